@@ -0,0 +1,156 @@
+/***********************************************************************
+TV Fleet Simulator
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+	"github.com/VDobryvechir/tvengine/pkg/tvplayer"
+)
+
+type FaultConfig struct {
+	Latency       time.Duration
+	Jitter        time.Duration
+	Loss          float64
+	DisconnectP   float64
+	DisconnectFor time.Duration
+	DiskRate      int
+	PartialP      float64
+}
+
+// FaultyHandler wraps a player and spoils its traffic according to FaultConfig,
+// all random decisions are taken from a seeded source, so a run can be repeated
+type FaultyHandler struct {
+	Config    *FaultConfig
+	Next      http.Handler
+	mu        sync.Mutex
+	random    *rand.Rand
+	downUntil time.Time
+	Stats     FaultStats
+}
+
+type FaultStats struct {
+	Requests    int
+	Lost        int
+	Disconnects int
+	Partial     int
+}
+
+func NewFaultyHandler(config *FaultConfig, next http.Handler, seed int64) *FaultyHandler {
+	return &FaultyHandler{Config: config, Next: next, random: rand.New(rand.NewSource(seed))}
+}
+
+func (h *FaultyHandler) decide() (delay time.Duration, lost bool, partial bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c := h.Config
+	h.Stats.Requests++
+	now := time.Now()
+	if now.Before(h.downUntil) {
+		h.Stats.Lost++
+		return 0, true, false
+	}
+	if c.DisconnectP > 0 && h.random.Float64() < c.DisconnectP {
+		h.downUntil = now.Add(c.DisconnectFor)
+		h.Stats.Disconnects++
+		h.Stats.Lost++
+		return 0, true, false
+	}
+	if c.Loss > 0 && h.random.Float64() < c.Loss {
+		h.Stats.Lost++
+		return 0, true, false
+	}
+	delay = c.Latency
+	if c.Jitter > 0 {
+		delay += time.Duration(h.random.Int63n(int64(c.Jitter)))
+	}
+	if c.PartialP > 0 && h.random.Float64() < c.PartialP {
+		h.Stats.Partial++
+		partial = true
+	}
+	return
+}
+
+func (h *FaultyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	delay, lost, partial := h.decide()
+	if lost {
+		dropConnection(w)
+		return
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if strings.HasPrefix(path, "upload/") && r.Method == http.MethodPost {
+		h.serveUpload(w, r, path, partial)
+		return
+	}
+	h.Next.ServeHTTP(w, r)
+}
+
+// serveUpload decodes the chunk, imitates a slow disk and, for partial replies, stores only the first
+// half of the chunk, so the player answers with a smaller offset than the server expects
+func (h *FaultyHandler) serveUpload(w http.ResponseWriter, r *http.Request, path string, partial bool) {
+	// the signature is checked before the chunk is cut, the player gets it as verified
+	player, isPlayer := h.Next.(*tvplayer.Player)
+	if isPlayer {
+		err := player.CheckSignature(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+	body, err := tvcontrol.OpenEncodedBody(r.Body, r.Header.Get("Content-Encoding"))
+	if err != nil {
+		dropConnection(w)
+		return
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		dropConnection(w)
+		return
+	}
+	// the player gets the decoded chunk, so it can be cut and the disk sees the real size
+	r.Header.Del("Content-Encoding")
+	if h.Config.DiskRate > 0 {
+		time.Sleep(time.Duration(len(data)) * time.Second / time.Duration(h.Config.DiskRate))
+	}
+	params := strings.Split(path[len("upload/"):], "_")
+	if partial && len(params) == 3 && len(data) > 1 {
+		data = data[:len(data)/2]
+		params[2] = strconv.Itoa(len(data))
+		r.URL.Path = "/upload/" + strings.Join(params, "_")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	if isPlayer {
+		player.ServeVerified(w, r)
+		return
+	}
+	h.Next.ServeHTTP(w, r)
+}
+
+func dropConnection(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	conn.Close()
+}
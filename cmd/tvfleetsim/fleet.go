@@ -0,0 +1,169 @@
+/***********************************************************************
+TV Fleet Simulator
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+	"github.com/VDobryvechir/tvengine/pkg/tvplayer"
+)
+
+type Device struct {
+	Index        int
+	Name         string
+	Id           string
+	Url          string
+	Player       *tvplayer.Player
+	Faults       *FaultyHandler
+	server       *http.Server
+	mu           sync.Mutex
+	started      time.Time
+	configAt     time.Time
+	readyAt      time.Time
+	convergedAt  time.Time
+	taskStatus   int
+	connectionSt int
+}
+
+type Fleet struct {
+	Devices []*Device
+}
+
+func StartFleet(amount int, host string, root string, faults *FaultConfig, seed int64) (*Fleet, error) {
+	fleet := &Fleet{Devices: make([]*Device, 0, amount)}
+	for i := 0; i < amount; i++ {
+		d, err := startDevice(i, host, root, faults, seed+int64(i))
+		if err != nil {
+			fleet.Stop()
+			return nil, err
+		}
+		fleet.Devices = append(fleet.Devices, d)
+	}
+	return fleet, nil
+}
+
+func startDevice(index int, host string, root string, faults *FaultConfig, seed int64) (*Device, error) {
+	name := fmt.Sprintf("sim-%03d", index+1)
+	player, err := tvplayer.NewPlayer(filepath.Join(root, name))
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	d := &Device{Index: index, Name: name, Player: player, started: time.Now()}
+	d.Url = "http://" + net.JoinHostPort(host, strconv.Itoa(port)) + "/"
+	d.Faults = NewFaultyHandler(faults, player, seed)
+	player.OnChange = d.onChange
+	d.server = &http.Server{Handler: d.Faults}
+	go d.server.Serve(listener)
+	return d, nil
+}
+
+func (d *Device) onChange(config *tvcontrol.TvConfig, ready bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if d.configAt.IsZero() {
+		d.configAt = now
+	}
+	if ready && d.readyAt.IsZero() {
+		d.readyAt = now
+	}
+}
+
+func (d *Device) updateTask(t *taskRecord) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.taskStatus = t.TaskStatus
+	d.connectionSt = t.ConnectionStatus
+	if t.TaskStatus == 1000 && d.convergedAt.IsZero() {
+		d.convergedAt = time.Now()
+	}
+}
+
+func (d *Device) Converged() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.convergedAt.IsZero()
+}
+
+func (f *Fleet) Stop() {
+	for _, d := range f.Devices {
+		if d.server != nil {
+			d.server.Close()
+		}
+	}
+}
+
+func (f *Fleet) Register(server *ServerClient) error {
+	for _, d := range f.Devices {
+		id, err := server.RegisterTvpc(d.Name, d.Url)
+		if err != nil {
+			return err
+		}
+		d.Id = id
+	}
+	return nil
+}
+
+func (f *Fleet) Ids() []string {
+	ids := make([]string, 0, len(f.Devices))
+	for _, d := range f.Devices {
+		if d.Id != "" {
+			ids = append(ids, d.Id)
+		}
+	}
+	return ids
+}
+
+// Poll reads the task table and returns true when every device has converged
+func (f *Fleet) Poll(server *ServerClient) (bool, error) {
+	tasks, err := server.ReadTasks()
+	if err != nil {
+		return false, err
+	}
+	all := true
+	for _, d := range f.Devices {
+		if t, ok := tasks[d.Id]; ok {
+			d.updateTask(t)
+		}
+		if !d.Converged() {
+			all = false
+		}
+	}
+	return all, nil
+}
+
+func since(start time.Time, end time.Time) string {
+	if start.IsZero() || end.IsZero() {
+		return "-"
+	}
+	return end.Sub(start).Round(time.Millisecond).String()
+}
+
+func (f *Fleet) Report(w io.Writer) {
+	fmt.Fprintf(w, "%-8s %-6s %-26s %7s %5s %10s %10s %10s %8s %6s %6s\n", "name", "id", "url", "status", "conn", "to-config", "to-ready", "converge", "requests", "lost", "part")
+	for _, d := range f.Devices {
+		d.mu.Lock()
+		d.Faults.mu.Lock()
+		stats := d.Faults.Stats
+		d.Faults.mu.Unlock()
+		fmt.Fprintf(w, "%-8s %-6s %-26s %7d %5d %10s %10s %10s %8d %6d %6d\n", d.Name, d.Id, d.Url, d.taskStatus, d.connectionSt,
+			since(d.started, d.configAt), since(d.configAt, d.readyAt), since(d.configAt, d.convergedAt), stats.Requests, stats.Lost, stats.Partial)
+		d.mu.Unlock()
+	}
+}
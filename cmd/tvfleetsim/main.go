@@ -0,0 +1,96 @@
+// package main is the entry point of the fleet simulator of fake TV PCs
+
+package main
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+)
+
+func main() {
+	amount := flag.Int("n", 10, "amount of simulated tv pcs")
+	serverUrl := flag.String("server", "http://localhost:80", "tvengine server to register the tv pcs at")
+	host := flag.String("host", "127.0.0.1", "address the server uses to reach the simulated tv pcs")
+	root := flag.String("dir", "", "folder for the received media, temporary if empty")
+	seed := flag.Int64("seed", 1, "seed for the random faults, the same seed repeats the same faults")
+	register := flag.Bool("register", true, "register the simulated tv pcs in the tvpc table")
+	cleanup := flag.Bool("cleanup", true, "delete the registered tv pcs at exit")
+	poll := flag.Duration("poll", 2*time.Second, "interval of reading the task table")
+	timeout := flag.Duration("timeout", 0, "stop after this time even if not converged, 0 waits for Ctrl+C")
+	exitOnConverge := flag.Bool("exit-on-converge", false, "stop when all tasks reach status 1000")
+	faults := &FaultConfig{}
+	flag.DurationVar(&faults.Latency, "latency", 0, "latency added to every request")
+	flag.DurationVar(&faults.Jitter, "jitter", 0, "random latency added to every request")
+	flag.Float64Var(&faults.Loss, "loss", 0, "probability of dropping a request without an answer")
+	flag.Float64Var(&faults.DisconnectP, "disconnect", 0, "probability of a request starting a disconnect")
+	flag.DurationVar(&faults.DisconnectFor, "disconnect-for", 30*time.Second, "duration of a disconnect")
+	flag.IntVar(&faults.DiskRate, "disk-rate", 0, "bytes per second written by a slow disk, 0 is unlimited")
+	flag.Float64Var(&faults.PartialP, "partial", 0, "probability of storing only a half of an uploaded chunk")
+	flag.Parse()
+
+	folder := *root
+	if folder == "" {
+		var err error
+		folder, err = os.MkdirTemp("", "tvfleetsim")
+		if err != nil {
+			dvlog.PrintError(err)
+			return
+		}
+		defer os.RemoveAll(folder)
+	}
+	fleet, err := StartFleet(*amount, *host, folder, faults, *seed)
+	if err != nil {
+		dvlog.PrintError(err)
+		return
+	}
+	defer fleet.Stop()
+	server := NewServerClient(*serverUrl)
+	if *register {
+		err = fleet.Register(server)
+		if *cleanup {
+			defer func() {
+				if err := server.DeleteTvpcs(fleet.Ids()); err != nil {
+					dvlog.PrintError(err)
+				}
+			}()
+		}
+		if err != nil {
+			dvlog.PrintError(err)
+			return
+		}
+	}
+	dvlog.PrintfFullOnly("Started %d simulated tv pcs, storage %s", len(fleet.Devices), folder)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	ticker := time.NewTicker(*poll)
+	defer ticker.Stop()
+	var deadline <-chan time.Time
+	if *timeout > 0 {
+		deadline = time.After(*timeout)
+	}
+	for running := true; running; {
+		select {
+		case <-interrupt:
+			running = false
+		case <-deadline:
+			dvlog.PrintlnError("Timeout reached before convergence")
+			running = false
+		case <-ticker.C:
+			if !*register {
+				continue
+			}
+			done, err := fleet.Poll(server)
+			if err != nil {
+				dvlog.PrintError(err)
+			} else if done && *exitOnConverge {
+				running = false
+			}
+		}
+	}
+	fleet.Report(os.Stdout)
+}
@@ -0,0 +1,111 @@
+/***********************************************************************
+TV Fleet Simulator
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const tvpcApi = "api/v1/tvpc"
+const taskApi = "api/v1/task"
+
+type ServerClient struct {
+	Url    string
+	Client *http.Client
+}
+
+type tvpcRecord struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+type taskRecord struct {
+	Id               string `json:"id"`
+	TaskStatus       int    `json:"taskStatus"`
+	ConnectionStatus int    `json:"connectionStatus"`
+}
+
+func NewServerClient(url string) *ServerClient {
+	if !strings.HasSuffix(url, "/") {
+		url += "/"
+	}
+	return &ServerClient{Url: url, Client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (s *ServerClient) call(method string, api string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, s.Url+api, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 {
+		return errors.New(strconv.Itoa(res.StatusCode) + " " + method + " " + api + " " + string(data))
+	}
+	if result == nil {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+// RegisterTvpc creates a tvpc record and returns its id
+func (s *ServerClient) RegisterTvpc(name string, url string) (string, error) {
+	res := &tvpcRecord{}
+	err := s.call(http.MethodPost, tvpcApi, &tvpcRecord{Name: name, Url: url}, res)
+	if err != nil {
+		return "", err
+	}
+	if res.Id == "" {
+		return "", errors.New("server did not return id for " + name)
+	}
+	return res.Id, nil
+}
+
+func (s *ServerClient) DeleteTvpcs(ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return s.call(http.MethodDelete, tvpcApi+"/"+strings.Join(ids, ","), nil, nil)
+}
+
+func (s *ServerClient) ReadTasks() (map[string]*taskRecord, error) {
+	var list []*taskRecord
+	err := s.call(http.MethodGet, taskApi, nil, &list)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]*taskRecord, len(list))
+	for _, t := range list {
+		if t != nil {
+			res[t.Id] = t
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,159 @@
+// package main is the entry point of the reference TV PC player agent
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+	"github.com/VDobryvechir/tvengine/pkg/tvplayer"
+)
+
+func main() {
+	listen := flag.String("listen", ":8085", "address to listen for the tvengine server")
+	root := flag.String("dir", "./tvplayer", "folder to keep the received config and media")
+	verbose := flag.Bool("verbose", false, "log every received config and chunk")
+	cert := flag.String("cert", "", "certificate file to listen with https")
+	key := flag.String("key", "", "key file of the certificate")
+	clientCa := flag.String("client-ca", "", "ca bundle of the accepted client certificates of the server")
+	requireSignature := flag.Bool("require-signature", false, "reject unsigned config and media even before the first key")
+	register := flag.String("register", "", "url of the tvengine server to register at until an admin approves the player")
+	url := flag.String("url", "", "url of this player for the server, required with -register")
+	name := flag.String("name", "", "name of the registered tvpc, the hardware id by default")
+	hardwareId := flag.String("hardware-id", "", "hardware id of the registration and announcements, machine id or host name by default")
+	announce := flag.String("announce", "", "udp address to broadcast the announcements to, like 255.255.255.255:8087")
+	pull := flag.String("pull", "", "url of the tvengine server to poll for the task instead of waiting for it")
+	id := flag.String("id", "", "tvpc id of the polled task and heartbeats, the id of the registration by default")
+	heartbeat := flag.String("heartbeat", "", "url of the tvengine server to send the heartbeats to")
+	flag.Parse()
+
+	player, err := tvplayer.NewPlayer(*root)
+	if err != nil {
+		dvlog.PrintError(err)
+		return
+	}
+	player.LogLevel = *verbose
+	player.RequireSignature = *requireSignature
+	player.OnChange = func(config *tvcontrol.TvConfig, ready bool) {
+		dvlog.PrintfFullOnly("Config with %d files, ready %v", len(config.File), ready)
+	}
+	if *hardwareId == "" {
+		*hardwareId = readHardwareId()
+	}
+	if *register != "" {
+		if *url == "" && *pull == "" {
+			dvlog.PrintError(errors.New("-register needs -url of this player or -pull"))
+			return
+		}
+		reg := &tvcontrol.TvpcRegistration{HardwareId: *hardwareId, Name: *name, Url: *url, Capabilities: getCapabilities(*cert != "")}
+		if *pull != "" {
+			reg.Mode = tvcontrol.TaskModePull
+		}
+		go player.RegisterUntilApproved(&http.Client{Timeout: 30 * time.Second}, *register, reg, registerRetryDelay)
+	}
+	if *pull != "" {
+		go player.PullEvery(&http.Client{Timeout: pullTimeout}, *pull, *id, pullInterval)
+	}
+	if *heartbeat != "" {
+		go player.HeartbeatEvery(&http.Client{Timeout: 30 * time.Second}, *heartbeat, *id, heartbeatInterval)
+	}
+	if *announce != "" {
+		a, err := getAnnouncement(*listen, *hardwareId, *name, *cert != "")
+		if err != nil {
+			dvlog.PrintError(err)
+			return
+		}
+		go player.AnnounceEvery(*announce, *a, announceInterval)
+	}
+	dvlog.PrintfFullOnly("Player listens at %s, storage %s", *listen, *root)
+	if token := player.PairingToken(); token != "" {
+		dvlog.PrintfFullOnly("Player has no key yet, its pairing token for POST /api/v1/tvpc/{id}/key is %s", token)
+	}
+	if *cert == "" {
+		err = http.ListenAndServe(*listen, player)
+	} else {
+		err = listenTls(*listen, player, *cert, *key, *clientCa)
+	}
+	if err != nil {
+		dvlog.PrintError(err)
+	}
+}
+
+// pause between the registrations while the tvpc waits for approval
+const registerRetryDelay = 15 * time.Second
+
+// pause between the polls of the task in pull mode
+const pullInterval = 30 * time.Second
+
+// a pulled chunk is not larger than the largest chunk of the server
+const pullTimeout = 5 * time.Minute
+
+// the first heartbeat interval, the server tells the next one
+const heartbeatInterval = 30 * time.Second
+
+// the server forgets an unknown player 10 minutes after its last announcement
+const announceInterval = 30 * time.Second
+
+// getAnnouncement takes the port of the listen address, the server sees the address itself
+func getAnnouncement(listen string, hardwareId string, name string, https bool) (*tvcontrol.Announcement, error) {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return nil, err
+	}
+	a := &tvcontrol.Announcement{HardwareId: hardwareId, Name: name, Scheme: "http"}
+	a.Port, err = strconv.Atoi(port)
+	if https {
+		a.Scheme = "https"
+	}
+	return a, err
+}
+
+// getCapabilities tells the server what this player supports
+func getCapabilities(https bool) []string {
+	res := []string{"signature", "peers", "checksum"}
+	for _, encoding := range tvcontrol.SupportedEncodings {
+		res = append(res, "encoding:"+encoding)
+	}
+	if https {
+		res = append(res, "https")
+	}
+	return res
+}
+
+// readHardwareId uses the machine id of linux and the host name elsewhere
+func readHardwareId() string {
+	data, err := os.ReadFile("/etc/machine-id")
+	if err == nil && len(strings.TrimSpace(string(data))) != 0 {
+		return strings.TrimSpace(string(data))
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+// listenTls accepts only the server with a client certificate of clientCa when it is set
+func listenTls(listen string, player *tvplayer.Player, cert string, key string, clientCa string) error {
+	server := &http.Server{Addr: listen, Handler: player, TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12}}
+	if clientCa != "" {
+		data, err := os.ReadFile(clientCa)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New("no certificate in " + clientCa)
+		}
+		server.TLSConfig.ClientCAs = pool
+		server.TLSConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return server.ListenAndServeTLS(cert, key)
+}
@@ -1,7 +1,13 @@
 module github.com/VDobryvechir/tvengine
 
-go 1.21.3
+go 1.22
 
 toolchain go1.22.3
 
-require github.com/Dobryvechir/microcore v1.0.5
+require (
+	github.com/Dobryvechir/microcore v1.0.5
+	github.com/klauspost/compress v1.18.0
+	github.com/lib/pq v1.4.0
+)
+
+require github.com/go-zookeeper/zk v1.0.2 // indirect
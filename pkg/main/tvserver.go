@@ -3,13 +3,46 @@
 package main
 
 import (
+	"os"
+	"os/signal"
+	"syscall"
+
 	_ "github.com/Dobryvechir/microcore/pkg/dvoc"
     "github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+    "github.com/VDobryvechir/tvengine/pkg/tvrelay"
     "github.com/Dobryvechir/microcore/pkg/dvconfig"
+    "github.com/Dobryvechir/microcore/pkg/dvlog"
 )
 
 func main() {
 	dvconfig.SetApplicationName("tvserver")
         tvcontrol.RunMainWorker()
+        tvrelay.RunRelay()
+        tvcontrol.RunDiscovery()
+        tvcontrol.RunLivenessCheck()
+	go shutdownOnSignal()
+	go reloadOnSignal()
 	dvconfig.ServerStart()
+	tvcontrol.ShutdownMainWorker()
+}
+
+// shutdownOnSignal lets the workers save their tasks before the container is stopped
+func shutdownOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	<-signals
+	tvcontrol.ShutdownMainWorker()
+	os.Exit(0)
+}
+
+// reloadOnSignal reads the TVSERVER_ properties again on SIGHUP
+func reloadOnSignal() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		err := tvcontrol.ReloadSettings("")
+		if err != nil {
+			dvlog.PrintError(err)
+		}
+	}
 }
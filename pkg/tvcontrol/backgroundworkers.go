@@ -6,60 +6,113 @@ Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
 package tvcontrol
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
-	"io"
 	"net/http"
+	"reflect"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
 	"github.com/Dobryvechir/microcore/pkg/dvlog"
 )
 
+// errEncodingRejected is the answer 415 of a player to a compressed body, the body is sent uncompressed next time
+var errEncodingRejected = errors.New("player does not accept the content encoding")
+
 type TaskWorker struct {
-	Id            string
-	Task          *TvTask
-	WakeUpChannel chan int
-	StopChannel   chan int
+	Id         string
+	Task       *TvTask
+	ChunkSize  int
+	throughput float64
+	// wakeUp has room for one signal, it is never closed, the worker is stopped by its context
+	wakeUp chan int
+	// control takes the controls of the task, which the worker applies between its steps
+	control chan *taskControlRequest
+	cancel  context.CancelFunc
+	// abort is cancelled when the shutdown deadline passes, the requests to the tv pc use it
+	abort context.Context
+	// done is closed when RunBackground returns
+	done chan struct{}
+	// encoding is the Content-Encoding accepted by the player, known after its status is read
+	encoding      string
+	encodingKnown bool
+	// peerProgressAt is the last time the peers of the tv pc brought it new files
+	peerProgressAt time.Time
+}
+
+func NewTaskWorker(id string, tvTask *TvTask) *TaskWorker {
+	return &TaskWorker{Id: id, Task: tvTask, wakeUp: make(chan int, 1), control: make(chan *taskControlRequest), done: make(chan struct{})}
+}
+
+// WakeUp makes the worker reload its task and run the next step without waiting for its delay
+func (task *TaskWorker) WakeUp(val int) bool {
+	select {
+	case task.wakeUp <- val:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done is closed when the worker has stopped
+func (task *TaskWorker) Done() <-chan struct{} {
+	return task.done
 }
 
-func (task *TaskWorker) RunBackground() {
+// RunBackground works on the task until ctx is cancelled or the task is no longer in the database
+func (task *TaskWorker) RunBackground(ctx context.Context) {
+	defer close(task.done)
 	err := task.LoadTask()
 	if err != nil {
 		dvlog.PrintError(err)
+		recordTaskEvent(task.Id, TaskEventStop, "", err.Error())
 		return
 	}
-	var delay int
+	recordTaskEvent(task.Id, TaskEventStart, task.Task.Phase, "")
+	var delay time.Duration
 	for {
 		res, err := task.RunNextTask()
 		if err != nil {
 			dvlog.PrintError(err)
-			delay = GetDelayInErrorCase()
+			delay = GetBackoffDelay(task.getFailures())
 		} else if res {
-			delay = GetDelayInOperationCase()
+			delay = time.Duration(GetDelayInOperationCase()) * time.Second
 		} else {
-			delay = GetDelayInIdleCase()
+			delay = time.Duration(GetDelayInIdleCase()) * time.Second
 		}
-		timer := time.NewTimer(time.Duration(delay) * time.Second)
+		timer := time.NewTimer(delay)
 		select {
-		case val := <-task.StopChannel:
-			if logLevel {
-				dvlog.PrintfFullOnly("b worker %s stopped %d", task.Id, val)
+		case <-ctx.Done():
+			timer.Stop()
+			if logLevel() {
+				dvlog.PrintfFullOnly("b worker %s stopped %v", task.Id, ctx.Err())
 			}
-			close(task.StopChannel)
-			close(task.WakeUpChannel)
+			recordTaskEvent(task.Id, TaskEventStop, task.getPhase(), ctx.Err().Error())
 			return
-		case wval := <-task.WakeUpChannel:
+		case wval := <-task.wakeUp:
+			timer.Stop()
 			err = task.LoadTask()
-			if logLevel || err != nil {
-				dvlog.PrintfFullOnly("b worker %s waken up %d %v", task.Id, wval)
+			if logLevel() || err != nil {
+				dvlog.PrintfFullOnly("b worker %s waken up %d %v", task.Id, wval, err)
 			}
+			if err == nil {
+				recordTaskEvent(task.Id, TaskEventWakeUp, task.getPhase(), "")
+			}
+		case req := <-task.control:
+			timer.Stop()
+			err = task.LoadTask()
+			if err == nil {
+				req.task, err = task.applyControl(req.control)
+			}
+			req.err = err
+			close(req.done)
 		case <-timer.C:
-			if logLevel {
-				dvlog.PrintfFullOnly("Continue to work by timer %d", delay)
+			if logLevel() {
+				dvlog.PrintfFullOnly("Continue to work by timer %v", delay)
 			}
 		}
 	}
@@ -73,113 +126,334 @@ func (task *TaskWorker) LoadTask() error {
 	if res == nil {
 		return errors.New("task no longer exists")
 	}
-	task.Task = &TvTask{}
-	err = res.DvVariableToAnyStruct(task.Task)
-	return err
+	t, err := rowToTask(res)
+	if err != nil {
+		return err
+	}
+	task.Task = t
+	return nil
 }
 
 func (task *TaskWorker) RunNextTask() (bool, error) {
-	if task == nil || task.Task == nil || len(task.Id) == 0 || len(task.Task.Url) == 0 {
+	// the player in pull mode asks for its task itself
+	if task == nil || task.Task == nil || len(task.Id) == 0 || len(task.Task.Url) == 0 || task.Task.Mode == TaskModePull {
 		return false, nil
 	}
 	t := task.Task
-	if len(t.NewPresentationId) == 0 || len(t.NewPresentationVersion) == 0 {
+	if t.NextKeyId != "" && t.NextKeyId != t.KeyId && getKeyWrapping(t) != nil {
+		return true, task.RunKeySending()
+	}
+	if len(t.NewPresentationId) == 0 || len(t.NewPresentationVersion) == 0 || t.Paused {
 		return false, task.RunCheckConnection()
 	}
-	if t.NewPresentationId != t.OldPresentationId || t.NewPresentationVersion != t.OldPresentationVersion {
+	switch t.Phase {
+	case PhasePending, PhaseSendingConfig:
 		return true, task.RunConfigSending()
-	}
-	if len(t.LeftFiles) != 0 {
+	case PhaseSendingFiles:
+		if !IsFileSendingAllowed(t.GroupId) {
+			return false, task.RunCheckConnection()
+		}
+		if task.isWaitingForPeers() {
+			return false, task.RunLeftFilesCheck()
+		}
 		return true, task.RunFileSending()
 	}
+	// done, failed, cancelled and superseded tasks only watch the player
 	return false, task.RunCheckConnection()
 }
 
+// RunCheckConnection polls GET status of a player without live heartbeats
 func (task *TaskWorker) RunCheckConnection() error {
+	if live, err := task.applyHeartbeat(time.Now()); live {
+		return err
+	}
 	t := task.Task
-	s, err := task.SendToComputer("status", "", "GET")
+	s, err := task.sendRequest(requestStatus, "status", "", "GET", nil)
 	if err != nil {
-		task.saveWrongConnectionStatus(t)
+		task.encodingKnown = false
+		task.saveWrongConnectionStatus(t, err)
 		return err
 	}
-	if logLevel {
+	task.encoding = parseStatusEncodings(s)
+	task.encodingKnown = true
+	if logLevel() {
 		dvlog.PrintfFullOnly("Connection %s %s", t.Url, s)
 	}
-	if t.ConnectionStatus != 0 {
-		t.ConnectionStatus = 0
+	relay := parseStatusRelay(s)
+	if t.connectionSucceeded() || !reflect.DeepEqual(relay, t.Relay) {
+		t.Relay = relay
 		err = task.saveConnectionStatus(t)
 		return err
 	}
 	return nil
 }
 
-func (task *TaskWorker) RunConfigSending() error {
+func (task *TaskWorker) sendConfig() (string, error) {
 	config := task.Task.Config
 	if config == nil {
-		return errors.New("no config in task")
+		return "", errors.New("no config in task")
 	}
 	body, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	data, encoding := encodeBody(string(body), task.getEncoding())
+	var headers map[string]string
+	if encoding != "" {
+		headers = map[string]string{"Content-Encoding": encoding}
+	}
+	res, err := task.sendRequest(requestConfig, configUrl, data, configMethod, headers)
+	if err == errEncodingRejected {
+		task.encoding = ""
+	}
+	return res, err
+}
+
+// getKeyWrapping returns the key which signs and wraps the next key: the pairing key when
+// the admin gave the pairing token of the player, else the key the player has; a player
+// without both gets no key and the unsigned requests as before
+func getKeyWrapping(t *TvTask) *PlayerKey {
+	if key := getPairingKey(t.Id); key != nil {
+		return key
+	}
+	return getTvpcKey(t.Id, t.KeyId)
+}
+
+// RunKeySending gives the next key of the tvpc to the player, wrapped and signed by the key
+// of getKeyWrapping; a player without key support answers 404 and receives the signed
+// requests as before
+func (task *TaskWorker) RunKeySending() error {
+	t := task.Task
+	key := getTvpcKey(t.Id, t.NextKeyId)
+	if key == nil {
+		return errors.New("no secret of key " + t.NextKeyId + " of tvpc " + t.Id)
+	}
+	by := getKeyWrapping(t)
+	if by == nil {
+		return errors.New("no key of tvpc " + t.Id + " to send key " + t.NextKeyId + " by")
+	}
+	wrapped, err := WrapKey(key, by)
 	if err != nil {
 		return err
 	}
-	res, err := task.SendToComputer(configUrl, string(body), configMethod)
+	body, err := json.Marshal(wrapped)
 	if err != nil {
-		task.saveWrongConnectionStatus(task.Task)
 		return err
 	}
-	if logLevel {
-		dvlog.Print("received from config " + task.Task.Id + " : " + res)
+	_, err = task.sendSignedRequest(requestConfig, keyUrl, string(body), keyMethod, nil, by)
+	if playerError, ok := err.(*PlayerError); ok && playerError.StatusCode == http.StatusNotFound {
+		dvlog.PrintfFullOnly("Player %s does not check signatures", t.Url)
+		err = nil
+	}
+	if err != nil {
+		task.saveWrongConnectionStatus(t, err)
+		return err
+	}
+	if logLevel() {
+		dvlog.PrintfFullOnly("Key %s is delivered to %s", t.NextKeyId, t.Id)
+	}
+	if by.Id == PairingKeyId {
+		err = savePairingToken(t.Id, "")
+		if err != nil {
+			dvlog.PrintError(err)
+		}
+	}
+	t.KeyId = t.NextKeyId
+	t.connectionSucceeded()
+	newTask, err := createOrUpdateTaskDatabaseForKeySending(t)
+	if err != nil {
+		return err
 	}
+	task.Task = newTask
+	return nil
+}
+
+func (task *TaskWorker) RunConfigSending() error {
 	t := task.Task
+	if t.Config == nil {
+		return errors.New("no config in task")
+	}
+	err := t.setPhase(PhaseSendingConfig)
+	if err != nil {
+		return err
+	}
+	res, err := task.sendConfig()
+	if err != nil {
+		task.saveWrongConnectionStatus(t, err)
+		return err
+	}
+	if logLevel() {
+		dvlog.Print("received from config " + t.Id + " : " + res)
+	}
 	err = analyzeComputerConfigSendingResponse(res, t)
 	if err != nil {
 		return err
 	}
-	t.ConnectionStatus = 0
-	t.TaskStatus = 1
-	if len(t.LeftFiles) == 0 {
-		t.LeftFiles = nil
-		t.TaskStatus = 1000
+	recordTaskEvent(t.Id, TaskEventConfig, t.Phase, "presentation "+t.NewPresentationId+" version "+t.NewPresentationVersion+", "+strconv.Itoa(len(t.LeftFiles))+" files left")
+	t.connectionSucceeded()
+	t.LastError = ""
+	t.Progress = 1
+	task.peerProgressAt = time.Now()
+	err = t.setReceivedPhase()
+	if err != nil {
+		return err
 	}
 	err = task.saveConfigSending(t)
 	return err
 }
 
-func (task *TaskWorker) RunFileSending() error {
-	fileUrl, body, hint, err := analyzeComputerFileSendingRequest(task.Task)
+// RunLeftFilesCheck sends the same config again to learn which files the tv pc still misses,
+// the player answers the left files without saving the config it already has
+func (task *TaskWorker) RunLeftFilesCheck() error {
+	res, err := task.sendConfig()
 	if err != nil {
+		task.saveWrongConnectionStatus(task.Task, err)
 		return err
 	}
-	if len(body) == 0 {
-		t := task.Task
-		t.LeftFiles = nil
-		t.ConnectionStatus = 0
-		t.TaskStatus = 1000
-		err = task.saveFileSending(t)
+	t := task.Task
+	before := t.Progress
+	err = analyzeComputerConfigSendingResponse(res, t)
+	if err != nil {
 		return err
 	}
-	res, err := task.SendToComputer(fileUrl, string(body), fileSendMethod)
+	err = calculateTaskStatus(t)
 	if err != nil {
-		task.saveWrongConnectionStatus(task.Task)
 		return err
 	}
-	if logLevel {
-		dvlog.Print("received from file sending " + task.Task.Id + " : " + res)
+	if t.Progress > before {
+		task.peerProgressAt = time.Now()
 	}
-	t := task.Task
-	err = analyzeComputerFileSendingResponse(res, hint, t)
+	if logLevel() {
+		dvlog.PrintfFullOnly("Peers of %s brought it to %d, left %v", t.Id, t.Progress, t.LeftFiles)
+	}
+	t.connectionSucceeded()
+	err = task.saveFileSending(t)
+	return err
+}
+
+func (task *TaskWorker) RunFileSending() error {
+	chunks, err := analyzeComputerFileSendingRequests(task.Task, task.getChunkSize(), GetParallelUploads())
 	if err != nil {
 		return err
 	}
-	if len(t.LeftFiles) == 0 {
-		t.LeftFiles = nil
-		t.TaskStatus = 1000
+	if len(chunks) == 0 {
+		t := task.Task
+		t.connectionSucceeded()
+		err = t.setPhase(PhaseDone)
+		if err != nil {
+			return err
+		}
+		err = task.saveFileSending(t)
+		return err
+	}
+	encoding := task.getEncoding()
+	results := task.sendFileChunks(chunks, encoding)
+	t := task.Task
+	var failure error
+	sent, connected := 0, false
+	var elapsed time.Duration
+	acks := make([]*TaskEvent, 0, len(results))
+	for i, r := range results {
+		if mismatch, ok := r.err.(*ChecksumError); ok {
+			connected = true
+			failure = r.err
+			applyChecksumMismatch(t, chunks[i].entry, mismatch)
+			continue
+		}
+		if r.err == errEncodingRejected {
+			task.encoding = ""
+		}
+		if r.err != nil {
+			if failure == nil {
+				failure = r.err
+			}
+			t.LastError = r.err.Error()
+			continue
+		}
+		connected = true
+		if logLevel() {
+			dvlog.Print("received from file sending " + t.Id + " : " + r.res)
+		}
+		applyFileChunkHint(t, chunks[i].entry, chunks[i].hint)
+		acks = append(acks, &TaskEvent{Kind: TaskEventChunk, Phase: t.Phase, Message: getChunkAckMessage(chunks[i])})
+		if len(chunks[i].body) > sent {
+			sent, elapsed = len(chunks[i].body), r.elapsed
+		}
+	}
+	// the acknowledged chunks of the batch are kept by one write of the events
+	recordTaskEvents(t.Id, acks)
+	if failure != nil {
+		task.adaptChunkSizeOnFailure()
+	} else {
+		task.adaptChunkSizeOnSuccess(sent, elapsed)
+		t.LastError = ""
+	}
+	t.ChunkSize = task.ChunkSize
+	if !connected {
+		task.saveWrongConnectionStatus(t, failure)
+		return failure
+	}
+	t.connectionSucceeded()
+	// a task failed for its mismatches keeps its phase
+	if t.Phase != PhaseFailed {
+		err = calculateTaskStatus(t)
+		if err != nil {
+			return err
+		}
 	}
-	t.ConnectionStatus = 0
 	err = task.saveFileSending(t)
+	if failure != nil {
+		return failure
+	}
 	return err
 }
 
+type fileChunkResult struct {
+	res     string
+	err     error
+	elapsed time.Duration
+}
+
+// sendFileChunks sends the chunks of different files at the same time,
+// the results are in the order of the chunks
+func (task *TaskWorker) sendFileChunks(chunks []*fileChunk, encoding string) []*fileChunkResult {
+	results := make([]*fileChunkResult, len(chunks))
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk *fileChunk) {
+			defer wg.Done()
+			results[i] = task.sendFileChunk(chunk, encoding)
+		}(i, chunk)
+	}
+	wg.Wait()
+	return results
+}
+
+// getChunkAckMessage tells the acknowledged chunk and where the file goes on
+func getChunkAckMessage(chunk *fileChunk) string {
+	if chunk.hint == "" {
+		return chunk.entry + " is complete"
+	}
+	return chunk.entry + " goes on from " + chunk.hint
+}
+
+// sendFileChunk compresses the chunk by the encoding the player accepts
+func (task *TaskWorker) sendFileChunk(chunk *fileChunk, accepted string) *fileChunkResult {
+	headers := map[string]string{ChunkDigestHeader: CalculateChunkDigest([]byte(chunk.body))}
+	data, encoding := chunk.body, ""
+	if isCompressibleFile(chunk.entry) {
+		data, encoding = encodeBody(chunk.body, accepted)
+	}
+	if encoding != "" {
+		headers["Content-Encoding"] = encoding
+	}
+	waitForBandwidth(task.getAbortContext(), task.Task.GroupId, len(data))
+	started := time.Now()
+	res, err := task.sendRequest(requestUpload, chunk.url, data, fileSendMethod, headers)
+	return &fileChunkResult{res: res, err: err, elapsed: time.Since(started)}
+}
+
 func (task *TaskWorker) GetComputerUrl() string {
 	s := task.Task.Url
 	if s == "" {
@@ -190,45 +464,82 @@ func (task *TaskWorker) GetComputerUrl() string {
 	}
 	p := strings.Index(s, "//")
 	if p < 0 {
-		return "http://" + s
+		return getPlayerScheme() + "://" + s
 	}
 	if p == 0 {
-		return "http:" + s
+		return getPlayerScheme() + ":" + s
 	}
 	return s
 }
 
-func (task *TaskWorker) SendToComputer(url string, body string, method string) (string, error) {
-	fullUrl := task.GetComputerUrl() + url
-	bodyIo := io.NopCloser(bytes.NewReader([]byte(body)))
-
-	req, err := http.NewRequest(method, fullUrl, bodyIo)
+// getEncoding asks the player for its status once to learn which compression it accepts,
+// an unreachable player gets uncompressed bodies and is asked again next time
+func (task *TaskWorker) getEncoding() string {
+	if task.encodingKnown {
+		return task.encoding
+	}
+	s, err := task.sendRequest(requestStatus, "status", "", "GET", nil)
 	if err != nil {
-		return "", err
+		return ""
+	}
+	task.encoding = parseStatusEncodings(s)
+	task.encodingKnown = true
+	return task.encoding
+}
+
+func (task *TaskWorker) getAbortContext() context.Context {
+	if task.abort == nil {
+		return context.Background()
 	}
+	return task.abort
+}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return "", err
+// getPhase returns the phase of the loaded task
+func (task *TaskWorker) getPhase() TaskPhase {
+	if task.Task == nil {
+		return ""
 	}
-	if res.StatusCode >= 300 {
-		return "", errors.New(strconv.Itoa(res.StatusCode) + " " + url + " " + method + " " + body)
+	return task.Task.Phase
+}
+
+// getFailures returns the number of failed connections in a row
+func (task *TaskWorker) getFailures() int {
+	if task.Task == nil {
+		return 0
 	}
+	return task.Task.Failures
+}
 
-	resBody, err := io.ReadAll(res.Body)
+// saveWrongConnectionStatus counts the failure and keeps its message, with the answer
+// of the player for a PlayerError, in lastError of the task
+func (task *TaskWorker) saveWrongConnectionStatus(t *TvTask, err error) error {
+	if task.getAbortContext().Err() != nil {
+		// the request was aborted by the shutdown, not by the tv pc
+		return nil
+	}
 	if err != nil {
-		return "", err
+		t.LastError = err.Error()
 	}
-	return string(resBody), nil
+	t.connectionFailed()
+	return task.saveConnectionStatus(t)
 }
 
-func (task *TaskWorker) saveWrongConnectionStatus(t *TvTask) error {
-	if t.ConnectionStatus < 0 {
-		t.ConnectionStatus = 1
-	} else {
-		t.ConnectionStatus++
+// applyChecksumMismatch keeps the chunk in LeftFiles to be resent, a wrong whole file is resent from the beginning;
+// the source of a file changed after the presentation was sent never matches its hash, so the task fails
+// after TVSERVER_TASK_MAX_MISMATCHES resent files
+func applyChecksumMismatch(t *TvTask, entry string, mismatch *ChecksumError) {
+	t.LastError = mismatch.Error()
+	if mismatch.Mismatch != MismatchFile {
+		return
+	}
+	applyFileChunkHint(t, entry, changeSeek(entry, 0))
+	t.Mismatches++
+	limit := readIntProperty("TVSERVER_TASK_MAX_MISMATCHES", defaultMaxMismatches)
+	if limit > 0 && t.Mismatches >= limit && t.isSending() {
+		t.LastError = "file " + changeSeek(entry, 0) + " does not match its hash after " + strconv.Itoa(t.Mismatches) + " resent files, its source may have changed: " + t.LastError
+		t.setPhase(PhaseFailed)
+		dvlog.PrintfFullOnly("Task %s failed: %s", t.Id, t.LastError)
 	}
-	return task.saveConnectionStatus(t)
 }
 
 func (task *TaskWorker) saveConnectionStatus(t *TvTask) error {
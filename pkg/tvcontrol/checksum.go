@@ -0,0 +1,113 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvparser"
+)
+
+// ChunkDigestHeader carries the hex sha-256 of the body of every upload/ request
+const ChunkDigestHeader = "X-Tv-Chunk-Sha256"
+
+// values of the mismatch field in the player answer with status 422
+const (
+	MismatchChunk = "chunk"
+	MismatchFile  = "file"
+)
+
+// the whole files resent for a mismatch before the task fails
+const defaultMaxMismatches = 3
+
+type ChecksumError struct {
+	Mismatch string `json:"mismatch"`
+	Message  string `json:"error"`
+}
+
+func (e *ChecksumError) Error() string {
+	return e.Mismatch + " checksum mismatch: " + e.Message
+}
+
+func parseChecksumError(body []byte) *ChecksumError {
+	e := &ChecksumError{}
+	if json.Unmarshal(body, e) != nil || (e.Mismatch != MismatchFile && e.Mismatch != MismatchChunk) {
+		e.Mismatch = MismatchChunk
+		e.Message = string(body)
+	}
+	return e
+}
+
+type fileHashEntry struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// hashes are cached by file name, size and modification time, so the same
+// video in many presentations is read only once
+var fileHashCache = make(map[string]*fileHashEntry)
+var fileHashCacheMu sync.Mutex
+
+func CalculateChunkDigest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func CalculateFileDigest(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func calculateRealFileHash(realFile string) (string, error) {
+	name := dvparser.GetByGlobalPropertiesOrDefault("HTML_PATH", "") + realFile
+	fi, err := os.Stat(name)
+	if err != nil {
+		return "", err
+	}
+	fileHashCacheMu.Lock()
+	entry, ok := fileHashCache[name]
+	fileHashCacheMu.Unlock()
+	if ok && entry.size == fi.Size() && entry.modTime.Equal(fi.ModTime()) {
+		return entry.hash, nil
+	}
+	hash, err := CalculateFileDigest(name)
+	if err != nil {
+		return "", err
+	}
+	fileHashCacheMu.Lock()
+	fileHashCache[name] = &fileHashEntry{size: fi.Size(), modTime: fi.ModTime(), hash: hash}
+	fileHashCacheMu.Unlock()
+	return hash, nil
+}
+
+func calculateRealFileHashes(realFiles []string) ([]string, error) {
+	n := len(realFiles)
+	res := make([]string, n)
+	for i := 0; i < n; i++ {
+		hash, err := calculateRealFileHash(realFiles[i])
+		if err != nil {
+			return nil, err
+		}
+		res[i] = hash
+	}
+	return res, nil
+}
@@ -0,0 +1,58 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestChecksumMismatchHandling(t *testing.T) {
+	e := parseChecksumError([]byte(`{"mismatch":"file","error":"bad"}`))
+	if e.Mismatch != MismatchFile || e.Message != "bad" {
+		t.Errorf("unexpected %v", e)
+	}
+	if e = parseChecksumError([]byte("plain text")); e.Mismatch != MismatchChunk {
+		t.Errorf("unknown answers must be treated as a chunk mismatch, got %v", e)
+	}
+	if d := CalculateChunkDigest([]byte("abc")); d != "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad" {
+		t.Errorf("wrong digest %s", d)
+	}
+
+	tvTask := &TvTask{LeftFiles: []string{"b-20.png", "a-10.png:6"}}
+	applyChecksumMismatch(tvTask, "a-10.png:6", &ChecksumError{Mismatch: MismatchChunk})
+	if tvTask.LeftFiles[1] != "a-10.png:6" || tvTask.LastError == "" {
+		t.Errorf("chunk mismatch must keep the offset, got %v %s", tvTask.LeftFiles, tvTask.LastError)
+	}
+	applyChecksumMismatch(tvTask, "a-10.png:6", &ChecksumError{Mismatch: MismatchFile})
+	if tvTask.LeftFiles[1] != "a-10.png:0" || tvTask.LeftFiles[0] != "b-20.png" {
+		t.Errorf("file mismatch must restart the file, got %v", tvTask.LeftFiles)
+	}
+}
+
+func TestTaskFailsAfterFileMismatches(t *testing.T) {
+	defer SetPropertyForTest("TVSERVER_TASK_MAX_MISMATCHES", "2")()
+	tvTask := &TvTask{Id: "9201", Url: "http://127.0.0.1:1/", NewPresentationId: "1", NewPresentationVersion: "1", Phase: PhaseSendingFiles, LeftFiles: []string{"a-10.png:6"}}
+	applyChecksumMismatch(tvTask, "a-10.png:6", &ChecksumError{Mismatch: MismatchFile})
+	if tvTask.Phase != PhaseSendingFiles || tvTask.Mismatches != 1 {
+		t.Fatalf("first file mismatch must resend the file: %s %d", tvTask.Phase, tvTask.Mismatches)
+	}
+	applyChecksumMismatch(tvTask, "a-10.png:0", &ChecksumError{Mismatch: MismatchChunk})
+	if tvTask.Mismatches != 1 {
+		t.Errorf("chunk mismatch must not be counted, got %d", tvTask.Mismatches)
+	}
+	applyChecksumMismatch(tvTask, "a-10.png:0", &ChecksumError{Mismatch: MismatchFile})
+	if tvTask.Phase != PhaseFailed || !strings.Contains(tvTask.LastError, "a-10.png") {
+		t.Errorf("task must fail after 2 file mismatches: %s %s", tvTask.Phase, tvTask.LastError)
+	}
+	task := &TaskWorker{Id: "9201", Task: tvTask}
+	if res, _ := task.RunNextTask(); res {
+		t.Error("failed task must not send its files")
+	}
+	if err := tvTask.applyControl(TaskControlRetry); err != nil || tvTask.Mismatches != 0 {
+		t.Errorf("retry must count the mismatches again: %v %d", err, tvTask.Mismatches)
+	}
+}
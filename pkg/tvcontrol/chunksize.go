@@ -0,0 +1,88 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+)
+
+const defaultChunkSize = 1 << 19
+const defaultMinChunkSize = 1 << 16
+const defaultMaxChunkSize = 1 << 23
+
+// a chunk is sized to be uploaded in about this time with the measured throughput
+const chunkTargetDuration = 2 * time.Second
+
+// GetChunkSizeLimits returns TVSERVER_CHUNK_MIN and TVSERVER_CHUNK_MAX in bytes
+func GetChunkSizeLimits() (int, int) {
+	min := readIntProperty("TVSERVER_CHUNK_MIN", defaultMinChunkSize)
+	max := readIntProperty("TVSERVER_CHUNK_MAX", defaultMaxChunkSize)
+	if min <= 0 {
+		min = defaultMinChunkSize
+	}
+	if max < min {
+		max = min
+	}
+	return min, max
+}
+
+func limitChunkSize(size int) int {
+	min, max := GetChunkSizeLimits()
+	if size < min {
+		return min
+	}
+	if size > max {
+		return max
+	}
+	return size
+}
+
+func (task *TaskWorker) getChunkSize() int {
+	if task.ChunkSize <= 0 {
+		task.ChunkSize = defaultChunkSize
+		if task.Task != nil && task.Task.ChunkSize > 0 {
+			task.ChunkSize = task.Task.ChunkSize
+		}
+	}
+	task.ChunkSize = limitChunkSize(task.ChunkSize)
+	return task.ChunkSize
+}
+
+// adaptChunkSizeOnSuccess moves the chunk size to the amount sent in chunkTargetDuration,
+// but not more than twice per step; the throughput grows by averaging and drops at once;
+// small last chunks of files are not representative
+func (task *TaskWorker) adaptChunkSizeOnSuccess(sent int, elapsed time.Duration) {
+	size := task.getChunkSize()
+	if sent < size/2 || elapsed <= 0 {
+		return
+	}
+	throughput := float64(sent) / elapsed.Seconds()
+	if task.throughput > 0 && throughput > task.throughput {
+		throughput = (task.throughput + throughput) / 2
+	}
+	task.throughput = throughput
+	target := int(throughput * chunkTargetDuration.Seconds())
+	if target > size*2 {
+		target = size * 2
+	} else if target < size/2 {
+		target = size / 2
+	}
+	task.ChunkSize = limitChunkSize(target)
+	if logLevel() && task.ChunkSize != size {
+		dvlog.PrintfFullOnly("Chunk size of %s changed from %d to %d at %.0f bytes/s", task.Id, size, task.ChunkSize, throughput)
+	}
+}
+
+func (task *TaskWorker) adaptChunkSizeOnFailure() {
+	size := task.getChunkSize()
+	task.throughput = 0
+	task.ChunkSize = limitChunkSize(size / 2)
+	if logLevel() && task.ChunkSize != size {
+		dvlog.PrintfFullOnly("Chunk size of %s reduced from %d to %d after failure", task.Id, size, task.ChunkSize)
+	}
+}
@@ -0,0 +1,46 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAdaptiveChunkSize(t *testing.T) {
+	defer SetPropertyForTest("TVSERVER_CHUNK_MIN", "1000")()
+	defer SetPropertyForTest("TVSERVER_CHUNK_MAX", "64000")()
+
+	task := &TaskWorker{Id: "chunks", Task: &TvTask{ChunkSize: 8000}}
+	if n := task.getChunkSize(); n != 8000 {
+		t.Fatalf("chunk size must start from the task record, got %d", n)
+	}
+	// 8000 bytes in 0.1s is 80000 bytes/s, which is 160000 for 2s, but growth is limited by twice
+	task.adaptChunkSizeOnSuccess(8000, 100*time.Millisecond)
+	if task.ChunkSize != 16000 {
+		t.Errorf("chunk size must double, got %d", task.ChunkSize)
+	}
+	for i := 0; i < 5; i++ {
+		task.adaptChunkSizeOnSuccess(task.ChunkSize, 100*time.Millisecond)
+	}
+	if task.ChunkSize != 64000 {
+		t.Errorf("chunk size must stop at TVSERVER_CHUNK_MAX, got %d", task.ChunkSize)
+	}
+	task.adaptChunkSizeOnSuccess(100, time.Millisecond)
+	if task.ChunkSize != 64000 {
+		t.Errorf("small last chunks must not change the size, got %d", task.ChunkSize)
+	}
+	task.adaptChunkSizeOnSuccess(64000, 8*time.Second)
+	if task.ChunkSize != 32000 {
+		t.Errorf("slow upload must halve the size, got %d", task.ChunkSize)
+	}
+	for i := 0; i < 10; i++ {
+		task.adaptChunkSizeOnFailure()
+	}
+	if task.ChunkSize != 1000 {
+		t.Errorf("failures must stop at TVSERVER_CHUNK_MIN, got %d", task.ChunkSize)
+	}
+}
@@ -18,14 +18,15 @@ import (
 	"github.com/Dobryvechir/microcore/pkg/dvtextutils"
 )
 
-const packageSize = 1 << 19
-
 const configUrl = "config"
 const configMethod = "POST"
 
 const fileSendUrl = "upload/"
 const fileSendMethod = "POST"
 
+const keyUrl = "key"
+const keyMethod = "POST"
+
 func getLeftFiles(r string) ([]string, error) {
 	res := make(map[string]int, 10)
 	err := json.Unmarshal([]byte(r), &res)
@@ -60,33 +61,50 @@ func analyzeComputerConfigSendingResponse(r string, t *TvTask) error {
 	return nil
 }
 
-func analyzeComputerFileSendingResponse(r string, hint string, t *TvTask) error {
-	if len(hint) == 0 {
-		t.LeftFiles = t.LeftFiles[1:]
-	} else if len(t.LeftFiles) > 0 {
-		t.LeftFiles[0] = hint
-	}
-	if logLevel {
-		dvlog.PrintfFullOnly("Left %v, response %s", t.LeftFiles, r)
+// applyFileChunkHint moves the entry of LeftFiles to the seek of hint, an empty hint means the file is complete
+func applyFileChunkHint(t *TvTask, entry string, hint string) {
+	for i, s := range t.LeftFiles {
+		if s != entry {
+			continue
+		}
+		if len(hint) == 0 {
+			t.LeftFiles = append(t.LeftFiles[:i:i], t.LeftFiles[i+1:]...)
+		} else {
+			t.LeftFiles[i] = hint
+		}
+		return
 	}
+}
+
+// calculateTaskStatus gives the progress 1 for the sent config and 1000 for all files received,
+// the partially received files are counted by their received parts; the task is done or sending files
+func calculateTaskStatus(t *TvTask) error {
+	t.ensurePhase()
 	m := len(t.RealFiles)
 	p := len(t.LeftFiles)
 	if m == 0 || p == 0 {
-		t.TaskStatus = 1000
 		t.LeftFiles = nil
 	} else {
-		done := (m-p)*999/m + 1
-		subCurrent := getCurrentSeek(t.LeftFiles[0])
-		subTotal := getFullSeek(t.LeftFiles[0])
+		t.Progress = calculateProgress(t.LeftFiles, m)
+	}
+	err := t.setReceivedPhase()
+	t.setLegacyStatus()
+	return err
+}
+
+func calculateProgress(leftFiles []string, m int) int {
+	done := (m-len(leftFiles))*999/m + 1
+	for _, s := range leftFiles {
+		subCurrent := getCurrentSeek(s)
+		subTotal := getFullSeek(s)
 		if subTotal > 0 {
 			done += subCurrent * 999 / (m * subTotal)
 		}
-		if done > 999 {
-			done = 999
-		}
-		t.TaskStatus = done
 	}
-	return nil
+	if done > 999 {
+		done = 999
+	}
+	return done
 }
 
 func getCurrentSeek(s string) int {
@@ -134,45 +152,57 @@ func changeSeek(s string, newSeek int) string {
 	return s
 }
 
-func analyzeComputerFileSendingRequest(t *TvTask) (url string, body string, hint string, err error) {
-	for len(t.LeftFiles) > 0 {
-		p := t.LeftFiles[0]
+// fileChunk is the next chunk of the entry of LeftFiles, hint is the entry after the chunk is received
+type fileChunk struct {
+	entry string
+	url   string
+	body  string
+	hint  string
+}
+
+// analyzeComputerFileSendingRequests takes one chunk of each of the first amount files in LeftFiles,
+// complete and unknown files are removed from LeftFiles
+func analyzeComputerFileSendingRequests(t *TvTask, chunkSize int, amount int) ([]*fileChunk, error) {
+	chunks := make([]*fileChunk, 0, amount)
+	for i := 0; i < len(t.LeftFiles) && len(chunks) < amount; {
+		p := t.LeftFiles[i]
 		current := getCurrentSeek(p)
 		total := getFullSeek(p)
 		if current >= total {
-                        if logLevel {
-                           dvlog.PrintfError("Left files removed %s because current %d reached size %d", p, current, total)
-                        }
-			t.LeftFiles = t.LeftFiles[1:]
+			if logLevel() {
+				dvlog.PrintfError("Left files removed %s because current %d reached size %d", p, current, total)
+			}
+			t.LeftFiles = append(t.LeftFiles[:i:i], t.LeftFiles[i+1:]...)
 			continue
 		}
+		chunk := &fileChunk{entry: p}
 		dif := total - current
-		if dif > packageSize {
-			dif = packageSize
-			hint = changeSeek(t.LeftFiles[0], current+dif)
+		if dif > chunkSize {
+			dif = chunkSize
+			chunk.hint = changeSeek(p, current+dif)
+		}
+		index, name, err := detectRealFileName(t, p)
+		if logLevel() {
+			dvlog.PrintfError("Hint %s index %d name %s err %v", chunk.hint, index, name, err)
 		}
-		index, name, err2 := detectRealFileName(t, t.LeftFiles[0])
-                if logLevel {
-                     dvlog.PrintfError("Hint %s index %d name %s err %v", hint, index, name, err2)
-                }
-		if err2 != nil {
-			dvlog.PrintError(err2)
-			t.LeftFiles = t.LeftFiles[1:]
+		if err != nil {
+			dvlog.PrintError(err)
+			t.LeftFiles = append(t.LeftFiles[:i:i], t.LeftFiles[i+1:]...)
 			continue
 		}
-		data, err1 := readFileWithSeek(name, current, dif)
-		url = fileSendUrl + strconv.Itoa(index) + "_" + strconv.Itoa(current) + "_" + strconv.Itoa(len(data))
-                if logLevel {
-                     dvlog.PrintfError("Seek %s url %s data-len %d err %v", name , url, len(data), err1)
-                }
-		if err1 != nil {
-			err = err1
-			return
+		data, err := readFileWithSeek(name, current, dif)
+		chunk.url = fileSendUrl + strconv.Itoa(index) + "_" + strconv.Itoa(current) + "_" + strconv.Itoa(len(data))
+		if logLevel() {
+			dvlog.PrintfError("Seek %s url %s data-len %d err %v", name, chunk.url, len(data), err)
 		}
-		body = string(data)
-		return
+		if err != nil {
+			return nil, err
+		}
+		chunk.body = string(data)
+		chunks = append(chunks, chunk)
+		i++
 	}
-	return
+	return chunks, nil
 }
 
 func readFileWithSeek(name string, seek int, amount int) ([]byte, error) {
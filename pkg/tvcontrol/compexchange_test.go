@@ -0,0 +1,137 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/Dobryvechir/microcore/pkg/dvparser"
+)
+
+func TestSeekArithmetic(t *testing.T) {
+	cases := []struct {
+		name    string
+		current int
+		full    int
+	}{
+		{"i583747_7721532218530737715-1071263.png", 0, 1071263},
+		{"i583747_7721532218530737715-1071263.png:524288", 524288, 1071263},
+		{"v12_0-300.mp4:299", 299, 300},
+		{"nosize.png", 0, 0},
+	}
+	for _, c := range cases {
+		if n := getCurrentSeek(c.name); n != c.current {
+			t.Errorf("getCurrentSeek(%s)=%d, expected %d", c.name, n, c.current)
+		}
+		if n := getFullSeek(c.name); n != c.full {
+			t.Errorf("getFullSeek(%s)=%d, expected %d", c.name, n, c.full)
+		}
+	}
+	if s := changeSeek("v12_0-300.mp4:10", 20); s != "v12_0-300.mp4:20" {
+		t.Errorf("changeSeek gave %s", s)
+	}
+	if s := changeSeek("v12_0-300.mp4", 20); s != "v12_0-300.mp4:20" {
+		t.Errorf("changeSeek gave %s", s)
+	}
+}
+
+func TestGetLeftFiles(t *testing.T) {
+	res, err := getLeftFiles(`{"a-10.png":0,"media/b-20.png":5}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(res)
+	if !reflect.DeepEqual(res, []string{"a-10.png", "b-20.png:5"}) {
+		t.Errorf("unexpected left files %v", res)
+	}
+}
+
+func TestFileSendingProgress(t *testing.T) {
+	task := &TvTask{RealFiles: []string{"a", "b"}, LeftFiles: []string{"a-1000.png", "b-1000.png"}}
+	applyFileChunkHint(task, "a-1000.png", "a-1000.png:500")
+	calculateTaskStatus(task)
+	if task.TaskStatus != 250 {
+		t.Errorf("half of the first file must give 250, got %d", task.TaskStatus)
+	}
+	applyFileChunkHint(task, "a-1000.png:500", "")
+	calculateTaskStatus(task)
+	if task.TaskStatus != 500 || !reflect.DeepEqual(task.LeftFiles, []string{"b-1000.png"}) {
+		t.Errorf("first file done must give 500, got %d %v", task.TaskStatus, task.LeftFiles)
+	}
+	applyFileChunkHint(task, "b-1000.png", "")
+	calculateTaskStatus(task)
+	if task.TaskStatus != 1000 || task.LeftFiles != nil {
+		t.Errorf("all files done must give 1000, got %d %v", task.TaskStatus, task.LeftFiles)
+	}
+}
+
+func TestFileSendingRequestChunks(t *testing.T) {
+	folder := dvparser.GetByGlobalPropertiesOrDefault("HTML_PATH", "")
+	packageSize := 70000
+	size := packageSize + 100
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	err := os.WriteFile(filepath.Join(folder, "chunks.mp4"), data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "v1_0-" + strconv.Itoa(size) + ".mp4"
+	task := &TvTask{Config: &TvConfig{File: []string{"other.png", name}}, RealFiles: []string{"/other.png", "/chunks.mp4"}, LeftFiles: []string{name}}
+	chunks, err := analyzeComputerFileSendingRequests(task, packageSize, 1)
+	if err != nil || len(chunks) != 1 {
+		t.Fatal(err, chunks)
+	}
+	c := chunks[0]
+	if c.url != fileSendUrl+"1_0_"+strconv.Itoa(packageSize) || len(c.body) != packageSize || c.hint != name+":"+strconv.Itoa(packageSize) {
+		t.Errorf("unexpected first chunk %s %d %s", c.url, len(c.body), c.hint)
+	}
+	applyFileChunkHint(task, c.entry, c.hint)
+	chunks, err = analyzeComputerFileSendingRequests(task, packageSize, 1)
+	if err != nil || len(chunks) != 1 {
+		t.Fatal(err, chunks)
+	}
+	c = chunks[0]
+	if c.url != fileSendUrl+"1_"+strconv.Itoa(packageSize)+"_100" || c.body != string(data[packageSize:]) || c.hint != "" {
+		t.Errorf("unexpected last chunk %s %d %s", c.url, len(c.body), c.hint)
+	}
+	task.LeftFiles = []string{name + ":" + strconv.Itoa(size), "unknown-10.png"}
+	chunks, err = analyzeComputerFileSendingRequests(task, packageSize, 1)
+	if err != nil || len(chunks) != 0 || len(task.LeftFiles) != 0 {
+		t.Errorf("complete and unknown files must be skipped, got %d %v %v", len(chunks), task.LeftFiles, err)
+	}
+}
+
+func TestParallelFileSendingRequests(t *testing.T) {
+	writeHtmlFile(t, "p1.png", 300)
+	writeHtmlFile(t, "p2.png", 100)
+	writeHtmlFile(t, "p3.png", 100)
+	task := &TvTask{Config: &TvConfig{File: []string{"p1-300.png", "p2-100.png", "p3-100.png"}}, RealFiles: []string{"/p1.png", "/p2.png", "/p3.png"},
+		LeftFiles: []string{"p1-300.png:100", "p0-10.png", "p2-100.png:100", "p3-100.png"}}
+	chunks, err := analyzeComputerFileSendingRequests(task, 150, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 || chunks[0].url != fileSendUrl+"0_100_150" || chunks[1].url != fileSendUrl+"2_0_100" {
+		t.Fatalf("unexpected chunks %v", chunks)
+	}
+	if !reflect.DeepEqual(task.LeftFiles, []string{"p1-300.png:100", "p3-100.png"}) {
+		t.Errorf("complete and unknown files must be removed, got %v", task.LeftFiles)
+	}
+	applyFileChunkHint(task, chunks[1].entry, chunks[1].hint)
+	applyFileChunkHint(task, chunks[0].entry, chunks[0].hint)
+	calculateTaskStatus(task)
+	// two files of three are done and 250 bytes of 300 of the first one
+	if task.TaskStatus != 666+1+277 || !reflect.DeepEqual(task.LeftFiles, []string{"p1-300.png:250"}) {
+		t.Errorf("unexpected progress %d %v", task.TaskStatus, task.LeftFiles)
+	}
+}
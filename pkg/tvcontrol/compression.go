@@ -0,0 +1,131 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// the content encodings built in, the player lists the encodings it accepts in the
+// encodings field of its status answer
+const (
+	EncodingZstd = "zstd"
+	EncodingGzip = "gzip"
+)
+
+// SupportedEncodings are the encodings the server can send, in the order of preference
+var SupportedEncodings = []string{EncodingZstd, EncodingGzip}
+
+// the encoder is safe for concurrent EncodeAll calls, so all workers share it
+var zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+
+// ErrUnsupportedEncoding is returned for a Content-Encoding the player cannot decode
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// a compressed chunk is sent only if it saves at least 1/compressionGain of the bytes
+const compressionGain = 10
+
+// these formats are compressed already, so compressing them again only spends cpu
+var incompressibleExtensions = map[string]bool{
+	"mp4":  true,
+	"webm": true,
+	"jpg":  true,
+	"jpeg": true,
+	"gif":  true,
+	"webp": true,
+}
+
+type playerStatus struct {
+	Encodings []string       `json:"encodings"`
+	Relay     *RelayProgress `json:"relay"`
+}
+
+// parseStatusEncodings selects the preferred encoding from the status answer, old players
+// have no encodings field or answer with plain text, they get uncompressed bodies
+func parseStatusEncodings(body string) string {
+	status := &playerStatus{}
+	if json.Unmarshal([]byte(body), status) != nil {
+		return ""
+	}
+	return selectEncoding(status.Encodings)
+}
+
+// selectEncoding gives the preferred encoding of the encodings accepted by the player
+func selectEncoding(encodings []string) string {
+	for _, supported := range SupportedEncodings {
+		for _, encoding := range encodings {
+			if strings.EqualFold(strings.TrimSpace(encoding), supported) {
+				return supported
+			}
+		}
+	}
+	return ""
+}
+
+func isCompressibleFile(name string) bool {
+	if pos := strings.Index(name, ":"); pos > 0 {
+		name = name[:pos]
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+	return !incompressibleExtensions[ext]
+}
+
+func compressBody(data []byte, encoding string) ([]byte, error) {
+	if encoding == EncodingZstd {
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	if encoding != EncodingGzip {
+		return nil, ErrUnsupportedEncoding
+	}
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(data)
+	if err1 := w.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeBody returns the body and its Content-Encoding, the body stays as it is
+// when there is no encoding or the compression does not pay off
+func encodeBody(body string, encoding string) (string, string) {
+	if encoding == "" || len(body) == 0 {
+		return body, ""
+	}
+	data, err := compressBody([]byte(body), encoding)
+	if err != nil || len(data) > len(body)-len(body)/compressionGain {
+		return body, ""
+	}
+	return string(data), encoding
+}
+
+// OpenEncodedBody returns the reader of the decoded body for the Content-Encoding of the request
+func OpenEncodedBody(body io.Reader, encoding string) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return io.NopCloser(body), nil
+	case EncodingGzip:
+		return gzip.NewReader(body)
+	case EncodingZstd:
+		d, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, ErrUnsupportedEncoding
+}
@@ -0,0 +1,72 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestParseStatusEncodings(t *testing.T) {
+	cases := map[string]string{
+		`{"status":"UP","encodings":["br","GZIP"]}`:   EncodingGzip,
+		`{"status":"UP","encodings":["gzip","zstd"]}`: EncodingZstd,
+		`{"status":"UP","encodings":["br"]}`:          "",
+		`{"status":"UP"}`:                             "",
+		`UP`:                                          "",
+	}
+	for body, expected := range cases {
+		if res := parseStatusEncodings(body); res != expected {
+			t.Errorf("parseStatusEncodings(%s)=%s, expected %s", body, res, expected)
+		}
+	}
+}
+
+func TestEncodeBody(t *testing.T) {
+	plain := strings.Repeat("screen ", 1000)
+	for _, supported := range SupportedEncodings {
+		data, encoding := encodeBody(plain, supported)
+		if encoding != supported || len(data) >= len(plain) {
+			t.Fatalf("repeated text must be compressed by %s, got %d bytes %q", supported, len(data), encoding)
+		}
+		r, err := OpenEncodedBody(strings.NewReader(data), encoding)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := io.ReadAll(r)
+		r.Close()
+		if err != nil || string(res) != plain {
+			t.Errorf("%s decoded body differs: %v", supported, err)
+		}
+	}
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	data, encoding := encodeBody(string(random), EncodingZstd)
+	if encoding != "" || data != string(random) {
+		t.Errorf("random data must be sent as it is, got %q", encoding)
+	}
+	if _, encoding = encodeBody(plain, ""); encoding != "" {
+		t.Errorf("no encoding must be used if the player accepts none")
+	}
+	if isCompressibleFile("v1_0-300.mp4:100") || !isCompressibleFile("i1_0-300.png") {
+		t.Errorf("wrong compressible files")
+	}
+	if _, err := OpenEncodedBody(strings.NewReader(""), "br"); err != ErrUnsupportedEncoding {
+		t.Errorf("br must be unsupported, got %v", err)
+	}
+}
+
+func TestParseStatusRelay(t *testing.T) {
+	relay := parseStatusRelay(`{"status":"UP","relay":{"version":"12","tvpcs":20,"done":15,"taskStatus":870}}`)
+	if relay == nil || *relay != (RelayProgress{Version: "12", Tvpcs: 20, Done: 15, TaskStatus: 870}) {
+		t.Errorf("unexpected relay progress %v", relay)
+	}
+	if relay = parseStatusRelay(`{"status":"UP"}`); relay != nil {
+		t.Errorf("a player must have no relay progress, got %v", relay)
+	}
+}
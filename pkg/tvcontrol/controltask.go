@@ -90,7 +90,20 @@ const (
 )
 
 var processFunctions = map[string]dvaction.ProcessFunction{
-	CommandTvControl: {Init: TvControlInit, Run: TvControlRun},
+	CommandTvControl:      {Init: TvControlInit, Run: TvControlRun},
+	CommandTvpcKey:        {Init: TvpcKeyInit, Run: TvpcKeyRun},
+	CommandTvpcRegister:   {Init: TvpcRegisterInit, Run: TvpcRegisterRun},
+	CommandTvpcApprove:    {Init: TvpcApproveInit, Run: TvpcApproveRun},
+	CommandTvpcDiscovered: {Init: TvpcDiscoveredInit, Run: TvpcDiscoveredRun},
+	CommandPlayerPull:     {Init: PlayerPullInit, Run: PlayerPullRun},
+	CommandPlayerLiveness: {Init: PlayerLivenessInit, Run: PlayerLivenessRun},
+	CommandTaskEvents:     {Init: TaskEventsInit, Run: TaskEventsRun},
+	CommandTaskPause:      {Init: TaskPauseInit, Run: TaskControlRun},
+	CommandTaskResume:     {Init: TaskResumeInit, Run: TaskControlRun},
+	CommandTaskCancel:     {Init: TaskCancelInit, Run: TaskControlRun},
+	CommandTaskRetry:      {Init: TaskRetryInit, Run: TaskControlRun},
+	CommandTvpcRollback:   {Init: RollbackInit, Run: TvpcRollbackRun},
+	CommandGroupRollback:  {Init: RollbackInit, Run: GroupRollbackRun},
 }
 
 func Init() bool {
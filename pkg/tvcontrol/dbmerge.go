@@ -0,0 +1,116 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+	"github.com/Dobryvechir/microcore/pkg/dvtextutils"
+)
+
+// the records are read, merged and written under this lock, so the workers and
+// the web actions of tvcontrol do not lose the fields of each other
+var recordMu sync.Mutex
+
+var wholeRecordConditions = []string{"DEFAULT"}
+var wholeRecordFields = []string{""}
+
+// updateRecordByConditions works as dvdbmanager.CreateOrUpdateByConditionsAndUpdateFields,
+// but the fields are merged here: CopyFieldsFromOther of microcore copies the fields
+// of a record to itself, so the listed fields were never taken from the other record
+func updateRecordByConditions(table string, row *dvevaluation.DvVariable, conditions []string, fields []string) (*dvevaluation.DvVariable, error) {
+	if row == nil || len(conditions) == 0 || len(conditions) != len(fields) {
+		return nil, errors.New("incorrect update of " + table)
+	}
+	recordMu.Lock()
+	defer recordMu.Unlock()
+	previous, err := dvdbmanager.RecordReadOne(table, row.ReadSimpleChildValue("id"))
+	if err != nil || previous == nil {
+		// only a new record can be created, no field is merged
+		return dvdbmanager.CreateOrUpdateByConditionsAndUpdateFields(table, row, conditions, fields)
+	}
+	n, err := findMetCondition(previous, row, conditions)
+	if err != nil {
+		return nil, err
+	}
+	if n < 0 {
+		return previous, nil
+	}
+	res := mergeRecordFields(previous, row, fields[n])
+	return dvdbmanager.CreateOrUpdateByConditionsAndUpdateFields(table, res, wholeRecordConditions, wholeRecordFields)
+}
+
+func findMetCondition(previous *dvevaluation.DvVariable, current *dvevaluation.DvVariable, conditions []string) (int, error) {
+	var env *dvevaluation.DvObject
+	for i, condition := range conditions {
+		switch condition {
+		case "NEW":
+			continue
+		case "DEFAULT":
+			return i, nil
+		}
+		if env == nil {
+			env = dvdbmanager.CreateEnvironmentForPreviousCurrent(previous, current)
+		}
+		r, err := env.EvaluateAnyTypeExpression(condition)
+		if err != nil {
+			return 0, errors.New("Error in expression " + condition + ":" + err.Error())
+		}
+		if dvevaluation.AnyToBoolean(r) {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// mergeRecordFields applies the fields of the met condition: "a,b" takes the current record
+// with a and b of the previous one, "^a,b" keeps the previous record with a and b of the current
+// one, "!a,b" keeps the previous record with a and b cleaned, an empty list takes the current record
+func mergeRecordFields(previous *dvevaluation.DvVariable, current *dvevaluation.DvVariable, fields string) *dvevaluation.DvVariable {
+	fields = strings.TrimSpace(fields)
+	if fields == "" {
+		return current
+	}
+	switch fields[0] {
+	case '!':
+		list := dvtextutils.ConvertToNonEmptyList(fields[1:])
+		if len(list) == 0 {
+			return previous
+		}
+		previous.CleanFields(list)
+		return previous
+	case '^':
+		list := dvtextutils.ConvertToNonEmptyList(fields[1:])
+		if len(list) == 0 {
+			return previous
+		}
+		for _, name := range list {
+			copyRecordField(previous, current, name)
+		}
+		return previous
+	}
+	for _, name := range dvtextutils.ConvertToNonEmptyList(fields) {
+		copyRecordField(current, previous, name)
+	}
+	return current
+}
+
+// copyRecordField sets the field of dst to the field of src, a field missing in src is removed
+func copyRecordField(dst *dvevaluation.DvVariable, src *dvevaluation.DvVariable, name string) {
+	for _, f := range src.Fields {
+		if f != nil && string(f.Name) == name {
+			dst.SetField(name, f)
+			return
+		}
+	}
+	if n := dst.FindIndex(name); n >= 0 {
+		dst.Fields = append(dst.Fields[:n], dst.Fields[n+1:]...)
+	}
+}
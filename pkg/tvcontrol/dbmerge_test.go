@@ -0,0 +1,102 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+)
+
+func TestTaskFieldsAreMerged(t *testing.T) {
+	_, err := createOrUpdateTaskDatabase(&TvTask{Id: "9100", Name: "merge", Url: "http://merge", KeyId: "1"}, taskConditionsForWeb, taskFieldsForWeb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dvdbmanager.RecordDelete(taskDbName, "9100")
+
+	res, err := createOrUpdateTaskDatabaseForConnectionStatus(&TvTask{Id: "9100", Name: "changed", ConnectionStatus: 5, LastError: "timeout"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.ConnectionStatus != 5 || res.LastError != "timeout" || res.Name != "merge" || res.Url != "http://merge" {
+		t.Errorf("^ must keep the previous record with the listed fields of the current one, got %+v", res)
+	}
+	// a new presentation keeps the key known to the player and brings the key of the tvpc
+	_, err = createOrUpdateTaskDatabase(&TvTask{Id: "9100", Name: "merge", Url: "http://merge", NewPresentationId: "3", NextKeyId: "2"}, taskConditionsForWeb, taskFieldsForWeb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := readTask(t, "9100")
+	if task.KeyId != "1" || task.NextKeyId != "2" || task.NewPresentationId != "3" || task.ConnectionStatus != 5 {
+		t.Errorf("listed fields must be kept from the previous record, got %+v", task)
+	}
+}
+
+func mergeRow(t *testing.T, fields map[string]string) *dvevaluation.DvVariable {
+	t.Helper()
+	row, err := dvevaluation.AnyStructToDvVariable(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return row
+}
+
+func TestMergeRecordFields(t *testing.T) {
+	cases := []struct {
+		fields   string
+		expected map[string]string
+	}{
+		// the current record with a and d of the previous one, d missing in the previous one is removed
+		{"a,d", map[string]string{"id": "1", "a": "a0", "b": "b1"}},
+		// the previous record with a of the current one, c missing in the current one is removed
+		{"^a,c", map[string]string{"id": "1", "a": "a1", "b": "b0"}},
+		// the previous record with a and b cleaned to empty values
+		{"!a,b", map[string]string{"id": "1", "a": "", "b": "", "c": "c0"}},
+		{"", map[string]string{"id": "1", "a": "a1", "b": "b1", "d": "d1"}},
+		{"^", map[string]string{"id": "1", "a": "a0", "b": "b0", "c": "c0"}},
+	}
+	for _, c := range cases {
+		previous := mergeRow(t, map[string]string{"id": "1", "a": "a0", "b": "b0", "c": "c0"})
+		current := mergeRow(t, map[string]string{"id": "1", "a": "a1", "b": "b1", "d": "d1"})
+		res := mergeRecordFields(previous, current, c.fields)
+		got := make(map[string]string)
+		for _, f := range res.Fields {
+			got[string(f.Name)] = string(f.Value)
+		}
+		if !reflect.DeepEqual(got, c.expected) {
+			t.Errorf("fields %q gave %v, expected %v", c.fields, got, c.expected)
+		}
+	}
+}
+
+func TestUpdateRecordByConditions(t *testing.T) {
+	defer dvdbmanager.RecordDelete(taskDbName, "9103")
+	conditions := []string{"NEW", "previous.name == current.name"}
+	fields := []string{"", "^url"}
+	res, err := updateRecordByConditions(taskDbName, mergeRow(t, map[string]string{"id": "9103", "name": "first", "url": "u1"}), conditions, fields)
+	if err != nil || res == nil || res.ReadSimpleChildValue("url") != "u1" {
+		t.Fatalf("NEW must create the record: %v %v", res, err)
+	}
+	res, err = updateRecordByConditions(taskDbName, mergeRow(t, map[string]string{"id": "9103", "name": "first", "url": "u2", "lastError": "e"}), conditions, fields)
+	if err != nil || res.ReadSimpleChildValue("url") != "u2" || res.ReadSimpleChildValue("lastError") != "" {
+		t.Errorf("met condition must merge its fields: %v %v", res, err)
+	}
+	// no condition is met, the previous record stays as it is
+	res, err = updateRecordByConditions(taskDbName, mergeRow(t, map[string]string{"id": "9103", "name": "other", "url": "u3"}), conditions, fields)
+	if err != nil || res.ReadSimpleChildValue("url") != "u2" || res.ReadSimpleChildValue("name") != "first" {
+		t.Errorf("record must stay when no condition is met: %v %v", res, err)
+	}
+	res, err = updateRecordByConditions(taskDbName, mergeRow(t, map[string]string{"id": "9104", "name": "none"}), []string{"DEFAULT"}, []string{"^name"})
+	if err != nil || res != nil {
+		t.Errorf("only NEW creates a record: %v %v", res, err)
+	}
+	if _, err = updateRecordByConditions(taskDbName, mergeRow(t, map[string]string{"id": "9103"}), conditions, fields[:1]); err == nil {
+		t.Error("conditions and fields of different lengths must fail")
+	}
+}
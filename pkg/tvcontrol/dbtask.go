@@ -8,6 +8,7 @@ package tvcontrol
 import (
 	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
 	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
 )
 
 const taskDbName = "task"
@@ -18,40 +19,57 @@ var taskConditionsForWeb = []string{
 	"DEFAULT",
 }
 
+// the key known to the player is kept, the key of the tvpc comes as the next key;
+// a new presentation starts in the pending phase and is not paused
 var taskFieldsForWeb = []string{
 	"",
-	"oldPresentationId,oldPresentationName,oldPresentationVersion,leftFiles,taskStatus,connectionStatus",
-	"oldPresentationId,oldPresentationName,oldPresentationVersion,connectionStatus",
+	"oldPresentationId,oldPresentationName,oldPresentationVersion,leftFiles,phase,paused,progress,taskStatus,failures,mismatches,contacted,connectionStatus,chunkSize,keyId",
+	"oldPresentationId,oldPresentationName,oldPresentationVersion,failures,contacted,connectionStatus,chunkSize,keyId",
 }
 
 const taskConditionsForConfigSendingPart1 = "current.newPresentationVersion=="
 const taskConditionsForConfigSendingPart2 = " && current.newPresentationId=="
 
+// the url is kept as well, the discovery may change it during the step;
+// the phase of a task for a changed url is cleaned to be derived as pending again
 var taskFieldsForConfigSending = []string{
-	"!oldPresentationId,oldPresentationName,oldPresentationVersion",
-	"name,newPresentationName",
-	"name,newPresentationId,newPresentationName,newPresentationVersion,config,realFiles,leftFiles,taskStatus",
+	"!oldPresentationId,oldPresentationName,oldPresentationVersion,phase",
+	"name,url,newPresentationName,nextKeyId",
+	"name,url,newPresentationId,newPresentationName,newPresentationVersion,config,realFiles,leftFiles,phase,paused,progress,taskStatus,groupId",
 }
 
 var taskFieldsForFileSending = []string{
-	"!oldPresentationId,oldPresentationName,oldPresentationVersion",
-	"name,newPresentationName",
-	"^oldPresentationId,oldPresentationName,oldPresentationVersion,connectionStatus",
+	"!oldPresentationId,oldPresentationName,oldPresentationVersion,phase",
+	"name,url,newPresentationName,nextKeyId",
+	"^oldPresentationId,oldPresentationName,oldPresentationVersion,failures,contacted,connectionStatus",
 }
 
 var taskConditionsForConnectionCheck = []string{
 	"DEFAULT",
 }
 
-// all fields except ConnectionStatus must be here
+// all fields except the connection ones must be here, the phase is taken
+// only for the same presentation, where too many failures fail the task
 var taskFieldsForConnectionCheck = []string{
-	"^connectionStatus",
+	"^phase,failures,contacted,connectionStatus,relay,lastError",
+	"^failures,contacted,connectionStatus,relay,lastError",
+}
+
+// the delivered key is saved, a newer next key of a rotation stays
+var taskFieldsForKeySending = []string{
+	"^keyId,failures,contacted,connectionStatus,lastError",
+}
+
+// the rotated key of the tvpc is delivered by its task if there is one
+var taskFieldsForKeyRotation = []string{
+	"^nextKeyId",
 }
 
 func createOrUpdateTaskDatabaseForWeb(tasks []*TvTask) (res []*dvevaluation.DvVariable, err error) {
 	n := len(tasks)
 	res = make([]*dvevaluation.DvVariable, n)
 	for i := 0; i < n; i++ {
+		recordPresentationChange(tasks[i])
 		res[i], err = createOrUpdateTaskDatabase(tasks[i], taskConditionsForWeb, taskFieldsForWeb)
 		if err != nil {
 			return
@@ -60,12 +78,32 @@ func createOrUpdateTaskDatabaseForWeb(tasks []*TvTask) (res []*dvevaluation.DvVa
 	return
 }
 
+// recordPresentationChange keeps the events of the tvpc whose presentation is replaced by the task,
+// its unfinished task is superseded and the new one is pending
+func recordPresentationChange(task *TvTask) {
+	presentation := "presentation " + task.NewPresentationId + " version " + task.NewPresentationVersion
+	previous, err := dvdbmanager.RecordReadOne(taskDbName, task.Id)
+	if err != nil || previous == nil {
+		recordTaskEvent(task.Id, TaskEventPhase, PhasePending, presentation)
+		return
+	}
+	t, err := rowToTask(previous)
+	if err != nil || t.NewPresentationId == task.NewPresentationId && t.NewPresentationVersion == task.NewPresentationVersion {
+		return
+	}
+	if t.isSending() && CanChangePhase(t.Phase, PhaseSuperseded) {
+		dvlog.PrintfFullOnly("Task %s of presentation %s version %s is superseded by %s in phase %s", t.Id, t.NewPresentationId, t.NewPresentationVersion, presentation, t.Phase)
+		recordTaskEvent(t.Id, TaskEventPhase, PhaseSuperseded, "from "+string(t.Phase)+" by "+presentation)
+	}
+	recordTaskEvent(task.Id, TaskEventPhase, PhasePending, presentation)
+}
+
 func createOrUpdateTaskDatabase(task *TvTask, taskConditions []string, taskFields []string) (*dvevaluation.DvVariable, error) {
-	rowTask, err := dvevaluation.AnyStructToDvVariable(task)
+	rowTask, err := taskToRow(task)
 	if err != nil {
 		return nil, err
 	}
-	res, err := dvdbmanager.CreateOrUpdateByConditionsAndUpdateFields(taskDbName, rowTask, taskConditions, taskFields)
+	res, err := updateRecordByConditions(taskDbName, rowTask, taskConditions, taskFields)
 	return res, err
 }
 
@@ -81,56 +119,67 @@ func createOrUpdateTaskDatabaseForConfigSending(task *TvTask) (*TvTask, error) {
 	task.OldPresentationId = task.NewPresentationId
 	task.OldPresentationName = task.NewPresentationName
 	task.OldPresentationVersion = task.NewPresentationVersion
-	rowTask, err := dvevaluation.AnyStructToDvVariable(task)
+	rowTask, err := taskToRow(task)
 	if err != nil {
 		return nil, err
 	}
 	taskConditions := getCoincidenceConditions(task)
-	res, err := dvdbmanager.CreateOrUpdateByConditionsAndUpdateFields(taskDbName, rowTask, taskConditions, taskFieldsForConfigSending)
+	res, err := updateRecordByConditions(taskDbName, rowTask, taskConditions, taskFieldsForConfigSending)
 	if err != nil {
 		return nil, err
 	}
 	if res == nil {
 		return nil, nil
 	}
-	tsk := &TvTask{}
-	err = res.DvVariableToAnyStruct(tsk)
-	return tsk, err
+	return rowToTask(res)
 }
 
-// it is assumed that the only changed fiedls are LeftFiles and TaskStatus, possibly also ConnectionStatus
+// it is assumed that the only changed fiedls are LeftFiles, Phase and Progress, possibly also Failures
 func createOrUpdateTaskDatabaseForFileSending(task *TvTask) (*TvTask, error) {
-	rowTask, err := dvevaluation.AnyStructToDvVariable(task)
+	rowTask, err := taskToRow(task)
 	if err != nil {
 		return nil, err
 	}
 	taskConditions := getCoincidenceConditions(task)
-	res, err := dvdbmanager.CreateOrUpdateByConditionsAndUpdateFields(taskDbName, rowTask, taskConditions, taskFieldsForFileSending)
+	res, err := updateRecordByConditions(taskDbName, rowTask, taskConditions, taskFieldsForFileSending)
 	if err != nil {
 		return nil, err
 	}
 	if res == nil {
 		return nil, nil
 	}
-	tsk := &TvTask{}
-	err = res.DvVariableToAnyStruct(tsk)
-	return tsk, err
+	return rowToTask(res)
 }
 
-// it is assumed that the only changed fiedls is ConnectionStatus
+// it is assumed that the only changed fiedls are Failures, Contacted, Relay and LastError, possibly also Phase
 func createOrUpdateTaskDatabaseForConnectionStatus(task *TvTask) (*TvTask, error) {
-	rowTask, err := dvevaluation.AnyStructToDvVariable(task)
+	rowTask, err := taskToRow(task)
 	if err != nil {
 		return nil, err
 	}
-	res, err := dvdbmanager.CreateOrUpdateByConditionsAndUpdateFields(taskDbName, rowTask, taskConditionsForConnectionCheck, taskFieldsForConnectionCheck)
+	taskConditions, taskFields := taskConditionsForConnectionCheck, taskFieldsForConnectionCheck[1:]
+	if task.NewPresentationId != "" && task.NewPresentationVersion != "" {
+		taskConditions, taskFields = []string{getCoincidenceInTask(task), "DEFAULT"}, taskFieldsForConnectionCheck
+	}
+	res, err := updateRecordByConditions(taskDbName, rowTask, taskConditions, taskFields)
 	if err != nil {
 		return nil, err
 	}
 	if res == nil {
 		return nil, nil
 	}
-	tsk := &TvTask{}
-	err = res.DvVariableToAnyStruct(tsk)
-	return tsk, err
+	return rowToTask(res)
+}
+
+// it is assumed that the only changed fields are KeyId, Failures, Contacted and LastError
+func createOrUpdateTaskDatabaseForKeySending(task *TvTask) (*TvTask, error) {
+	rowTask, err := taskToRow(task)
+	if err != nil {
+		return nil, err
+	}
+	res, err := updateRecordByConditions(taskDbName, rowTask, taskConditionsForConnectionCheck, taskFieldsForKeySending)
+	if err != nil || res == nil {
+		return nil, err
+	}
+	return rowToTask(res)
 }
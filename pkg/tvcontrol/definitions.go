@@ -8,6 +8,8 @@ package tvcontrol
 type TvConfig struct {
 	File     []string `json:"file"`
 	Duration []int    `json:"duration"`
+	Hash     []string `json:"hash,omitempty"`
+	Peer     []string `json:"peer,omitempty"`
 }
 
 type TvScreen struct {
@@ -17,18 +19,32 @@ type TvScreen struct {
 }
 
 type TvTask struct {
-	Id                     string    `json:"id"`
-	Name                   string    `json:"name"`
-	Url                    string    `json:"url"`
-	OldPresentationId      string    `json:"oldPresentationId"`
-	OldPresentationName    string    `json:"oldPresentationName"`
-	OldPresentationVersion string    `json:"oldPresentationVersion"`
-	NewPresentationId      string    `json:"newPresentationId"`
-	NewPresentationName    string    `json:"newPresentationName"`
-	NewPresentationVersion string    `json:"newPresentationVersion"`
-	Config                 *TvConfig `json:"config"`
-	RealFiles              []string  `json:"realFiles"`
-	LeftFiles              []string  `json:"leftFiles"`
-	TaskStatus             int       `json:"taskStatus"`
-	ConnectionStatus       int       `json:"connectionStatus"`
+	Id                     string         `json:"id"`
+	Name                   string         `json:"name"`
+	Url                    string         `json:"url"`
+	OldPresentationId      string         `json:"oldPresentationId"`
+	OldPresentationName    string         `json:"oldPresentationName"`
+	OldPresentationVersion string         `json:"oldPresentationVersion"`
+	NewPresentationId      string         `json:"newPresentationId"`
+	NewPresentationName    string         `json:"newPresentationName"`
+	NewPresentationVersion string         `json:"newPresentationVersion"`
+	Config                 *TvConfig      `json:"config"`
+	RealFiles              []string       `json:"realFiles"`
+	LeftFiles              []string       `json:"leftFiles"`
+	Phase                  TaskPhase      `json:"phase"`
+	Progress               int            `json:"progress"`
+	Failures               int            `json:"failures"`
+	Contacted              bool           `json:"contacted"`
+	Paused                 bool           `json:"paused"`
+	TaskStatus             int            `json:"taskStatus"`
+	Mismatches             int            `json:"mismatches"`
+	ConnectionStatus       int            `json:"connectionStatus"`
+	LastError              string         `json:"lastError"`
+	ChunkSize              int            `json:"chunkSize"`
+	GroupId                string         `json:"groupId"`
+	Relay                  *RelayProgress `json:"relay,omitempty"`
+	Pin                    string         `json:"pin,omitempty"`
+	KeyId                  string         `json:"keyId,omitempty"`
+	NextKeyId              string         `json:"nextKeyId,omitempty"`
+	Mode                   string         `json:"mode,omitempty"`
 }
@@ -5,18 +5,60 @@ Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
 
 package tvcontrol
 
+import (
+	"math/rand"
+	"time"
+)
+
+// the defaults of the delays in seconds, TVSERVER_ERROR_DELAY, TVSERVER_IDLE_DELAY
+// and TVSERVER_OPERATION_DELAY take their place when they are set
 var delayInErrorCase = 30
 var delayInIdleCase = 60
 var delayInOperationCase = 0
 
+// a player offline for long is asked at most once per TVSERVER_BACKOFF_MAX seconds
+const defaultBackoffMax = 3600
+
+// the delay after an error varies by this part not to ask all players at once
+const backoffJitter = 0.2
+
 func GetDelayInErrorCase() int {
-	return delayInErrorCase
+	return readIntProperty("TVSERVER_ERROR_DELAY", delayInErrorCase)
 }
 
 func GetDelayInIdleCase() int {
-	return delayInIdleCase
+	return readIntProperty("TVSERVER_IDLE_DELAY", delayInIdleCase)
 }
 
 func GetDelayInOperationCase() int {
-	return delayInOperationCase
+	return readIntProperty("TVSERVER_OPERATION_DELAY", delayInOperationCase)
+}
+
+// GetBackoffMax returns TVSERVER_BACKOFF_MAX, the longest delay after errors in seconds
+func GetBackoffMax() int {
+	return readIntProperty("TVSERVER_BACKOFF_MAX", defaultBackoffMax)
+}
+
+// getBackoffLimit doubles the error delay with every failed connection in a row
+// counted by failures, up to the backoff maximum
+func getBackoffLimit(failures int) time.Duration {
+	delay := time.Duration(GetDelayInErrorCase()) * time.Second
+	limit := time.Duration(GetBackoffMax()) * time.Second
+	if limit < delay {
+		limit = delay
+	}
+	for i := 1; i < failures && delay < limit; i++ {
+		delay *= 2
+	}
+	if delay > limit {
+		delay = limit
+	}
+	return delay
+}
+
+// GetBackoffDelay returns the delay after an error with the jitter of backoffJitter
+func GetBackoffDelay(failures int) time.Duration {
+	delay := getBackoffLimit(failures)
+	jitter := time.Duration(float64(delay) * backoffJitter * (2*rand.Float64() - 1))
+	return delay + jitter
 }
@@ -0,0 +1,225 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+)
+
+const groupDbName = "group"
+
+// group "0" is the default group of all tv pcs, it has no record and uses the global settings
+const defaultGroupId = "0"
+
+// chunks of different files sent to one tv pc at the same time
+const defaultParallelUploads = 4
+
+// group settings are read from the group table not more often than this
+const groupSettingsTtl = time.Minute
+
+type groupSettings struct {
+	bandwidth int
+	window    []deliveryWindow
+	readAt    time.Time
+}
+
+// deliveryWindow is a daily interval in minutes from midnight, from > to passes midnight
+type deliveryWindow struct {
+	from int
+	to   int
+}
+
+// bandwidthLimiter lets a chunk go when the bytes of the previous chunks are paid at rate bytes/s
+type bandwidthLimiter struct {
+	mu   sync.Mutex
+	rate int
+	next time.Time
+}
+
+var globalLimiter = &bandwidthLimiter{}
+var groupLimiters = make(map[string]*bandwidthLimiter)
+var groupSettingsCache = make(map[string]*groupSettings)
+var deliveryMu sync.Mutex
+
+func parseDayTime(s string) (int, error) {
+	p := strings.Index(s, ":")
+	if p <= 0 {
+		return 0, errors.New("time must be HH:MM: " + s)
+	}
+	h, err := strconv.Atoi(strings.TrimSpace(s[:p]))
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.Atoi(strings.TrimSpace(s[p+1:]))
+	if err != nil {
+		return 0, err
+	}
+	if h < 0 || h > 24 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, errors.New("incorrect time " + s)
+	}
+	return h*60 + m, nil
+}
+
+// parseDeliveryWindows reads windows like 22:00-06:00,12:00-13:00, empty means always
+func parseDeliveryWindows(s string) ([]deliveryWindow, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	parts := strings.Split(s, ",")
+	res := make([]deliveryWindow, 0, len(parts))
+	for _, part := range parts {
+		p := strings.Index(part, "-")
+		if p <= 0 {
+			return nil, errors.New("window must be HH:MM-HH:MM: " + part)
+		}
+		from, err := parseDayTime(part[:p])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseDayTime(part[p+1:])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, deliveryWindow{from: from, to: to})
+	}
+	return res, nil
+}
+
+func isInDeliveryWindow(windows []deliveryWindow, now time.Time) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	minute := now.Hour()*60 + now.Minute()
+	for _, w := range windows {
+		if w.from <= w.to {
+			if minute >= w.from && minute < w.to {
+				return true
+			}
+		} else if minute >= w.from || minute < w.to {
+			return true
+		}
+	}
+	return false
+}
+
+func readGroupSettings(groupId string) *groupSettings {
+	bandwidth := ""
+	window := readProperty("TVSERVER_DELIVERY_WINDOW", "")
+	if groupId != "" && groupId != defaultGroupId {
+		group, err := dvdbmanager.RecordReadOne(groupDbName, groupId)
+		if err != nil {
+			dvlog.PrintError(err)
+		} else if group != nil {
+			bandwidth = group.ReadSimpleChildValue("bandwidth")
+			if w := group.ReadSimpleChildValue("window"); w != "" {
+				window = w
+			}
+		}
+	}
+	settings := &groupSettings{readAt: time.Now()}
+	if bandwidth != "" {
+		n, err := strconv.Atoi(bandwidth)
+		if err != nil || n < 0 {
+			dvlog.PrintlnError("Incorrect bandwidth " + bandwidth + " in group " + groupId)
+		} else {
+			settings.bandwidth = n
+		}
+	}
+	windows, err := parseDeliveryWindows(window)
+	if err != nil {
+		dvlog.PrintlnError("Incorrect delivery window in group " + groupId + ": " + err.Error())
+	} else {
+		settings.window = windows
+	}
+	return settings
+}
+
+func getGroupSettings(groupId string) *groupSettings {
+	deliveryMu.Lock()
+	settings, ok := groupSettingsCache[groupId]
+	deliveryMu.Unlock()
+	if ok && time.Since(settings.readAt) < groupSettingsTtl {
+		return settings
+	}
+	settings = readGroupSettings(groupId)
+	deliveryMu.Lock()
+	groupSettingsCache[groupId] = settings
+	deliveryMu.Unlock()
+	return settings
+}
+
+// IsFileSendingAllowed tells whether the group is in its delivery window now
+func IsFileSendingAllowed(groupId string) bool {
+	return isInDeliveryWindow(getGroupSettings(groupId).window, time.Now())
+}
+
+func (l *bandwidthLimiter) reserve(rate int, amount int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	if rate <= 0 {
+		return 0
+	}
+	start := l.next
+	if start.Before(now) {
+		start = now
+	}
+	l.next = start.Add(time.Duration(amount) * time.Second / time.Duration(rate))
+	return start.Sub(now)
+}
+
+func getGroupLimiter(groupId string) *bandwidthLimiter {
+	deliveryMu.Lock()
+	defer deliveryMu.Unlock()
+	l, ok := groupLimiters[groupId]
+	if !ok {
+		l = &bandwidthLimiter{}
+		groupLimiters[groupId] = l
+	}
+	return l
+}
+
+// waitForBandwidth sleeps until the chunk fits into the global TVSERVER_BANDWIDTH
+// and the group bandwidth caps, both in bytes per second, 0 means no cap
+func waitForBandwidth(ctx context.Context, groupId string, amount int) {
+	now := time.Now()
+	wait := globalLimiter.reserve(readIntProperty("TVSERVER_BANDWIDTH", 0), amount, now)
+	groupRate := getGroupSettings(groupId).bandwidth
+	if groupRate > 0 {
+		if w := getGroupLimiter(groupId).reserve(groupRate, amount, now); w > wait {
+			wait = w
+		}
+	}
+	if wait > 0 {
+		if logLevel() {
+			dvlog.PrintfFullOnly("Bandwidth wait %v for %d bytes in group %s", wait, amount, groupId)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+}
+
+// GetParallelUploads returns TVSERVER_PARALLEL_UPLOADS, the number of chunks in flight to one tv pc
+func GetParallelUploads() int {
+	n := readIntProperty("TVSERVER_PARALLEL_UPLOADS", defaultParallelUploads)
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
@@ -0,0 +1,89 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+)
+
+func TestDeliveryWindows(t *testing.T) {
+	windows, err := parseDeliveryWindows("22:00-06:00, 12:30-13:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		hour   int
+		minute int
+		inside bool
+	}{
+		{23, 0, true}, {3, 15, true}, {6, 0, false}, {12, 45, true}, {13, 0, false}, {21, 59, false},
+	}
+	for _, c := range cases {
+		now := time.Date(2024, 5, 1, c.hour, c.minute, 0, 0, time.Local)
+		if isInDeliveryWindow(windows, now) != c.inside {
+			t.Errorf("%02d:%02d must be inside=%v", c.hour, c.minute, c.inside)
+		}
+	}
+	if !isInDeliveryWindow(nil, time.Now()) {
+		t.Error("no windows means always")
+	}
+	for _, wrong := range []string{"22-06", "25:00-01:00", "10:00"} {
+		if _, err = parseDeliveryWindows(wrong); err == nil {
+			t.Errorf("%s must be rejected", wrong)
+		}
+	}
+}
+
+func TestBandwidthLimiter(t *testing.T) {
+	l := &bandwidthLimiter{}
+	now := time.Now()
+	if w := l.reserve(1000, 500, now); w != 0 {
+		t.Errorf("first chunk must go at once, waits %v", w)
+	}
+	if w := l.reserve(1000, 500, now); w != 500*time.Millisecond {
+		t.Errorf("second chunk must wait for the first one, waits %v", w)
+	}
+	if w := l.reserve(1000, 100, now.Add(2*time.Second)); w != 0 {
+		t.Errorf("idle time must not be accumulated as debt, waits %v", w)
+	}
+	if w := l.reserve(0, 1<<30, now); w != 0 {
+		t.Errorf("zero rate means no cap, waits %v", w)
+	}
+}
+
+func TestGroupDeliverySettings(t *testing.T) {
+	now := time.Now()
+	closed := now.Add(2*time.Hour).Format("15:04") + "-" + now.Add(3*time.Hour).Format("15:04")
+	res := dvdbmanager.RecordCreate(groupDbName, `{"name":"night","bandwidth":"2048","window":"`+closed+`"}`, "9101")
+	created, ok := res.(*dvevaluation.DvVariable)
+	if !ok {
+		t.Fatalf("group is not created: %v", res)
+	}
+	groupId := created.ReadSimpleChildValue("id")
+	defer dvdbmanager.RecordDelete(groupDbName, groupId)
+
+	settings := getGroupSettings(groupId)
+	if settings.bandwidth != 2048 || len(settings.window) != 1 {
+		t.Errorf("unexpected group settings %v", settings)
+	}
+	if IsFileSendingAllowed(groupId) {
+		t.Error("file sending must wait for the window " + closed)
+	}
+	if !IsFileSendingAllowed(defaultGroupId) {
+		t.Error("default group without TVSERVER_DELIVERY_WINDOW must always send")
+	}
+	// outside the window the worker only checks the connection
+	task := &TaskWorker{Id: "9102", Task: &TvTask{Id: "9102", Url: "http://127.0.0.1:1/", GroupId: groupId,
+		NewPresentationId: "1", NewPresentationVersion: "1", OldPresentationId: "1", OldPresentationVersion: "1", LeftFiles: []string{"a-10.png"}}}
+	busy, err := task.RunNextTask()
+	if busy || err == nil {
+		t.Errorf("outside the window no file must be sent, got %v %v", busy, err)
+	}
+}
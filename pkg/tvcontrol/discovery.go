@@ -0,0 +1,311 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvaction"
+	"github.com/Dobryvechir/microcore/pkg/dvcontext"
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+)
+
+// DiscoveryService is the service of the announcements, as the mDNS service name of tvengine
+const DiscoveryService = "_tvengine._tcp"
+
+// the announcement is signed as a request with this method and the path /{hardwareId}
+const announceMethod = "ANNOUNCE"
+
+// default seconds an unknown device stays in the discovered list after its last announcement
+const defaultDiscoveryTtl = 600
+
+// an announcement is a small json datagram
+const maxAnnouncementSize = 4096
+
+// the announcements of more unknown devices are not kept until some of them expire
+const maxDiscoveredDevices = 1024
+
+// Announcement is broadcast by a player over udp; the url of the player is made of Scheme,
+// the address the datagram came from and Port, so the player need not know its own address;
+// Seq grows with every signed announcement, so a recorded one cannot be sent again
+type Announcement struct {
+	Service    string `json:"service"`
+	HardwareId string `json:"hardwareId"`
+	Name       string `json:"name,omitempty"`
+	Scheme     string `json:"scheme,omitempty"`
+	Port       int    `json:"port"`
+	Seq        int64  `json:"seq,omitempty"`
+	Signature  string `json:"signature,omitempty"`
+}
+
+// DiscoveredDevice is an announcing player whose hardware id is in no tvpc or in the tvpc TvpcId
+// without a key, whose url is not changed by an unsigned announcement
+type DiscoveredDevice struct {
+	HardwareId string `json:"hardwareId"`
+	TvpcId     string `json:"tvpcId,omitempty"`
+	Name       string `json:"name"`
+	Url        string `json:"url"`
+	FirstSeen  int64  `json:"firstSeen"`
+	LastSeen   int64  `json:"lastSeen"`
+}
+
+type TvpcDiscoveredConfig struct {
+	Result string `json:"result"`
+}
+
+var discoveredMu sync.Mutex
+var discovered = make(map[string]*DiscoveredDevice)
+
+// the last seq of the signed announcement of every hardware id, the announcements signed
+// before the start are refused, so they cannot be sent again after a restart
+var announcedSeq = make(map[string]int64)
+var discoveryStarted = time.Now().UnixNano()
+
+// only the url of the tvpc and of its task is changed
+var fieldsForDiscoveredUrl = []string{
+	"^url",
+}
+
+func getAnnouncementBody(a *Announcement) []byte {
+	return []byte(a.Service + "\n" + a.Scheme + "\n" + strconv.Itoa(a.Port) + "\n" + a.Name + "\n" + strconv.FormatInt(a.Seq, 10))
+}
+
+// SignAnnouncement signs the announcement by the key of the player with the time in
+// nanoseconds as its seq, so that nobody else can move its tvpc to another address
+func SignAnnouncement(a *Announcement, key *PlayerKey, now time.Time) {
+	a.Seq = now.UnixNano()
+	a.Signature = SignRequest(key, announceMethod, "/"+a.HardwareId, getAnnouncementBody(a), now)
+}
+
+func getAnnouncementUrl(a *Announcement, ip net.IP) string {
+	scheme := a.Scheme
+	if scheme != "https" {
+		scheme = "http"
+	}
+	return scheme + "://" + net.JoinHostPort(ip.String(), strconv.Itoa(a.Port))
+}
+
+// getTvpcKeys returns the key of the tvpc and the key its task has delivered, the player
+// signs with the latter until the rotated one reaches it
+func getTvpcKeys(tvpc *dvevaluation.DvVariable, id string) []*PlayerKey {
+	var keys []*PlayerKey
+	keyId := tvpc.ReadSimpleChildValue("keyId")
+	if key := getTvpcKey(id, keyId); key != nil {
+		keys = append(keys, key)
+	}
+	task, err := dvdbmanager.RecordReadOne(taskDbName, id)
+	if err == nil && task != nil {
+		if taskKeyId := task.ReadSimpleChildValue("keyId"); taskKeyId != keyId {
+			if key := getTvpcKey(id, taskKeyId); key != nil {
+				keys = append(keys, key)
+			}
+		}
+	}
+	return keys
+}
+
+// HandleAnnouncement keeps an unknown player or a tvpc without key at another address in the
+// discovered list and moves a tvpc with a key to the address of its signed announcement
+func HandleAnnouncement(a *Announcement, ip net.IP, now time.Time) error {
+	if a.Service != DiscoveryService || a.HardwareId == "" || a.Port <= 0 || a.Port > 65535 || ip == nil {
+		return errors.New("incorrect announcement of " + a.HardwareId)
+	}
+	url := getAnnouncementUrl(a, ip)
+	registerMu.Lock()
+	defer registerMu.Unlock()
+	tvpc, err := findTvpcByHardwareId(a.HardwareId)
+	if err != nil {
+		return err
+	}
+	if tvpc == nil {
+		return keepDiscoveredDevice(a, "", url, now)
+	}
+	id := tvpc.ReadSimpleChildValue("id")
+	keys := getTvpcKeys(tvpc, id)
+	if len(keys) == 0 {
+		// anybody could send it, so the admin decides whether to take the announced url
+		if tvpc.ReadSimpleChildValue("url") == url {
+			return nil
+		}
+		return keepDiscoveredDevice(a, id, url, now)
+	}
+	err = VerifySignature(keys, a.Signature, announceMethod, "/"+a.HardwareId, getAnnouncementBody(a), now)
+	if err != nil {
+		return errors.New("announcement of tvpc " + id + " from " + url + ": " + err.Error())
+	}
+	discoveredMu.Lock()
+	if a.Seq <= announcedSeq[a.HardwareId] || a.Seq < discoveryStarted {
+		discoveredMu.Unlock()
+		return errors.New("announcement of tvpc " + id + " from " + url + " is sent again")
+	}
+	announcedSeq[a.HardwareId] = a.Seq
+	delete(discovered, a.HardwareId)
+	discoveredMu.Unlock()
+	if tvpc.ReadSimpleChildValue("url") == url {
+		return nil
+	}
+	return updateTvpcUrl(id, url)
+}
+
+// keepDiscoveredDevice lists the player of the announcement as discovered
+func keepDiscoveredDevice(a *Announcement, tvpcId string, url string, now time.Time) error {
+	discoveredMu.Lock()
+	defer discoveredMu.Unlock()
+	device := discovered[a.HardwareId]
+	if device == nil {
+		if len(discovered) >= maxDiscoveredDevices {
+			return errors.New("too many discovered devices to keep " + a.HardwareId)
+		}
+		device = &DiscoveredDevice{HardwareId: a.HardwareId, FirstSeen: now.Unix()}
+		discovered[a.HardwareId] = device
+		if tvpcId == "" {
+			dvlog.PrintfFullOnly("Discovered unknown player %s at %s", a.HardwareId, url)
+		} else {
+			dvlog.PrintfFullOnly("Discovered tvpc %s without key at %s", tvpcId, url)
+		}
+	}
+	device.TvpcId = tvpcId
+	device.Name = a.Name
+	device.Url = url
+	device.LastSeen = now.Unix()
+	return nil
+}
+
+// updateTvpcUrl saves the new url in the tvpc and its task and wakes up the worker of the task
+func updateTvpcUrl(id string, url string) error {
+	row, err := dvevaluation.AnyStructToDvVariable(map[string]string{"id": id, "url": url})
+	if err != nil {
+		return err
+	}
+	_, err = updateRecordByConditions(tvpcDbName, row, tvpcConditionsForRegistration, fieldsForDiscoveredUrl)
+	if err != nil {
+		return err
+	}
+	task, err := updateRecordByConditions(taskDbName, row, taskConditionsForConnectionCheck, fieldsForDiscoveredUrl)
+	if err != nil {
+		return err
+	}
+	dvlog.PrintfFullOnly("Tvpc %s moved to %s", id, url)
+	if task != nil {
+		if worker := mainSupervisor.Worker(id); worker != nil {
+			worker.WakeUp(1)
+		}
+	}
+	return nil
+}
+
+// GetDiscoveredDevices returns the unknown players and the tvpcs without key which announced
+// another url within TVSERVER_DISCOVERY_TTL seconds
+func GetDiscoveredDevices(now time.Time) []*DiscoveredDevice {
+	known := make(map[string]string)
+	tvs, err := dvdbmanager.RecordReadAll(tvpcDbName)
+	if err == nil && tvs != nil {
+		for _, tv := range tvs.Fields {
+			if tv != nil {
+				known[tv.ReadSimpleChildValue("hardwareId")] = tv.ReadSimpleChildValue("id")
+			}
+		}
+	}
+	oldest := now.Unix() - int64(readIntProperty("TVSERVER_DISCOVERY_TTL", defaultDiscoveryTtl))
+	discoveredMu.Lock()
+	defer discoveredMu.Unlock()
+	res := make([]*DiscoveredDevice, 0, len(discovered))
+	for hardwareId, device := range discovered {
+		if id, ok := known[hardwareId]; ok && id != device.TvpcId || device.LastSeen < oldest {
+			delete(discovered, hardwareId)
+			continue
+		}
+		copied := *device
+		res = append(res, &copied)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].HardwareId < res[j].HardwareId })
+	return res
+}
+
+// ServeDiscovery handles the announcements coming to conn until it is closed
+func ServeDiscovery(conn net.PacketConn) error {
+	buf := make([]byte, maxAnnouncementSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		a := &Announcement{}
+		err = json.Unmarshal(buf[:n], a)
+		if err == nil {
+			err = HandleAnnouncement(a, udpAddr.IP, time.Now())
+		}
+		if err != nil && logLevel() {
+			dvlog.PrintError(err)
+		}
+	}
+}
+
+// RunDiscovery listens for the announcements of the players at the udp address
+// TVSERVER_DISCOVERY_LISTEN (like :8087) when it is set
+func RunDiscovery() {
+	go runDiscoveryThread()
+}
+
+func runDiscoveryThread() {
+	time.Sleep(supervisorStartDelay)
+	listen := readProperty("TVSERVER_DISCOVERY_LISTEN", "")
+	if listen == "" {
+		return
+	}
+	conn, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		dvlog.PrintError(err)
+		return
+	}
+	dvlog.PrintfFullOnly("Discovery listens at %s", listen)
+	err = ServeDiscovery(conn)
+	if err != nil {
+		dvlog.PrintError(err)
+	}
+}
+
+func TvpcDiscoveredInit(command string, ctx *dvcontext.RequestContext) ([]interface{}, bool) {
+	config := &TvpcDiscoveredConfig{}
+	if !dvaction.DefaultInitWithObject(command, config, dvaction.GetEnvironment(ctx)) {
+		return nil, false
+	}
+	return []interface{}{config, ctx}, true
+}
+
+func TvpcDiscoveredRun(data []interface{}) bool {
+	config := data[0].(*TvpcDiscoveredConfig)
+	var ctx *dvcontext.RequestContext = nil
+	if data[1] != nil {
+		ctx = data[1].(*dvcontext.RequestContext)
+	}
+	res, err := dvevaluation.AnyStructToDvVariable(GetDiscoveredDevices(time.Now()))
+	if err != nil {
+		dvlog.PrintError(err)
+		return true
+	}
+	dvaction.SaveActionResult(config.Result, res, ctx)
+	return true
+}
+
+const (
+	CommandTvpcDiscovered = "tvpcdiscovered"
+)
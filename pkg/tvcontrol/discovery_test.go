@@ -0,0 +1,142 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+)
+
+func TestDiscoveryMovesKnownTvpc(t *testing.T) {
+	key := &PlayerKey{Id: "1", Secret: "discovery-secret"}
+	row, err := dvevaluation.AnyStructToDvVariable(map[string]string{"id": "9101", "name": "moved", "url": "http://10.0.0.1:8085",
+		"hardwareId": "disc-known", "keyId": key.Id})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = saveTvpcKey("9101", key); err != nil {
+		t.Fatal(err)
+	}
+	defer dvdbmanager.RecordDelete(tvpcSecretDbName, "9101")
+	if _, err = updateRecordByConditions(tvpcDbName, row, tvpcConditionsForNew, tvpcFieldsForNew); err != nil {
+		t.Fatal(err)
+	}
+	defer dvdbmanager.RecordDelete(tvpcDbName, "9101")
+	if _, err = createOrUpdateTaskDatabase(&TvTask{Id: "9101", Name: "moved", Url: "http://10.0.0.1:8085"}, taskConditionsForWeb, taskFieldsForWeb); err != nil {
+		t.Fatal(err)
+	}
+	defer dvdbmanager.RecordDelete(taskDbName, "9101")
+
+	now := time.Now()
+	ip := net.ParseIP("127.0.0.1")
+	a := &Announcement{Service: DiscoveryService, HardwareId: "disc-known", Port: 9000}
+	if err = HandleAnnouncement(a, ip, now); err == nil {
+		t.Error("unsigned announcement of a tvpc with a key must be refused")
+	}
+	SignAnnouncement(a, &PlayerKey{Id: "1", Secret: "other"}, now)
+	if err = HandleAnnouncement(a, ip, now); err == nil {
+		t.Error("announcement signed by another secret must be refused")
+	}
+	if url := readTask(t, "9101").Url; url != "http://10.0.0.1:8085" {
+		t.Fatalf("refused announcement must not move the task, got %s", url)
+	}
+	now = now.Add(time.Second)
+	SignAnnouncement(a, key, now)
+	if err = HandleAnnouncement(a, ip, now); err != nil {
+		t.Fatal(err)
+	}
+	replayed := *a
+	if err = HandleAnnouncement(&replayed, net.ParseIP("127.0.0.2"), now); err == nil {
+		t.Error("announcement sent again must be refused")
+	}
+	tvpc, err := dvdbmanager.RecordReadOne(tvpcDbName, "9101")
+	if err != nil || tvpc.ReadSimpleChildValue("url") != "http://127.0.0.1:9000" || tvpc.ReadSimpleChildValue("keyId") != key.Id {
+		t.Errorf("tvpc must get the announced url and keep its other fields: %v %v", tvpc, err)
+	}
+	if url := readTask(t, "9101").Url; url != "http://127.0.0.1:9000" {
+		t.Errorf("task must get the announced url, got %s", url)
+	}
+	for _, device := range GetDiscoveredDevices(now) {
+		if device.HardwareId == "disc-known" {
+			t.Error("known tvpc must not be listed as discovered")
+		}
+	}
+}
+
+func TestDiscoveryListsTvpcWithoutKey(t *testing.T) {
+	row, err := dvevaluation.AnyStructToDvVariable(map[string]string{"id": "9102", "name": "keyless", "url": "http://10.0.0.2:8085",
+		"hardwareId": "disc-keyless"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = updateRecordByConditions(tvpcDbName, row, tvpcConditionsForNew, tvpcFieldsForNew); err != nil {
+		t.Fatal(err)
+	}
+	defer dvdbmanager.RecordDelete(tvpcDbName, "9102")
+
+	now := time.Now()
+	a := &Announcement{Service: DiscoveryService, HardwareId: "disc-keyless", Name: "lobby", Port: 9000}
+	if err = HandleAnnouncement(a, net.ParseIP("127.0.0.1"), now); err != nil {
+		t.Fatal(err)
+	}
+	tvpc, err := dvdbmanager.RecordReadOne(tvpcDbName, "9102")
+	if err != nil || tvpc.ReadSimpleChildValue("url") != "http://10.0.0.2:8085" {
+		t.Errorf("unsigned announcement must not move the tvpc: %v %v", tvpc, err)
+	}
+	var found *DiscoveredDevice
+	for _, device := range GetDiscoveredDevices(now) {
+		if device.HardwareId == "disc-keyless" {
+			found = device
+		}
+	}
+	if found == nil || found.TvpcId != "9102" || found.Url != "http://127.0.0.1:9000" {
+		t.Errorf("tvpc without key must be listed with the announced url: %+v", found)
+	}
+}
+
+func TestDiscoveryListsUnknownPlayers(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- ServeDiscovery(conn) }()
+	sender, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	sender.Write([]byte("not json"))
+	sender.Write([]byte(`{"service":"_tvengine._tcp","hardwareId":"disc-unknown","name":"hall","scheme":"https","port":8443}`))
+	var found *DiscoveredDevice
+	for i := 0; i < 100 && found == nil; i++ {
+		time.Sleep(20 * time.Millisecond)
+		for _, device := range GetDiscoveredDevices(time.Now()) {
+			if device.HardwareId == "disc-unknown" {
+				found = device
+			}
+		}
+	}
+	if found == nil || found.Url != "https://127.0.0.1:8443" || found.Name != "hall" {
+		t.Fatalf("unknown player must be listed with its address: %+v", found)
+	}
+	conn.Close()
+	if err = <-done; err != nil {
+		t.Errorf("closed discovery must stop without error, got %v", err)
+	}
+
+	defer SetPropertyForTest("TVSERVER_DISCOVERY_TTL", "60")()
+	for _, device := range GetDiscoveredDevices(time.Now().Add(61 * time.Second)) {
+		if strings.HasPrefix(device.HardwareId, "disc-") {
+			t.Errorf("device must expire after the ttl: %+v", device)
+		}
+	}
+}
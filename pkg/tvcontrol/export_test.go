@@ -0,0 +1,34 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+// SetDelaysForTest shortens the worker delays so that the tests do not wait minutes
+func SetDelaysForTest(errorCase int, idleCase int, operationCase int) {
+	delayInErrorCase = errorCase
+	delayInIdleCase = idleCase
+	delayInOperationCase = operationCase
+}
+
+// SetPropertyForTest overrides a TVSERVER_ property like ReloadSettings does, the workers
+// of other tests may read the properties meanwhile; the returned function restores it
+func SetPropertyForTest(name string, value string) func() {
+	propertyOverridesMu.Lock()
+	defer propertyOverridesMu.Unlock()
+	if propertyOverrides == nil {
+		propertyOverrides = make(map[string]string)
+	}
+	old, ok := propertyOverrides[name]
+	propertyOverrides[name] = value
+	return func() {
+		propertyOverridesMu.Lock()
+		defer propertyOverridesMu.Unlock()
+		if ok {
+			propertyOverrides[name] = old
+		} else {
+			delete(propertyOverrides, name)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvaction"
+	"github.com/Dobryvechir/microcore/pkg/dvcontext"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+)
+
+// default seconds between the heartbeats of a player and after the last one before it is late or offline
+const (
+	defaultHeartbeatInterval = 30
+	defaultHeartbeatLate     = 60
+	defaultHeartbeatOffline  = 120
+)
+
+// the liveness of a player, a player without heartbeats is checked by GET status
+const (
+	LivenessOnline  = "online"
+	LivenessLate    = "late"
+	LivenessOffline = "offline"
+)
+
+// Heartbeat is pushed by a player with the fields of its status answer
+type Heartbeat struct {
+	Uptime      int64          `json:"uptime"`
+	Playing     string         `json:"playing,omitempty"`
+	FreeDisk    int64          `json:"freeDisk"`
+	Temperature float64        `json:"temperature,omitempty"`
+	Encodings   []string       `json:"encodings,omitempty"`
+	Relay       *RelayProgress `json:"relay,omitempty"`
+}
+
+// PlayerLiveness is the last heartbeat of a tvpc and the state derived from its age
+type PlayerLiveness struct {
+	Id        string     `json:"id"`
+	State     string     `json:"state"`
+	LastSeen  int64      `json:"lastSeen"`
+	Address   string     `json:"address,omitempty"`
+	Heartbeat *Heartbeat `json:"heartbeat"`
+}
+
+type PlayerLivenessConfig struct {
+	Result string `json:"result"`
+}
+
+var livenessMu sync.Mutex
+var liveness = make(map[string]*PlayerLiveness)
+
+// getLivenessState tells the state of the heartbeat seen at lastSeen by the thresholds
+// TVSERVER_HEARTBEAT_LATE and TVSERVER_HEARTBEAT_OFFLINE
+func getLivenessState(lastSeen int64, now time.Time) string {
+	age := now.Unix() - lastSeen
+	switch {
+	case age < int64(readIntProperty("TVSERVER_HEARTBEAT_LATE", defaultHeartbeatLate)):
+		return LivenessOnline
+	case age < int64(readIntProperty("TVSERVER_HEARTBEAT_OFFLINE", defaultHeartbeatOffline)):
+		return LivenessLate
+	}
+	return LivenessOffline
+}
+
+// GetLiveness returns the liveness of the tvpc or nil if it has sent no heartbeat
+func GetLiveness(id string, now time.Time) *PlayerLiveness {
+	livenessMu.Lock()
+	defer livenessMu.Unlock()
+	current := liveness[id]
+	if current == nil {
+		return nil
+	}
+	res := *current
+	res.State = getLivenessState(res.LastSeen, now)
+	return &res
+}
+
+// GetLivenessTable returns the liveness of all tvpcs which have sent heartbeats
+func GetLivenessTable(now time.Time) []*PlayerLiveness {
+	livenessMu.Lock()
+	res := make([]*PlayerLiveness, 0, len(liveness))
+	for _, current := range liveness {
+		copied := *current
+		copied.State = getLivenessState(copied.LastSeen, now)
+		res = append(res, &copied)
+	}
+	livenessMu.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Id < res[j].Id })
+	return res
+}
+
+// HandleHeartbeat keeps the heartbeat of the task's player; a task with failed connections
+// is connected again at once and its worker goes on without waiting for its backoff
+func HandleHeartbeat(t *TvTask, heartbeat *Heartbeat, address string, now time.Time) error {
+	livenessMu.Lock()
+	previous := liveness[t.Id]
+	liveness[t.Id] = &PlayerLiveness{Id: t.Id, State: LivenessOnline, LastSeen: now.Unix(), Address: address, Heartbeat: heartbeat}
+	livenessMu.Unlock()
+	if previous == nil || getLivenessState(previous.LastSeen, now) == LivenessOffline {
+		dvlog.PrintfFullOnly("Player %s is online", t.Id)
+	}
+	if !t.connectionSucceeded() && t.LastError == "" {
+		return nil
+	}
+	t.LastError = ""
+	_, err := createOrUpdateTaskDatabaseForConnectionStatus(t)
+	wakeUpTaskWorker(t.Id)
+	return err
+}
+
+// CheckLiveness counts a failed connection for every tvpc whose heartbeats have stopped since
+// the last check, so its outage is seen without polling; its worker polls it once more
+func CheckLiveness(now time.Time) {
+	offline := make(map[string]int64)
+	livenessMu.Lock()
+	for id, current := range liveness {
+		if current.State != LivenessOffline && getLivenessState(current.LastSeen, now) == LivenessOffline {
+			current.State = LivenessOffline
+			offline[id] = current.LastSeen
+		}
+	}
+	livenessMu.Unlock()
+	for id, lastSeen := range offline {
+		dvlog.PrintfFullOnly("Player %s is offline", id)
+		t, err := readPullTask(id)
+		if err != nil {
+			continue
+		}
+		t.LastError = "no heartbeat since " + time.Unix(lastSeen, 0).Format(time.RFC3339)
+		t.connectionFailed()
+		_, err = createOrUpdateTaskDatabaseForConnectionStatus(t)
+		if err != nil {
+			dvlog.PrintError(err)
+		}
+		wakeUpTaskWorker(id)
+	}
+}
+
+func wakeUpTaskWorker(id string) {
+	if worker := mainSupervisor.Worker(id); worker != nil {
+		worker.WakeUp(1)
+	}
+}
+
+// RunLivenessCheck checks the heartbeats of the players every TVSERVER_HEARTBEAT_INTERVAL seconds
+func RunLivenessCheck() {
+	go func() {
+		for {
+			time.Sleep(getHeartbeatInterval())
+			CheckLiveness(time.Now())
+		}
+	}()
+}
+
+func getHeartbeatInterval() time.Duration {
+	interval := readIntProperty("TVSERVER_HEARTBEAT_INTERVAL", defaultHeartbeatInterval)
+	if interval <= 0 {
+		interval = defaultHeartbeatInterval
+	}
+	return time.Duration(interval) * time.Second
+}
+
+// servePullHeartbeat takes the heartbeat of a player in any mode, the answer tells it when to send the next one
+func servePullHeartbeat(t *TvTask, r *http.Request, body []byte) *pullAnswer {
+	heartbeat := &Heartbeat{}
+	err := json.Unmarshal(body, heartbeat)
+	if err != nil {
+		return newPullError(http.StatusBadRequest, err)
+	}
+	err = HandleHeartbeat(t, heartbeat, r.RemoteAddr, time.Now())
+	if err != nil {
+		return newPullError(http.StatusInternalServerError, err)
+	}
+	return newPullJson(map[string]int{"interval": int(getHeartbeatInterval() / time.Second)})
+}
+
+// applyHeartbeat takes the encodings and the relay progress from a live heartbeat
+// instead of GET status; it returns false when the player must be polled
+func (task *TaskWorker) applyHeartbeat(now time.Time) (bool, error) {
+	current := GetLiveness(task.Id, now)
+	if current == nil || current.State == LivenessOffline || current.Heartbeat == nil {
+		return false, nil
+	}
+	t := task.Task
+	task.encoding = selectEncoding(current.Heartbeat.Encodings)
+	task.encodingKnown = true
+	if logLevel() {
+		dvlog.PrintfFullOnly("Heartbeat of %s is %s", t.Id, current.State)
+	}
+	if t.connectionSucceeded() || !reflect.DeepEqual(current.Heartbeat.Relay, t.Relay) {
+		t.Relay = current.Heartbeat.Relay
+		return true, task.saveConnectionStatus(t)
+	}
+	return true, nil
+}
+
+func PlayerLivenessInit(command string, ctx *dvcontext.RequestContext) ([]interface{}, bool) {
+	config := &PlayerLivenessConfig{}
+	if !dvaction.DefaultInitWithObject(command, config, dvaction.GetEnvironment(ctx)) {
+		return nil, false
+	}
+	return []interface{}{config, ctx}, true
+}
+
+func PlayerLivenessRun(data []interface{}) bool {
+	config := data[0].(*PlayerLivenessConfig)
+	var ctx *dvcontext.RequestContext = nil
+	if data[1] != nil {
+		ctx = data[1].(*dvcontext.RequestContext)
+	}
+	res, err := dvevaluation.AnyStructToDvVariable(GetLivenessTable(time.Now()))
+	if err != nil {
+		dvlog.PrintError(err)
+		return true
+	}
+	dvaction.SaveActionResult(config.Result, res, ctx)
+	return true
+}
+
+const (
+	CommandPlayerLiveness = "playerliveness"
+)
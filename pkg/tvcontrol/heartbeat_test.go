@@ -0,0 +1,64 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+)
+
+func TestHeartbeatsDeriveConnectionStatus(t *testing.T) {
+	defer SetPropertyForTest("TVSERVER_HEARTBEAT_LATE", "60")()
+	defer SetPropertyForTest("TVSERVER_HEARTBEAT_OFFLINE", "120")()
+	task := &TvTask{Id: "9201", Name: "beating", ConnectionStatus: 3, LastError: "connection refused"}
+	if _, err := createOrUpdateTaskDatabase(task, taskConditionsForWeb, taskFieldsForWeb); err != nil {
+		t.Fatal(err)
+	}
+	defer dvdbmanager.RecordDelete(taskDbName, "9201")
+	defer func() {
+		livenessMu.Lock()
+		delete(liveness, "9201")
+		livenessMu.Unlock()
+	}()
+
+	now := time.Now()
+	heartbeat := &Heartbeat{Uptime: 100, Playing: "a.png", FreeDisk: 1 << 30, Encodings: []string{"deflate", "gzip"}}
+	if err := HandleHeartbeat(readTask(t, "9201"), heartbeat, "127.0.0.1:5000", now); err != nil {
+		t.Fatal(err)
+	}
+	if saved := readTask(t, "9201"); saved.ConnectionStatus != 0 || saved.LastError != "" {
+		t.Errorf("heartbeat must connect the task again: %d %q", saved.ConnectionStatus, saved.LastError)
+	}
+	worker := &TaskWorker{Id: "9201", Task: readTask(t, "9201")}
+	if live, err := worker.applyHeartbeat(now); !live || err != nil || worker.getEncoding() != "gzip" {
+		t.Errorf("live heartbeat must replace GET status: %v %v %q", live, err, worker.encoding)
+	}
+
+	for _, c := range []struct {
+		after time.Duration
+		state string
+	}{{59 * time.Second, LivenessOnline}, {60 * time.Second, LivenessLate}, {120 * time.Second, LivenessOffline}} {
+		if current := GetLiveness("9201", now.Add(c.after)); current == nil || current.State != c.state || current.Heartbeat.Playing != "a.png" {
+			t.Errorf("after %v the player must be %s: %+v", c.after, c.state, current)
+		}
+	}
+
+	CheckLiveness(now.Add(119 * time.Second))
+	if saved := readTask(t, "9201"); saved.ConnectionStatus != 0 {
+		t.Errorf("late player must stay connected, got %d", saved.ConnectionStatus)
+	}
+	CheckLiveness(now.Add(121 * time.Second))
+	CheckLiveness(now.Add(150 * time.Second))
+	if saved := readTask(t, "9201"); saved.ConnectionStatus != 1 || saved.LastError == "" {
+		t.Errorf("stopped heartbeats must count one failed connection: %d %q", saved.ConnectionStatus, saved.LastError)
+	}
+	worker.Task = readTask(t, "9201")
+	if live, _ := worker.applyHeartbeat(now.Add(121 * time.Second)); live {
+		t.Error("offline player must be polled")
+	}
+}
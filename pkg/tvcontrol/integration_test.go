@@ -0,0 +1,591 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+	"github.com/VDobryvechir/tvengine/pkg/tvplayer"
+)
+
+type record map[string]interface{}
+
+func (r record) str(key string) string {
+	s, _ := r[key].(string)
+	return s
+}
+
+// stubPlayer is a reference player which remembers the upload requests it received
+type stubPlayer struct {
+	*tvplayer.Player
+	Url     string
+	mu      sync.Mutex
+	uploads []string
+}
+
+func (p *stubPlayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/upload/") {
+		p.mu.Lock()
+		p.uploads = append(p.uploads, r.URL.Path)
+		p.mu.Unlock()
+	}
+	p.Player.ServeHTTP(w, r)
+}
+
+func (p *stubPlayer) takeUploads() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := p.uploads
+	p.uploads = nil
+	return res
+}
+
+func createStubPlayer(t *testing.T) *stubPlayer {
+	t.Helper()
+	player, err := tvplayer.NewPlayer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub := &stubPlayer{Player: player}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+	stub.Url = server.URL
+	return stub
+}
+
+func createMedia(t *testing.T, table string, name string, size int, seed int64) record {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	res := record{}
+	callApi(t, "POST", table, map[string]string{"name": name, "file": "data:image/png;base64," + base64.StdEncoding.EncodeToString(data)}, &res)
+	if res.str("id") == "" || res.str("fileName") == "" {
+		t.Fatalf("%s %s was not created: %v", table, name, res)
+	}
+	return res
+}
+
+func readTasks(t *testing.T) map[string]record {
+	var list []record
+	callApi(t, "GET", "task", nil, &list)
+	res := make(map[string]record, len(list))
+	for _, r := range list {
+		res[r.str("id")] = r
+	}
+	return res
+}
+
+func createPresentation(t *testing.T, name string, screens []record, duration []int) record {
+	t.Helper()
+	ids := make([]string, len(screens))
+	for i, screen := range screens {
+		ids[i] = screen.str("id")
+	}
+	presentation := record{}
+	callApi(t, "POST", "presentation", map[string]interface{}{"name": name, "screen": ids, "duration": duration, "group": "0"}, &presentation)
+	return presentation
+}
+
+func waitForDelivery(t *testing.T, presentation record, tvpcIds []string) map[string]record {
+	t.Helper()
+	var tasks map[string]record
+	eventually(t, 60*time.Second, "tasks did not reach status 1000", func() bool {
+		tasks = readTasks(t)
+		for _, id := range tvpcIds {
+			task, ok := tasks[id]
+			if !ok || task["taskStatus"] != float64(1000) || task.str("oldPresentationId") != presentation.str("id") {
+				return false
+			}
+		}
+		return true
+	})
+	return tasks
+}
+
+// checkDeliveryEvents reads the events of the delivered task by pages of two events
+func checkDeliveryEvents(t *testing.T, id string) {
+	t.Helper()
+	kinds := make(map[string]int)
+	var phases []string
+	after := float64(0)
+	for more := true; more; {
+		page := record{}
+		callApi(t, "GET", "task/"+id+"/events?limit=2&after="+strconv.Itoa(int(after)), nil, &page)
+		events, _ := page["events"].([]interface{})
+		if len(events) > 2 || page.str("id") != id {
+			t.Fatalf("wrong page of events: %v", page)
+		}
+		for _, v := range events {
+			event := record(v.(map[string]interface{}))
+			if event["seq"].(float64) <= after {
+				t.Fatalf("event %v is not after %v", event, after)
+			}
+			after = event["seq"].(float64)
+			kinds[event.str("kind")]++
+			if event.str("kind") == tvcontrol.TaskEventPhase {
+				phases = append(phases, event.str("phase"))
+			}
+		}
+		more, _ = page["more"].(bool)
+	}
+	if kinds[tvcontrol.TaskEventConfig] == 0 || kinds[tvcontrol.TaskEventChunk] < 3 || kinds[tvcontrol.TaskEventStart] == 0 {
+		t.Errorf("config, chunks and start must be in the events, got %v", kinds)
+	}
+	expected := []string{string(tvcontrol.PhasePending), string(tvcontrol.PhaseSendingConfig), string(tvcontrol.PhaseSendingFiles), string(tvcontrol.PhaseDone)}
+	if !reflect.DeepEqual(phases, expected) {
+		t.Errorf("phases must be %v, got %v", expected, phases)
+	}
+}
+
+func expectedConfig(t *testing.T, screens []record, duration []int) *tvcontrol.TvConfig {
+	t.Helper()
+	config := &tvcontrol.TvConfig{Duration: duration}
+	for _, screen := range screens {
+		name := filepath.Join(htmlPath, screen.str("file"))
+		hash, err := tvcontrol.CalculateFileDigest(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Hash = append(config.Hash, hash)
+		config.File = append(config.File, "i"+hash[:32]+"-"+strconv.FormatInt(fi.Size(), 10)+".png")
+	}
+	return config
+}
+
+func TestControlTaskDeliveryPipeline(t *testing.T) {
+	picture := createMedia(t, "picture", "logo", 1000, 1)
+	if !strings.HasPrefix(picture.str("fileName"), "i") {
+		t.Errorf("picture file name %s must start with i", picture.str("fileName"))
+	}
+	// the first screen takes three chunks, the second one a single chunk
+	screens := []record{createMedia(t, "screen", "big", 1<<20+12345, 2), createMedia(t, "screen", "small", 7000, 3)}
+	players := make([]*stubPlayer, 2)
+	tvpcIds := make([]string, 2)
+	for i := range players {
+		players[i] = createStubPlayer(t)
+		tvpc := record{}
+		callApi(t, "POST", "tvpc", map[string]string{"name": "stub" + string(rune('A'+i)), "url": players[i].Url}, &tvpc)
+		tvpcIds[i] = tvpc.str("id")
+	}
+	defer callApi(t, "DELETE", "tvpc/"+strings.Join(tvpcIds, ","), nil, nil)
+	presentation := createPresentation(t, "integration", screens, []int{10, 20})
+
+	control := struct {
+		Presentation []record `json:"presentation"`
+		Tv           []record `json:"tv"`
+	}{}
+	callApi(t, "GET", "control/"+presentation.str("id"), nil, &control)
+	if len(control.Presentation) != len(tvpcIds) || len(control.Tv) != len(tvpcIds) {
+		t.Fatalf("expected %d tasks, got %v", len(tvpcIds), control)
+	}
+	for _, task := range control.Presentation {
+		if task.str("newPresentationId") != presentation.str("id") || task.str("newPresentationVersion") != presentation.str("version") {
+			t.Errorf("task does not refer to the presentation: %v", task)
+		}
+	}
+
+	tasks := waitForDelivery(t, presentation, tvpcIds)
+	expected := expectedConfig(t, screens, []int{10, 20})
+	for i, player := range players {
+		task := tasks[tvpcIds[i]]
+		if task.str("oldPresentationId") != presentation.str("id") || task["connectionStatus"] != float64(0) {
+			t.Errorf("task is not finished correctly: %v", task)
+		}
+		if !reflect.DeepEqual(player.Config(), expected) {
+			t.Errorf("player %d received %v instead of %v", i, player.Config(), expected)
+		}
+		if !player.State().Ready {
+			t.Errorf("player %d is not ready: %v", i, player.State().Missing)
+		}
+		for j, screen := range screens {
+			original, err := os.ReadFile(filepath.Join(htmlPath, screen.str("file")))
+			if err != nil {
+				t.Fatal(err)
+			}
+			received, err := os.ReadFile(player.MediaPath(expected.File[j]))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(original, received) {
+				t.Errorf("player %d received corrupted %s", i, expected.File[j])
+			}
+		}
+		player.takeUploads()
+	}
+	checkDeliveryEvents(t, tvpcIds[0])
+	answer := record{}
+	callApi(t, "POST", "task/"+tvpcIds[0]+"/pause", nil, &answer)
+	if !strings.Contains(answer.str("error"), "cannot be paused") {
+		t.Errorf("delivered task must not be paused: %v", answer)
+	}
+
+	// the small screen is already on the players, so only the new one is uploaded
+	first, firstScreens := presentation, screens
+	screens = []record{screens[1], createMedia(t, "screen", "other", 3000, 4)}
+	presentation = createPresentation(t, "shared", screens, []int{7, 8})
+	callApi(t, "GET", "control/"+presentation.str("id"), nil, nil)
+	waitForDelivery(t, presentation, tvpcIds)
+	expected = expectedConfig(t, screens, []int{7, 8})
+	for i, player := range players {
+		if !reflect.DeepEqual(player.Config(), expected) {
+			t.Errorf("player %d received %v instead of %v", i, player.Config(), expected)
+		}
+		if uploads := player.takeUploads(); len(uploads) != 1 || !strings.HasPrefix(uploads[0], "/upload/1_0_") {
+			t.Errorf("player %d must receive only the new file, got %v", i, uploads)
+		}
+	}
+
+	// the group goes back to the first presentation, whose files the players still have
+	var rolled []record
+	callApi(t, "POST", "group/0/rollback", nil, &rolled)
+	if len(rolled) < len(tvpcIds) {
+		t.Fatalf("tasks of the group must be rolled back, got %v", rolled)
+	}
+	waitForDelivery(t, first, tvpcIds)
+	expected = expectedConfig(t, firstScreens, []int{10, 20})
+	for i, player := range players {
+		if !reflect.DeepEqual(player.Config(), expected) {
+			t.Errorf("player %d has %v instead of the rolled back %v", i, player.Config(), expected)
+		}
+		if uploads := player.takeUploads(); len(uploads) != 0 {
+			t.Errorf("player %d must receive no files for the rollback, got %v", i, uploads)
+		}
+	}
+	answer = record{}
+	callApi(t, "POST", "tvpc/"+tvpcIds[0]+"/rollback", nil, &answer)
+	if !strings.Contains(answer.str("error"), "no previous config") {
+		t.Errorf("tvpc has no config before the first presentation: %v", answer)
+	}
+}
+
+func TestPeerDistribution(t *testing.T) {
+	defer tvcontrol.SetPropertyForTest("TVSERVER_PEER_SEEDS", "1")()
+	screens := []record{createMedia(t, "screen", "peer", 300000, 5)}
+	players := make([]*stubPlayer, 3)
+	tvpcIds := make([]string, len(players))
+	for i := range players {
+		players[i] = createStubPlayer(t)
+		players[i].PeerRetryDelay = 100 * time.Millisecond
+		tvpc := record{}
+		callApi(t, "POST", "tvpc", map[string]string{"name": "peer" + string(rune('A'+i)), "url": players[i].Url}, &tvpc)
+		tvpcIds[i] = tvpc.str("id")
+	}
+	defer callApi(t, "DELETE", "tvpc/"+strings.Join(tvpcIds, ","), nil, nil)
+	presentation := createPresentation(t, "peers", screens, []int{10})
+	callApi(t, "GET", "control/"+presentation.str("id"), nil, nil)
+	waitForDelivery(t, presentation, tvpcIds)
+	expected := expectedConfig(t, screens, []int{10})
+	uploaded, pulled := 0, 0
+	for i, player := range players {
+		if !reflect.DeepEqual(player.Config().File, expected.File) || !player.State().Ready {
+			t.Errorf("player %d did not receive %v", i, expected.File)
+		}
+		if len(player.takeUploads()) != 0 {
+			uploaded++
+		}
+		if len(player.Config().Peer) != 0 {
+			pulled++
+		}
+	}
+	// the seed receives the file from the server, the others from the seed
+	if uploaded != 1 || pulled != 2 {
+		t.Errorf("expected 1 seed and 2 peers, got %d uploaded and %d pulled", uploaded, pulled)
+	}
+}
+
+func TestSignedDeliveryAndKeyRotation(t *testing.T) {
+	player := createStubPlayer(t)
+	tvpc := record{}
+	callApi(t, "POST", "tvpc", map[string]string{"name": "signed", "url": player.Url}, &tvpc)
+	id := tvpc.str("id")
+	defer callApi(t, "DELETE", "tvpc/"+id, nil, nil)
+	if tvpc.str("keyId") != "1" || tvpc.str("secret") != "" {
+		t.Fatalf("registered tvpc must get its key without showing the secret: %v", tvpc)
+	}
+	screens := []record{createMedia(t, "screen", "signed", 5000, 6)}
+	presentation := createPresentation(t, "signed", screens, []int{10})
+	callApi(t, "GET", "control/"+presentation.str("id"), nil, nil)
+	waitForDelivery(t, presentation, []string{id})
+	if player.KeyId() != "" {
+		t.Errorf("player must not get a key before the admin gives its pairing token, got %q", player.KeyId())
+	}
+	paired := record{}
+	callApi(t, "POST", "tvpc/"+id+"/key", map[string]string{"pairingToken": player.PairingToken()}, &paired)
+	if paired.str("keyId") != "2" {
+		t.Fatalf("pairing must issue a new key: %v", paired)
+	}
+	eventually(t, 30*time.Second, "paired key was not delivered", func() bool {
+		return player.KeyId() == "2"
+	})
+	res, err := http.Post(player.Url+"/config", "application/json", strings.NewReader(`{"file":["x.png"],"duration":[1]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned config must be rejected, got %d", res.StatusCode)
+	}
+
+	rotated := record{}
+	callApi(t, "POST", "tvpc/"+id+"/key", nil, &rotated)
+	if rotated.str("keyId") != "3" || rotated.str("secret") != "" {
+		t.Fatalf("rotation must issue a new key without showing the secret: %v", rotated)
+	}
+	eventually(t, 30*time.Second, "rotated key was not delivered", func() bool {
+		return player.KeyId() == "3"
+	})
+	screens = append(screens, createMedia(t, "screen", "rotated", 4000, 7))
+	presentation = createPresentation(t, "rotated", screens, []int{10, 5})
+	callApi(t, "GET", "control/"+presentation.str("id"), nil, nil)
+	waitForDelivery(t, presentation, []string{id})
+	if !player.State().Ready {
+		t.Error("player must accept the content signed by the rotated key")
+	}
+	for _, api := range []string{"tvpc", "tvpc/" + id, "task"} {
+		var raw json.RawMessage
+		callApi(t, "GET", api, nil, &raw)
+		if strings.Contains(strings.ToLower(string(raw)), "secret") || strings.Contains(strings.ToLower(string(raw)), "pairingtoken") {
+			t.Errorf("GET %s must not show a secret: %s", api, raw)
+		}
+	}
+}
+
+func TestPlayerRegistrationAndApproval(t *testing.T) {
+	player := createStubPlayer(t)
+	reg := &tvcontrol.TvpcRegistration{HardwareId: "hw-" + strconv.FormatInt(time.Now().UnixNano(), 36), Url: player.Url, Capabilities: []string{"signature"}}
+	answer, err := player.Register(http.DefaultClient, serverUrl, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := answer.Id
+	defer callApi(t, "DELETE", "tvpc/"+id, nil, nil)
+	if answer.Status != tvcontrol.TvpcStatusPending || len(answer.PairingCode) != 6 || player.PairingCode() != answer.PairingCode {
+		t.Fatalf("first registration must create a pending tvpc with a pairing code: %+v", answer)
+	}
+	again, err := player.Register(http.DefaultClient, serverUrl, reg)
+	if err != nil || again.Id != id || again.PairingCode != answer.PairingCode {
+		t.Fatalf("registration again must find the same tvpc: %+v %v", again, err)
+	}
+	stranger := record{}
+	callApi(t, "POST", "tvpc/register", reg, &stranger)
+	if stranger.str("error") == "" || stranger.str("id") != "" {
+		t.Errorf("the same hardware without the registration token must be refused: %v", stranger)
+	}
+	pending := record{}
+	callApi(t, "GET", "tvpc/"+id, nil, &pending)
+	if pending.str("status") != tvcontrol.TvpcStatusPending || pending.str("registrationToken") != "" || pending.str("pairingCode") != "" ||
+		pending.str("hardwareId") != reg.HardwareId {
+		t.Errorf("pending tvpc must not show the registration token and the pairing code: %v", pending)
+	}
+
+	screens := []record{createMedia(t, "screen", "registered", 3000, 8)}
+	presentation := createPresentation(t, "registered", screens, []int{10})
+	callApi(t, "GET", "control/"+presentation.str("id"), nil, nil)
+	if _, ok := readTasks(t)[id]; ok {
+		t.Error("pending tvpc must not get a task")
+	}
+
+	wrong := record{}
+	callApi(t, "POST", "tvpc/"+id+"/approve", map[string]string{"pairingCode": "x" + answer.PairingCode}, &wrong)
+	if wrong.str("error") == "" {
+		t.Errorf("wrong pairing code must not approve: %v", wrong)
+	}
+	approved := record{}
+	callApi(t, "POST", "tvpc/"+id+"/approve", map[string]string{"pairingCode": answer.PairingCode, "name": "lobby"}, &approved)
+	if approved.str("status") != tvcontrol.TvpcStatusApproved || approved.str("name") != "lobby" || approved.str("keyId") != "1" || approved.str("pairingCode") != "" {
+		t.Fatalf("approval must issue the key: %v", approved)
+	}
+	answer, err = player.Register(http.DefaultClient, serverUrl, reg)
+	if err != nil || answer.KeyId != "1" || player.KeyId() != "1" || player.PairingCode() != "" {
+		t.Fatalf("approved player must get its key: %+v %v", answer, err)
+	}
+
+	// the player rejects unsigned requests now, so the delivery is signed from the start
+	presentation = createPresentation(t, "approved", screens, []int{10})
+	callApi(t, "GET", "control/"+presentation.str("id"), nil, nil)
+	waitForDelivery(t, presentation, []string{id})
+	if !player.State().Ready {
+		t.Error("approved player must receive the presentation of the default group")
+	}
+}
+
+func TestAnnouncedPlayerIsDiscovered(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go tvcontrol.ServeDiscovery(conn)
+	player := createStubPlayer(t)
+	hardwareId := "announced-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	err = player.Announce(conn.LocalAddr().String(), tvcontrol.Announcement{HardwareId: hardwareId, Name: "entrance", Port: 8085})
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, 5*time.Second, "announced player is not discovered", func() bool {
+		var list []record
+		callApi(t, "GET", "tvpc/discovered", nil, &list)
+		for _, device := range list {
+			if device.str("hardwareId") == hardwareId {
+				return device.str("url") == "http://127.0.0.1:8085" && device.str("name") == "entrance"
+			}
+		}
+		return false
+	})
+}
+
+func TestPullModePlayer(t *testing.T) {
+	player, err := tvplayer.NewPlayer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reg := &tvcontrol.TvpcRegistration{HardwareId: "pull-" + strconv.FormatInt(time.Now().UnixNano(), 36), Mode: tvcontrol.TaskModePull}
+	answer, err := player.Register(http.DefaultClient, serverUrl, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := answer.Id
+	defer callApi(t, "DELETE", "tvpc/"+id, nil, nil)
+	callApi(t, "POST", "tvpc/"+id+"/approve", map[string]string{"pairingCode": answer.PairingCode}, nil)
+	answer, err = player.Register(http.DefaultClient, serverUrl, reg)
+	if err != nil || answer.KeyId != "1" {
+		t.Fatalf("approved player in pull mode must get its key without url: %+v %v", answer, err)
+	}
+
+	screens := []record{createMedia(t, "screen", "pulled", 700000, 9), createMedia(t, "screen", "pulled small", 2000, 10)}
+	presentation := createPresentation(t, "pulled", screens, []int{10, 5})
+	callApi(t, "GET", "control/"+presentation.str("id"), nil, nil)
+	res, err := http.Get(serverUrl + "api/v1/player/" + id + "/task")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned task request must be rejected, got %d", res.StatusCode)
+	}
+	eventually(t, 30*time.Second, "pulling player did not receive the presentation", func() bool {
+		ready, err := player.Pull(http.DefaultClient, serverUrl, id)
+		return err == nil && ready
+	})
+	if !reflect.DeepEqual(player.Config(), expectedConfig(t, screens, []int{10, 5})) {
+		t.Errorf("pulled config %+v", player.Config())
+	}
+	waitForDelivery(t, presentation, []string{id})
+
+	rotated := record{}
+	callApi(t, "POST", "tvpc/"+id+"/key", nil, &rotated)
+	if _, err = player.Pull(http.DefaultClient, serverUrl, id); err != nil || player.KeyId() != "2" {
+		t.Fatalf("rotated key must be delivered by the pull: %q %v", player.KeyId(), err)
+	}
+	eventually(t, 5*time.Second, "task did not take the rotated key", func() bool {
+		_, err := player.Pull(http.DefaultClient, serverUrl, id)
+		return err == nil && readTasks(t)[id].str("keyId") == "2"
+	})
+}
+
+func TestAdminCreatedPullModePlayer(t *testing.T) {
+	player, err := tvplayer.NewPlayer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tvpc := record{}
+	callApi(t, "POST", "tvpc", map[string]string{"name": "pulling", "mode": tvcontrol.TaskModePull}, &tvpc)
+	id := tvpc.str("id")
+	defer callApi(t, "DELETE", "tvpc/"+id, nil, nil)
+	screens := []record{createMedia(t, "screen", "paired", 3000, 11)}
+	presentation := createPresentation(t, "paired", screens, []int{10})
+	callApi(t, "GET", "control/"+presentation.str("id"), nil, nil)
+	if _, err = player.Pull(http.DefaultClient, serverUrl, id); err == nil || player.KeyId() != "" {
+		t.Fatalf("player without key must not pull before the admin gives its pairing token: %q %v", player.KeyId(), err)
+	}
+
+	paired := record{}
+	callApi(t, "POST", "tvpc/"+id+"/key", map[string]string{"pairingToken": player.PairingToken()}, &paired)
+	if paired.str("keyId") != "2" {
+		t.Fatalf("pairing must issue a new key: %v", paired)
+	}
+	eventually(t, 30*time.Second, "paired player did not receive the presentation", func() bool {
+		ready, err := player.Pull(http.DefaultClient, serverUrl, id)
+		return err == nil && ready
+	})
+	if player.KeyId() != "2" || player.PairingToken() != "" {
+		t.Errorf("paired player must get the key of its tvpc with the task, got %q", player.KeyId())
+	}
+	waitForDelivery(t, presentation, []string{id})
+	if keyId := readTasks(t)[id].str("keyId"); keyId != "2" {
+		t.Errorf("task must take the key signed by the player, got %q", keyId)
+	}
+	res, err := http.Post(serverUrl+"api/v1/player/"+id+"/progress", "application/json", strings.NewReader(`{"left":{}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned progress must be rejected, got %d", res.StatusCode)
+	}
+}
+
+func TestPlayerHeartbeat(t *testing.T) {
+	player := createStubPlayer(t)
+	player.HeartbeatInfo = func(heartbeat *tvcontrol.Heartbeat) {
+		heartbeat.Playing = "welcome.png"
+	}
+	tvpc := record{}
+	callApi(t, "POST", "tvpc", map[string]string{"name": "beating", "url": player.Url}, &tvpc)
+	id := tvpc.str("id")
+	defer callApi(t, "DELETE", "tvpc/"+id, nil, nil)
+	callApi(t, "POST", "tvpc/"+id+"/key", map[string]string{"pairingToken": player.PairingToken()}, nil)
+	presentation := createPresentation(t, "beating", []record{createMedia(t, "screen", "beating", 1000, 11)}, []int{10})
+	callApi(t, "GET", "control/"+presentation.str("id"), nil, nil)
+	waitForDelivery(t, presentation, []string{id})
+	eventually(t, 30*time.Second, "paired key was not delivered", func() bool {
+		return player.KeyId() == "2"
+	})
+
+	res, err := http.Post(serverUrl+"api/v1/player/"+id+"/heartbeat", "application/json", strings.NewReader(`{"uptime":1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("unsigned heartbeat must be rejected, got %d", res.StatusCode)
+	}
+	interval, err := player.SendHeartbeat(http.DefaultClient, serverUrl, id)
+	if err != nil || interval != 30*time.Second {
+		t.Fatalf("heartbeat must be taken with the next interval: %v %v", interval, err)
+	}
+	var list []record
+	callApi(t, "GET", "player/liveness", nil, &list)
+	for _, current := range list {
+		if current.str("id") == id {
+			heartbeat, _ := current["heartbeat"].(map[string]interface{})
+			if current.str("state") != tvcontrol.LivenessOnline || heartbeat["playing"] != "welcome.png" || heartbeat["encodings"] == nil {
+				t.Errorf("liveness must show the heartbeat: %v", current)
+			}
+			return
+		}
+	}
+	t.Errorf("tvpc %s is not in the liveness table %v", id, list)
+}
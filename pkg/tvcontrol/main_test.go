@@ -0,0 +1,178 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvconfig"
+	_ "github.com/Dobryvechir/microcore/pkg/dvoc"
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+)
+
+// serverUrl and htmlPath belong to the microcore server started once by TestMain
+// with the real build/tvserver.conf and build/data actions over temporary folders
+var serverUrl string
+var htmlPath string
+
+const serverProperties = `LISTEN_PORT=%d
+HTML_PATH=%s
+DB_ROOT=%s
+#include "./data/data.properties"
+`
+
+func TestMain(m *testing.M) {
+	tmp, err := os.MkdirTemp("", "tvcontrol")
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	err = startServer(tmp)
+	code := 1
+	if err == nil {
+		code = m.Run()
+	} else {
+		fmt.Println(err)
+	}
+	os.RemoveAll(tmp)
+	os.Exit(code)
+}
+
+func startServer(tmp string) error {
+	buildFolder, err := filepath.Abs("../../build")
+	if err != nil {
+		return err
+	}
+	err = copyFile(filepath.Join(buildFolder, "tvserver.conf"), filepath.Join(tmp, "tvserver.conf"))
+	if err != nil {
+		return err
+	}
+	err = copyFolder(filepath.Join(buildFolder, "data"), filepath.Join(tmp, "data"))
+	if err != nil {
+		return err
+	}
+	port, err := getFreePort()
+	if err != nil {
+		return err
+	}
+	htmlPath = filepath.Join(tmp, "html")
+	props := fmt.Sprintf(serverProperties, port, htmlPath, filepath.Join(tmp, "db"))
+	err = os.WriteFile(filepath.Join(tmp, "tvserver.properties"), []byte(props), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Chdir(tmp)
+	if err != nil {
+		return err
+	}
+	tvcontrol.SetDelaysForTest(1, 1, 0)
+	dvconfig.SetApplicationName("tvserver")
+	go dvconfig.ServerStart()
+	tvcontrol.RunMainWorker()
+	serverUrl = "http://127.0.0.1:" + strconv.Itoa(port) + "/"
+	for i := 0; i < 100; i++ {
+		time.Sleep(100 * time.Millisecond)
+		res, err := http.Get(serverUrl + "actuator/health")
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+	}
+	return errors.New("server did not start at " + serverUrl)
+}
+
+func getFreePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func copyFile(src string, dst string) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(dst, data, 0644)
+}
+
+func copyFolder(src string, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(filepath.Join(dst, rel), 0755)
+		}
+		return copyFile(path, filepath.Join(dst, rel))
+	})
+}
+
+func callApi(t *testing.T, method string, api string, body interface{}, result interface{}) {
+	t.Helper()
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, serverUrl+"api/v1/"+api, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode >= 300 {
+		t.Fatalf("%s %s: %d %s", method, api, res.StatusCode, data)
+	}
+	if result != nil {
+		err = json.Unmarshal(data, result)
+		if err != nil {
+			t.Fatalf("%s %s: %v in %s", method, api, err, data)
+		}
+	}
+}
+
+func eventually(t *testing.T, timeout time.Duration, message string, check func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout: " + message)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -6,6 +6,8 @@ Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
 package tvcontrol
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
@@ -13,43 +15,139 @@ import (
 	"github.com/Dobryvechir/microcore/pkg/dvlog"
 )
 
-var taskWorkerPoolChannel = make(chan int)
-var taskWorkerPool map[string]*TaskWorker = make(map[string]*TaskWorker)
-var logLevel = true
+// the server loads its properties and databases meanwhile
+const supervisorStartDelay = 5 * time.Second
+
+// Supervisor owns the pool of task workers, one worker per record of the task table;
+// all access to the pool goes under mu, the workers are stopped by cancelling their contexts
+type Supervisor struct {
+	mu      sync.Mutex
+	workers map[string]*TaskWorker
+	// stopping are the cancelled workers which have not returned yet,
+	// a new worker for the same id starts only after the old one returns
+	stopping map[string]*TaskWorker
+	wakeUp   chan int
+	wg       sync.WaitGroup
+	// closed supervisor accepts no wake-ups and starts no workers until it is run again
+	closed    bool
+	cancelRun context.CancelFunc
+	// abortCtx is cancelled when the shutdown deadline passes, it cuts the requests of the workers
+	abortCtx context.Context
+	abort    context.CancelFunc
+}
+
+// ShutdownSummary tells how the workers were stopped
+type ShutdownSummary struct {
+	Workers    int
+	Unfinished int
+	Aborted    bool
+	// Stuck has the ids of the workers which have not returned even after the abort
+	Stuck    []string
+	Duration time.Duration
+}
+
+// default seconds for the workers to finish their current step on shutdown
+const defaultShutdownTimeout = 30
+
+func NewSupervisor() *Supervisor {
+	s := &Supervisor{workers: make(map[string]*TaskWorker), stopping: make(map[string]*TaskWorker), wakeUp: make(chan int, 1)}
+	s.abortCtx, s.abort = context.WithCancel(context.Background())
+	return s
+}
+
+var mainSupervisor = NewSupervisor()
+
+func GetMainSupervisor() *Supervisor {
+	return mainSupervisor
+}
 
 func wakeUpMainWorker() error {
-	select {
-	case taskWorkerPoolChannel <- 0:
-		if logLevel {
+	if mainSupervisor.WakeUp() {
+		if logLevel() {
 			dvlog.Print("woke up main worker")
 		}
-	default:
-		if logLevel {
-			dvlog.Print("main worker already waken up")
-		}
+	} else if logLevel() {
+		dvlog.Print("main worker already waken up")
 	}
 	return nil
 }
 
 func RunMainWorker() {
-    go runMainWorkerThread()
+	go mainSupervisor.Run(context.Background())
 }
 
-func runMainWorkerThread() {
-	time.Sleep(5 * time.Second)
+// GetShutdownTimeout returns TVSERVER_SHUTDOWN_TIMEOUT, the seconds given to the workers on shutdown
+func GetShutdownTimeout() time.Duration {
+	return time.Duration(readIntProperty("TVSERVER_SHUTDOWN_TIMEOUT", defaultShutdownTimeout)) * time.Second
+}
+
+// ShutdownMainWorker stops the workers of the server, the next RunMainWorker resumes the tasks
+// from the leftFiles saved in the task table
+func ShutdownMainWorker() *ShutdownSummary {
+	return mainSupervisor.Shutdown(GetShutdownTimeout())
+}
+
+// WakeUp makes the supervisor read the task table again
+func (s *Supervisor) WakeUp() bool {
+	s.mu.Lock()
+	closed := s.closed
+	s.mu.Unlock()
+	if closed {
+		return false
+	}
+	select {
+	case s.wakeUp <- 0:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run keeps the workers in line with the task table until ctx is cancelled, then stops them all
+func (s *Supervisor) Run(ctx context.Context) {
+	s.mu.Lock()
+	s.closed = false
+	if s.abortCtx.Err() != nil {
+		s.abortCtx, s.abort = context.WithCancel(context.Background())
+	}
+	ctx, s.cancelRun = context.WithCancel(ctx)
+	s.mu.Unlock()
+	select {
+	case <-time.After(supervisorStartDelay):
+	case <-ctx.Done():
+		return
+	}
+	ApplySettings()
+	if err := migrateTvpcSecrets(); err != nil {
+		dvlog.PrintError(err)
+	}
+	if err := migrateTaskTable(); err != nil {
+		dvlog.PrintError(err)
+	}
+	if err := pruneTaskEvents(time.Now()); err != nil {
+		dvlog.PrintError(err)
+	}
+	if err := cleanMediaStore(); err != nil {
+		dvlog.PrintError(err)
+	}
 	for {
 		res, err := dvdbmanager.RecordReadAll(taskDbName)
 		if err == nil {
-			loadMainTasks(res)
+			s.LoadTasks(ctx, res)
 		} else {
 			dvlog.PrintError(err)
 		}
-		<-taskWorkerPoolChannel
+		select {
+		case <-s.wakeUp:
+		case <-ctx.Done():
+			s.StopAll()
+			return
+		}
 	}
-
 }
 
-func loadMainTasks(res *dvevaluation.DvVariable) {
+// LoadTasks starts or wakes up the workers of the listed tasks and stops the others
+func (s *Supervisor) LoadTasks(ctx context.Context, res *dvevaluation.DvVariable) {
 	if res == nil || len(res.Fields) == 0 {
 		dvlog.PrintlnError("No task is defined yet")
 		return
@@ -63,64 +161,165 @@ func loadMainTasks(res *dvevaluation.DvVariable) {
 			continue
 		}
 		rest[id] = 1
-		createOrWakeUpTaskById(id, v)
+		s.StartOrWakeUp(ctx, id, v)
 	}
-	for k := range taskWorkerPool {
-		if rest[k] != 1 {
-			getTaskDownById(k)
+	for _, id := range s.Ids() {
+		if rest[id] != 1 {
+			s.Stop(id)
 		}
 	}
 }
 
-func getTaskDownById(id string) {
-	task, ok := taskWorkerPool[id]
-	if !ok {
+// Ids returns the ids of the running workers
+func (s *Supervisor) Ids() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]string, 0, len(s.workers))
+	for id := range s.workers {
+		res = append(res, id)
+	}
+	return res
+}
+
+// Worker returns the running worker of the task or nil
+func (s *Supervisor) Worker(id string) *TaskWorker {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.workers[id]
+}
+
+// StartOrWakeUp wakes up the running worker of the task or starts a new one with v as its task
+func (s *Supervisor) StartOrWakeUp(ctx context.Context, id string, v *dvevaluation.DvVariable) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
 		return
 	}
-	delete(taskWorkerPool, id)
-	if task == nil {
+	task, ok := s.workers[id]
+	if ok {
+		if task.WakeUp(1) {
+			if logLevel() {
+				dvlog.Print("Wake up sent")
+			}
+		} else if logLevel() {
+			dvlog.Print("Wake up already sent")
+		}
 		return
 	}
-	select {
-	case task.StopChannel <- 2:
-		if logLevel {
-			dvlog.Print("Stop sent")
+	tvTask := &TvTask{}
+	err := v.DvVariableToAnyStruct(tvTask)
+	if err != nil {
+		tvTask = nil
+		dvlog.PrintError(err)
+	}
+	task = NewTaskWorker(id, tvTask)
+	task.abort = s.abortCtx
+	var taskCtx context.Context
+	taskCtx, task.cancel = context.WithCancel(ctx)
+	previous := s.stopping[id]
+	s.workers[id] = task
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if previous != nil {
+			<-previous.done
 		}
-	default:
-		if logLevel {
-			dvlog.Print("Stop already sent")
+		task.RunBackground(taskCtx)
+		task.cancel()
+		dvlog.Print("Task " + task.Id + " ended")
+		s.mu.Lock()
+		if s.workers[id] == task {
+			delete(s.workers, id)
+		}
+		if s.stopping[id] == task {
+			delete(s.stopping, id)
 		}
+		s.mu.Unlock()
+	}()
+}
+
+// Stop cancels the worker of the task, it returns after the current step is finished
+func (s *Supervisor) Stop(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	task, ok := s.workers[id]
+	if !ok {
+		return
+	}
+	delete(s.workers, id)
+	s.stopping[id] = task
+	task.cancel()
+	if logLevel() {
+		dvlog.Print("Stop sent")
 	}
 }
 
-func createOrWakeUpTaskById(id string, v *dvevaluation.DvVariable) {
-	task, ok := taskWorkerPool[id]
-	if !ok || task == nil {
-		tvTask := &TvTask{}
-		err := v.DvVariableToAnyStruct(tvTask)
-		if err != nil {
-			tvTask = nil
-			dvlog.PrintError(err)
+// StopAll cancels all workers
+func (s *Supervisor) StopAll() {
+	for _, id := range s.Ids() {
+		s.Stop(id)
+	}
+}
+
+// Wait returns when all started workers have returned
+func (s *Supervisor) Wait() {
+	s.wg.Wait()
+}
+
+// Shutdown stops accepting wake-ups and stops all workers; they finish their current step
+// and save the task, the requests still running after timeout are aborted and the workers
+// which do not return within another timeout are reported as stuck
+func (s *Supervisor) Shutdown(timeout time.Duration) *ShutdownSummary {
+	started := time.Now()
+	s.mu.Lock()
+	s.closed = true
+	cancelRun := s.cancelRun
+	abort := s.abort
+	workers := make([]*TaskWorker, 0, len(s.workers)+len(s.stopping))
+	for _, task := range s.workers {
+		workers = append(workers, task)
+	}
+	for _, task := range s.stopping {
+		workers = append(workers, task)
+	}
+	s.mu.Unlock()
+	if cancelRun != nil {
+		cancelRun()
+	}
+	s.StopAll()
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	summary := &ShutdownSummary{Workers: len(workers)}
+	timer := time.NewTimer(timeout)
+	select {
+	case <-done:
+		timer.Stop()
+	case <-timer.C:
+		summary.Aborted = true
+		abort()
+		// the aborted requests return at once, a worker still running after the same timeout is left
+		timer.Reset(timeout)
+		select {
+		case <-done:
+			timer.Stop()
+		case <-timer.C:
 		}
-		task = &TaskWorker{Id: id, Task: tvTask, WakeUpChannel: make(chan int), StopChannel: make(chan int)}
-		taskWorkerPool[id] = task
-		go func() {
-			task.RunBackground()
-			dvlog.Print("Task " + task.Id + " ended")
-			if _, ok = taskWorkerPool[id]; ok {
-				taskWorkerPool[id] = nil
-			}
-		}()
-	} else {
+	}
+	for _, task := range workers {
 		select {
-		case task.WakeUpChannel <- 1:
-			if logLevel {
-				dvlog.Print("Wake up sent")
-			}
+		case <-task.done:
 		default:
-			if logLevel {
-				dvlog.Print("Wake up already sent")
-			}
+			summary.Stuck = append(summary.Stuck, task.Id)
+			continue
+		}
+		if task.Task != nil && task.Task.isSending() {
+			summary.Unfinished++
 		}
 	}
+	summary.Duration = time.Since(started)
+	dvlog.PrintfFullOnly("Shutdown of %d task workers in %v, %d tasks unfinished, aborted %v, stuck %v", summary.Workers, summary.Duration, summary.Unfinished, summary.Aborted, summary.Stuck)
+	return summary
 }
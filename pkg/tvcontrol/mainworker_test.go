@@ -0,0 +1,214 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+)
+
+func waitForDone(t *testing.T, task *TaskWorker) {
+	t.Helper()
+	select {
+	case <-task.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("worker %s did not stop", task.Id)
+	}
+}
+
+func TestSupervisorStartWakeStopRestart(t *testing.T) {
+	// a task without url keeps the worker idle, so it waits for wake up or stop
+	row, err := createOrUpdateTaskDatabase(&TvTask{Id: "9001", Name: "idle"}, taskConditionsForWeb, taskFieldsForWeb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dvdbmanager.RecordDelete(taskDbName, "9001")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := NewSupervisor()
+
+	s.StartOrWakeUp(ctx, "9001", row)
+	task := s.Worker("9001")
+	if task == nil || task.Id != "9001" {
+		t.Fatalf("worker is not created: %v", task)
+	}
+	for i := 0; i < 10; i++ {
+		s.StartOrWakeUp(ctx, "9001", row)
+	}
+	if s.Worker("9001") != task {
+		t.Fatal("wake up must reuse the running worker")
+	}
+
+	s.Stop("9001")
+	if s.Worker("9001") != nil {
+		t.Fatal("stopped worker must be removed from the pool")
+	}
+	// the same id is started again at once, the new worker waits for the old one
+	s.StartOrWakeUp(ctx, "9001", row)
+	restarted := s.Worker("9001")
+	if restarted == nil || restarted == task {
+		t.Fatal("restart must create a new worker")
+	}
+	waitForDone(t, task)
+	select {
+	case <-restarted.Done():
+		t.Fatal("restarted worker must keep running")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	cancel()
+	waitForDone(t, restarted)
+	s.Wait()
+	if ids := s.Ids(); len(ids) != 0 {
+		t.Errorf("cancelled supervisor must have no workers, got %v", ids)
+	}
+}
+
+func TestSupervisorDropsDeletedTask(t *testing.T) {
+	row, err := createOrUpdateTaskDatabase(&TvTask{Id: "9003", Name: "gone"}, taskConditionsForWeb, taskFieldsForWeb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dvdbmanager.RecordDelete(taskDbName, "9003")
+	s := NewSupervisor()
+	s.StartOrWakeUp(context.Background(), "9003", row)
+	task := s.Worker("9003")
+	if task == nil {
+		t.Fatal("worker is not created")
+	}
+	waitForDone(t, task)
+	s.Wait()
+	if s.Worker("9003") != nil {
+		t.Error("worker of a deleted task must leave the pool")
+	}
+}
+
+// hangingPlayer answers the first upload and hangs on the others while hang is set
+type hangingPlayer struct {
+	mu      sync.Mutex
+	hang    bool
+	uploads []string
+	hanging chan string
+}
+
+func (p *hangingPlayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, "/upload/") {
+		w.Write([]byte(`{"status":"UP"}`))
+		return
+	}
+	p.mu.Lock()
+	p.uploads = append(p.uploads, r.URL.Path)
+	hang := p.hang && len(p.uploads) > 1
+	p.mu.Unlock()
+	io.ReadAll(r.Body)
+	if hang {
+		p.hanging <- r.URL.Path
+		<-r.Context().Done()
+		return
+	}
+	w.Write([]byte("{}"))
+}
+
+func (p *hangingPlayer) takeUploads() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := p.uploads
+	p.uploads = nil
+	return res
+}
+
+func readTask(t *testing.T, id string) *TvTask {
+	t.Helper()
+	res, err := dvdbmanager.RecordReadOne(taskDbName, id)
+	if err != nil || res == nil {
+		t.Fatalf("task %s is not read: %v", id, err)
+	}
+	task := &TvTask{}
+	if err = res.DvVariableToAnyStruct(task); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+func TestSupervisorShutdownAndResume(t *testing.T) {
+	defer SetPropertyForTest("TVSERVER_CHUNK_MIN", "1000")()
+	defer SetPropertyForTest("TVSERVER_CHUNK_MAX", "1000")()
+	writeHtmlFile(t, "shutdown.png", 3000)
+	player := &hangingPlayer{hang: true, hanging: make(chan string, 1)}
+	server := httptest.NewServer(player)
+	defer server.Close()
+	row, err := createOrUpdateTaskDatabase(&TvTask{Id: "9004", Name: "shutdown", Url: server.URL, OldPresentationId: "9", OldPresentationVersion: "1",
+		NewPresentationId: "9", NewPresentationVersion: "1", Config: &TvConfig{File: []string{"s-3000.png"}, Duration: []int{5}},
+		RealFiles: []string{"/shutdown.png"}, LeftFiles: []string{"s-3000.png"}, TaskStatus: 1}, taskConditionsForWeb, taskFieldsForWeb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dvdbmanager.RecordDelete(taskDbName, "9004")
+
+	s := NewSupervisor()
+	s.StartOrWakeUp(context.Background(), "9004", row)
+	select {
+	case <-player.hanging:
+	case <-time.After(10 * time.Second):
+		t.Fatal("second chunk was not sent")
+	}
+	summary := s.Shutdown(200 * time.Millisecond)
+	if summary.Workers != 1 || summary.Unfinished != 1 || !summary.Aborted {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if s.WakeUp() {
+		t.Error("supervisor must not accept wake-ups after shutdown")
+	}
+	task := readTask(t, "9004")
+	if !reflect.DeepEqual(task.LeftFiles, []string{"s-3000.png:1000"}) || task.ConnectionStatus != 0 {
+		t.Errorf("the acknowledged offset must be saved without a connection error, got %v %d", task.LeftFiles, task.ConnectionStatus)
+	}
+
+	// the restarted worker continues from the saved offset
+	player.mu.Lock()
+	player.hang = false
+	player.mu.Unlock()
+	player.takeUploads()
+	s = NewSupervisor()
+	s.StartOrWakeUp(context.Background(), "9004", row)
+	for i := 0; i < 100 && readTask(t, "9004").TaskStatus != 1000; i++ {
+		time.Sleep(50 * time.Millisecond)
+	}
+	summary = s.Shutdown(5 * time.Second)
+	if summary.Aborted || summary.Unfinished != 0 {
+		t.Errorf("finished worker must stop in time, got %+v", summary)
+	}
+	if uploads := player.takeUploads(); !reflect.DeepEqual(uploads, []string{"/upload/0_1000_1000", "/upload/0_2000_1000"}) {
+		t.Errorf("resume must start from the saved offset, got %v", uploads)
+	}
+}
+
+func TestSupervisorShutdownReportsStuckWorkers(t *testing.T) {
+	s := NewSupervisor()
+	// a worker which never returns, like one blocked outside of its requests
+	stuck := NewTaskWorker("9005", nil)
+	stuck.cancel = func() {}
+	s.workers["9005"] = stuck
+	s.wg.Add(1)
+	defer s.wg.Done()
+	started := time.Now()
+	summary := s.Shutdown(50 * time.Millisecond)
+	if !summary.Aborted || !reflect.DeepEqual(summary.Stuck, []string{"9005"}) {
+		t.Errorf("stuck worker must be reported, got %+v", summary)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("shutdown must not wait for the stuck worker, took %v", elapsed)
+	}
+}
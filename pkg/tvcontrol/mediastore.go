@@ -0,0 +1,230 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"errors"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+	"github.com/Dobryvechir/microcore/pkg/dvparser"
+)
+
+// media are kept under HTML_PATH by their content hash, so the same picture
+// in many presentations has the same name for the players and is sent only once
+const mediaStoreFolder = "/store/"
+const contentNameHashLength = 32
+
+// template of the names given to the uploaded screens by fileweb: i583747_7721532218530737715-1071263.png
+var generatedFileName = regexp.MustCompile(`^[iv][0-9]+_[0-9]+-[0-9]+\.[a-z0-9]+$`)
+
+// files stored since the start are kept by the store cleanup, their tasks may be not saved yet
+var storedMediaFiles = make(map[string]bool)
+var storedMediaFilesMu sync.Mutex
+
+// template: i3f7a0c9d2b1e8f4a6c5d7e9b0a1c2d3e-1071263.png
+func getContentFileName(hash string, size int64, ext string) (string, error) {
+	prefix, err := getFileNamePrefix(ext)
+	if err != nil {
+		return "", err
+	}
+	if len(hash) < contentNameHashLength {
+		return "", errors.New("too short hash " + hash)
+	}
+	return prefix + hash[:contentNameHashLength] + "-" + strconv.FormatInt(size, 10) + "." + ext, nil
+}
+
+func copyMediaFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst + ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err1 := out.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(dst + ".tmp")
+		return err
+	}
+	return os.Rename(dst+".tmp", dst)
+}
+
+// storeMediaFile puts the file into the store by its hash, a hard link is used where possible
+func storeMediaFile(realFile string, hash string, ext string, size int64) (string, error) {
+	root := dvparser.GetByGlobalPropertiesOrDefault("HTML_PATH", "")
+	storeFile := mediaStoreFolder + hash + "." + ext
+	dst := root + storeFile
+	storedMediaFilesMu.Lock()
+	storedMediaFiles[storeFile] = true
+	storedMediaFilesMu.Unlock()
+	if fi, err := os.Stat(dst); err == nil && fi.Size() == size {
+		return storeFile, nil
+	}
+	err := os.MkdirAll(root+mediaStoreFolder, 0755)
+	if err != nil {
+		return "", err
+	}
+	src := root + realFile
+	if os.Link(src, dst) != nil {
+		err = copyMediaFile(src, dst)
+		if err != nil {
+			return "", err
+		}
+	}
+	if logLevel() {
+		dvlog.PrintfFullOnly("Stored %s as %s", realFile, storeFile)
+	}
+	return storeFile, nil
+}
+
+// isCustomFileName tells if the screen file name is set by the operator and can be given to the players,
+// it must have the prefix of its extension and end with the size of the file
+func isCustomFileName(name string, ext string, size int64) bool {
+	if name == "" || generatedFileName.MatchString(name) || strings.ContainsAny(name, "/\\:") {
+		return false
+	}
+	prefix, err := getFileNamePrefix(ext)
+	return err == nil && strings.HasPrefix(name, prefix) && strings.HasSuffix(name, "-"+strconv.FormatInt(size, 10)+"."+ext)
+}
+
+// putUpContentFiles replaces the real files by their content-addressed versions and the config file names
+// by the content names unless the operator has set them
+func putUpContentFiles(config *TvConfig, realFiles []string) error {
+	n := len(config.File)
+	if n == 0 {
+		return errors.New("no files to show")
+	}
+	if n != len(realFiles) {
+		return errors.New("misconfiguration in screens, remove them and create from the scratch")
+	}
+	hashes, err := calculateRealFileHashes(realFiles)
+	if err != nil {
+		return err
+	}
+	root := dvparser.GetByGlobalPropertiesOrDefault("HTML_PATH", "")
+	for i := 0; i < n; i++ {
+		ext, err := getFileNameExtension(realFiles[i])
+		if err != nil {
+			return err
+		}
+		fi, err := os.Stat(root + realFiles[i])
+		if err != nil {
+			return err
+		}
+		if fi.Size() == 0 {
+			return errors.New("File " + realFiles[i] + " has zero size")
+		}
+		storeFile, err := storeMediaFile(realFiles[i], hashes[i], ext, fi.Size())
+		if err != nil {
+			return err
+		}
+		if !isCustomFileName(config.File[i], ext, fi.Size()) {
+			if config.File[i] != "" && !generatedFileName.MatchString(config.File[i]) {
+				dvlog.PrintfFullOnly("File name %s does not end with -%d.%s, the content name is used", config.File[i], fi.Size(), ext)
+			}
+			config.File[i], err = getContentFileName(hashes[i], fi.Size(), ext)
+			if err != nil {
+				return err
+			}
+		}
+		realFiles[i] = storeFile
+	}
+	config.Hash = hashes
+	return nil
+}
+
+func addStoreFiles(used map[string]bool, realFiles []string) {
+	for _, f := range realFiles {
+		if strings.HasPrefix(f, mediaStoreFolder) {
+			used[f] = true
+		}
+	}
+}
+
+// getUsedStoreFiles returns the store files of the tasks and of the delivered configs kept for rollback
+func getUsedStoreFiles() (map[string]bool, error) {
+	used := make(map[string]bool)
+	tasks, err := dvdbmanager.RecordReadAll(taskDbName)
+	if err != nil {
+		return nil, err
+	}
+	if tasks != nil {
+		for _, row := range tasks.Fields {
+			t, err := rowToTask(row)
+			if err != nil {
+				return nil, err
+			}
+			addStoreFiles(used, t.RealFiles)
+		}
+	}
+	configHistoryMu.Lock()
+	defer configHistoryMu.Unlock()
+	histories, err := dvdbmanager.RecordReadAll(configHistoryDbName)
+	if err != nil {
+		return nil, err
+	}
+	if histories != nil {
+		for _, row := range histories.Fields {
+			history := &configHistory{}
+			err = row.DvVariableToAnyStruct(history)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range history.Configs {
+				addStoreFiles(used, c.RealFiles)
+			}
+		}
+	}
+	return used, nil
+}
+
+// cleanMediaStore removes the store files which no task and no delivered config refers to,
+// a presentation activated again stores its files once more
+func cleanMediaStore() error {
+	used, err := getUsedStoreFiles()
+	if err != nil {
+		return err
+	}
+	root := dvparser.GetByGlobalPropertiesOrDefault("HTML_PATH", "")
+	entries, err := os.ReadDir(root + mediaStoreFolder)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	removed := 0
+	for _, entry := range entries {
+		storeFile := mediaStoreFolder + entry.Name()
+		storedMediaFilesMu.Lock()
+		stored := storedMediaFiles[storeFile]
+		storedMediaFilesMu.Unlock()
+		if entry.IsDir() || used[storeFile] || stored {
+			continue
+		}
+		err = os.Remove(root + storeFile)
+		if err != nil {
+			return err
+		}
+		removed++
+	}
+	if removed > 0 {
+		dvlog.PrintfFullOnly("%d unused files are removed from the media store", removed)
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// seconds a tv pc with peers may receive files from them without progress
+// before the server uploads the files itself
+const defaultPeerTimeout = 120
+
+// GetPeerSeeds returns TVSERVER_PEER_SEEDS, the number of tv pcs in a group and subnet
+// which receive the files from the server, 0 switches the distribution between peers off
+func GetPeerSeeds() int {
+	return readIntProperty("TVSERVER_PEER_SEEDS", 0)
+}
+
+func GetPeerTimeout() time.Duration {
+	return time.Duration(readIntProperty("TVSERVER_PEER_TIMEOUT", defaultPeerTimeout)) * time.Second
+}
+
+func normalizeComputerUrl(s string) string {
+	return (&TaskWorker{Task: &TvTask{Url: s}}).GetComputerUrl()
+}
+
+// getSubnet gives the /24 network of an ipv4 address, other hosts are their own subnet
+func getSubnet(computerUrl string) string {
+	u, err := url.Parse(normalizeComputerUrl(computerUrl))
+	if err != nil {
+		return computerUrl
+	}
+	host := u.Hostname()
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		return strings.ToLower(host)
+	}
+	return ip.Mask(net.CIDRMask(24, 32)).String()
+}
+
+// assignPeerSeeds gives the first tv pcs of every group and subnet the files from the server,
+// the others get the urls of these seeds in the config and pull the files from them
+func assignPeerSeeds(tasks []*TvTask) {
+	seeds := GetPeerSeeds()
+	if seeds <= 0 {
+		return
+	}
+	subnets := make(map[string][]*TvTask)
+	order := make([]string, 0, 4)
+	for _, t := range tasks {
+		key := t.GroupId + " " + getSubnet(t.Url)
+		if _, ok := subnets[key]; !ok {
+			order = append(order, key)
+		}
+		subnets[key] = append(subnets[key], t)
+	}
+	for _, key := range order {
+		list := subnets[key]
+		if len(list) <= seeds || list[0].Config == nil {
+			continue
+		}
+		peers := make([]string, seeds)
+		for i := 0; i < seeds; i++ {
+			peers[i] = normalizeComputerUrl(list[i].Url)
+		}
+		for _, t := range list[seeds:] {
+			config := *t.Config
+			config.Peer = peers
+			t.Config = &config
+		}
+	}
+}
+
+// isWaitingForPeers tells that the files are left to the peers until they stop making progress
+func (task *TaskWorker) isWaitingForPeers() bool {
+	t := task.Task
+	if t.Config == nil || len(t.Config.Peer) == 0 {
+		return false
+	}
+	if task.peerProgressAt.IsZero() {
+		task.peerProgressAt = time.Now()
+	}
+	return time.Since(task.peerProgressAt) < GetPeerTimeout()
+}
@@ -0,0 +1,65 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestAssignPeerSeeds(t *testing.T) {
+	cases := map[string]string{
+		"http://10.1.2.3:8085/": "10.1.2.0",
+		"10.1.2.200":            "10.1.2.0",
+		"//Hall.local:80":       "hall.local",
+	}
+	for u, expected := range cases {
+		if s := getSubnet(u); s != expected {
+			t.Errorf("getSubnet(%s)=%s, expected %s", u, s, expected)
+		}
+	}
+
+	config := &TvConfig{File: []string{"a-1.png"}, Duration: []int{5}}
+	newTasks := func() []*TvTask {
+		return []*TvTask{
+			{Id: "1", Url: "10.1.2.3:8085", GroupId: "5", Config: config},
+			{Id: "2", Url: "10.1.2.4:8085", GroupId: "5", Config: config},
+			{Id: "3", Url: "10.1.2.5:8085", GroupId: "5", Config: config},
+			{Id: "4", Url: "10.1.9.5:8085", GroupId: "5", Config: config},
+			{Id: "5", Url: "10.1.2.6:8085", GroupId: "6", Config: config},
+		}
+	}
+	tasks := newTasks()
+	assignPeerSeeds(tasks)
+	for _, task := range tasks {
+		if len(task.Config.Peer) != 0 {
+			t.Errorf("peers must be off by default, got %v in %s", task.Config.Peer, task.Id)
+		}
+	}
+
+	defer SetPropertyForTest("TVSERVER_PEER_SEEDS", "1")()
+	tasks = newTasks()
+	assignPeerSeeds(tasks)
+	peers := []string{"http://10.1.2.3:8085/"}
+	if tasks[0].Config.Peer != nil || !reflect.DeepEqual(tasks[1].Config.Peer, peers) || !reflect.DeepEqual(tasks[2].Config.Peer, peers) {
+		t.Errorf("the first tv pc of the subnet must be the seed of the others: %v %v %v", tasks[0].Config, tasks[1].Config, tasks[2].Config)
+	}
+	if tasks[3].Config.Peer != nil || tasks[4].Config.Peer != nil {
+		t.Errorf("other subnets and groups must not get peers")
+	}
+	if config.Peer != nil {
+		t.Errorf("the shared config must not be changed")
+	}
+
+	task := &TaskWorker{Task: tasks[1]}
+	if !task.isWaitingForPeers() {
+		t.Errorf("a tv pc with peers must wait for them first")
+	}
+	defer SetPropertyForTest("TVSERVER_PEER_TIMEOUT", "0")()
+	if task.isWaitingForPeers() {
+		t.Errorf("after the timeout the server must send the files itself")
+	}
+}
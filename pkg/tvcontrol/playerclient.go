@@ -0,0 +1,221 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// kinds of requests to a tv pc, each has its own deadline
+type requestKind int
+
+const (
+	requestStatus requestKind = iota
+	requestConfig
+	requestUpload
+)
+
+// default seconds of the deadlines of status, config and upload requests and of connecting
+const (
+	defaultStatusTimeout  = 15
+	defaultConfigTimeout  = 60
+	defaultUploadTimeout  = 300
+	defaultConnectTimeout = 10
+)
+
+// idle connections kept per tv pc, enough for the parallel uploads, and how long they are kept
+const (
+	defaultIdleConnections = 8
+	defaultIdleTimeout     = 90
+)
+
+// the error answer of a player kept in the task record, the rest is read and dropped
+// so that the connection can be reused
+const (
+	maxErrorBody = 1024
+	maxDrainBody = 64 * 1024
+)
+
+// PlayerError is an error status of a tv pc together with the start of its answer
+type PlayerError struct {
+	StatusCode int
+	Method     string
+	Url        string
+	Body       string
+}
+
+func (e *PlayerError) Error() string {
+	return strconv.Itoa(e.StatusCode) + " " + e.Method + " " + e.Url + ": " + e.Body
+}
+
+// getRequestTimeout returns TVSERVER_STATUS_TIMEOUT, TVSERVER_CONFIG_TIMEOUT or
+// TVSERVER_UPLOAD_TIMEOUT for the kind of the request
+func getRequestTimeout(kind requestKind) time.Duration {
+	var seconds int
+	switch kind {
+	case requestStatus:
+		seconds = readIntProperty("TVSERVER_STATUS_TIMEOUT", defaultStatusTimeout)
+	case requestConfig:
+		seconds = readIntProperty("TVSERVER_CONFIG_TIMEOUT", defaultConfigTimeout)
+	default:
+		seconds = readIntProperty("TVSERVER_UPLOAD_TIMEOUT", defaultUploadTimeout)
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+type transportSettings struct {
+	connectTimeout  int
+	idleConnections int
+	idleTimeout     int
+	caFile          string
+	systemCa        bool
+	certFile        string
+	keyFile         string
+}
+
+func getTransportSettings() transportSettings {
+	return transportSettings{
+		connectTimeout:  readIntProperty("TVSERVER_CONNECT_TIMEOUT", defaultConnectTimeout),
+		idleConnections: readIntProperty("TVSERVER_HTTP_IDLE_CONNECTIONS", defaultIdleConnections),
+		idleTimeout:     readIntProperty("TVSERVER_HTTP_IDLE_TIMEOUT", defaultIdleTimeout),
+		caFile:          readProperty("TVSERVER_TLS_CA", ""),
+		systemCa:        readProperty("TVSERVER_TLS_SYSTEM_CA", "false") == "true",
+		certFile:        readProperty("TVSERVER_TLS_CERT", ""),
+		keyFile:         readProperty("TVSERVER_TLS_KEY", ""),
+	}
+}
+
+// the clients are kept by the pin of the tv pc, all tv pcs without pin share one client
+var playerClients = make(map[string]*http.Client)
+var playerClientSettings transportSettings
+var playerClientMu sync.Mutex
+
+func newPlayerTransport(settings transportSettings, pin string) (*http.Transport, error) {
+	tlsConfig, err := newPlayerTlsConfig(settings, pin)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: time.Duration(settings.connectTimeout) * time.Second, KeepAlive: 30 * time.Second}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		MaxIdleConns:          settings.idleConnections * 16,
+		MaxIdleConnsPerHost:   settings.idleConnections,
+		IdleConnTimeout:       time.Duration(settings.idleTimeout) * time.Second,
+		TLSHandshakeTimeout:   time.Duration(settings.connectTimeout) * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}, nil
+}
+
+// getPlayerClient gives the client shared by the workers of the tv pcs with the same pin,
+// the clients are created again when the transport properties are reloaded;
+// the deadlines are set per request
+func getPlayerClient(pin string) (*http.Client, error) {
+	settings := getTransportSettings()
+	playerClientMu.Lock()
+	defer playerClientMu.Unlock()
+	if playerClientSettings != settings {
+		for _, client := range playerClients {
+			client.CloseIdleConnections()
+		}
+		playerClients = make(map[string]*http.Client)
+		playerClientSettings = settings
+	}
+	client := playerClients[pin]
+	if client == nil {
+		transport, err := newPlayerTransport(settings, pin)
+		if err != nil {
+			return nil, err
+		}
+		client = &http.Client{Transport: transport}
+		playerClients[pin] = client
+	}
+	return client, nil
+}
+
+// readErrorBody keeps the start of the answer and drains the rest
+func readErrorBody(body io.Reader) []byte {
+	data, _ := io.ReadAll(io.LimitReader(body, maxErrorBody))
+	io.Copy(io.Discard, io.LimitReader(body, maxDrainBody))
+	return data
+}
+
+// sendRequest signs the request by the current key of the tvpc
+func (task *TaskWorker) sendRequest(kind requestKind, url string, body string, method string, headers map[string]string) (string, error) {
+	var key *PlayerKey
+	if task.Task.KeyId != "" {
+		key = getTvpcKey(task.Task.Id, task.Task.KeyId)
+		if key == nil {
+			return "", errors.New("no secret of key " + task.Task.KeyId + " of tvpc " + task.Task.Id)
+		}
+	}
+	return task.sendSignedRequest(kind, url, body, method, headers, key)
+}
+
+// sendSignedRequest signs the request by key, a request without key is sent unsigned; it keeps
+// the error of the request in the events of the task unless the shutdown aborted it
+func (task *TaskWorker) sendSignedRequest(kind requestKind, url string, body string, method string, headers map[string]string, key *PlayerKey) (string, error) {
+	res, err := task.sendRequestOnce(kind, url, body, method, headers, key)
+	if err != nil && task.getAbortContext().Err() == nil {
+		recordTaskEvent(task.Task.Id, TaskEventError, task.Task.Phase, method+" "+url+": "+err.Error())
+	}
+	return res, err
+}
+
+func (task *TaskWorker) sendRequestOnce(kind requestKind, url string, body string, method string, headers map[string]string, key *PlayerKey) (string, error) {
+	fullUrl := task.GetComputerUrl() + url
+	ctx, cancel := context.WithTimeout(task.getAbortContext(), getRequestTimeout(kind))
+	defer cancel()
+	var bodyIo io.Reader
+	if body != "" {
+		bodyIo = bytes.NewReader([]byte(body))
+	}
+	req, err := http.NewRequestWithContext(ctx, method, fullUrl, bodyIo)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if key != nil {
+		req.Header.Set(SignatureHeader, SignRequest(key, method, req.URL.Path, []byte(body), time.Now()))
+	}
+
+	client, err := getPlayerClient(task.Task.Pin)
+	if err != nil {
+		return "", err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		resBody := readErrorBody(res.Body)
+		if res.StatusCode == http.StatusUnsupportedMediaType && req.Header.Get("Content-Encoding") != "" {
+			return "", errEncodingRejected
+		}
+		if res.StatusCode == http.StatusUnprocessableEntity {
+			return "", parseChecksumError(resBody)
+		}
+		return "", &PlayerError{StatusCode: res.StatusCode, Method: method, Url: url, Body: string(resBody)}
+	}
+
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(resBody), nil
+}
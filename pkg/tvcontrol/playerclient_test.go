@@ -0,0 +1,72 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPlayerErrorKeepsBodyAndReusesConnection(t *testing.T) {
+	var connections atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("disk full " + strings.Repeat("x", 2*maxErrorBody)))
+	}))
+	server.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			connections.Add(1)
+		}
+	}
+	server.Start()
+	defer server.Close()
+	task := &TaskWorker{Id: "client", Task: &TvTask{Url: server.URL}}
+	for i := 0; i < 5; i++ {
+		_, err := task.sendRequest(requestConfig, configUrl, "{}", configMethod, nil)
+		var playerError *PlayerError
+		if !errors.As(err, &playerError) {
+			t.Fatalf("error status must give PlayerError, got %v", err)
+		}
+		if playerError.StatusCode != http.StatusInternalServerError || !strings.HasPrefix(playerError.Body, "disk full") || len(playerError.Body) != maxErrorBody {
+			t.Fatalf("the start of the answer must be kept, got %d %d", playerError.StatusCode, len(playerError.Body))
+		}
+	}
+	if n := connections.Load(); n != 1 {
+		t.Errorf("drained answers must keep the connection alive, got %d connections", n)
+	}
+}
+
+func TestStatusRequestDeadline(t *testing.T) {
+	defer SetPropertyForTest("TVSERVER_STATUS_TIMEOUT", "1")()
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	task := &TaskWorker{Id: "client", Task: &TvTask{Url: server.URL}}
+	started := time.Now()
+	_, err := task.sendRequest(requestStatus, "status", "", "GET", nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("hung player must hit the deadline, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 3*time.Second {
+		t.Errorf("status deadline must stop the request in about a second, took %v", elapsed)
+	}
+	if getRequestTimeout(requestUpload) != defaultUploadTimeout*time.Second {
+		t.Error("uploads must keep their own deadline")
+	}
+}
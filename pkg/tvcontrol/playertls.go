@@ -0,0 +1,94 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+)
+
+// the scheme of the tv pc urls without one, TVSERVER_PLAYER_SCHEME=https sends everything over tls
+const defaultPlayerScheme = "http"
+
+// the pin of a tvpc record is the sha-256 of the public key of the player certificate
+const pinPrefix = "sha256/"
+
+func getPlayerScheme() string {
+	scheme := strings.ToLower(readProperty("TVSERVER_PLAYER_SCHEME", defaultPlayerScheme))
+	if scheme != "https" {
+		return defaultPlayerScheme
+	}
+	return scheme
+}
+
+// GetCertificatePin returns the pin of the certificate for the pin field of a tvpc record
+func GetCertificatePin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return pinPrefix + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// errNoPlayerTrust rejects an https player when nothing is configured to trust its certificate
+var errNoPlayerTrust = errors.New("https player needs TVSERVER_TLS_CA, a pin in its tvpc or TVSERVER_TLS_SYSTEM_CA=true")
+
+// newPlayerTlsConfig trusts only the ca bundle of TVSERVER_TLS_CA when it is set and presents
+// the client certificate of TVSERVER_TLS_CERT and TVSERVER_TLS_KEY to the players that ask for it;
+// a pinned player must also have a certificate of that ca, without the ca it may have
+// a self-signed one, its public key must match the pin;
+// the system store is trusted only with TVSERVER_TLS_SYSTEM_CA=true
+func newPlayerTlsConfig(settings transportSettings, pin string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if settings.caFile == "" && pin == "" && !settings.systemCa {
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			return errNoPlayerTrust
+		}
+	}
+	if settings.caFile != "" {
+		data, err := os.ReadFile(settings.caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificate in " + settings.caFile)
+		}
+		config.RootCAs = pool
+	}
+	if settings.certFile != "" || settings.keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.certFile, settings.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if pin != "" {
+		if !strings.HasPrefix(pin, pinPrefix) {
+			return nil, errors.New("pin " + pin + " must start with " + pinPrefix)
+		}
+		roots := config.RootCAs
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 || GetCertificatePin(state.PeerCertificates[0]) != pin {
+				return errors.New("certificate of " + state.ServerName + " does not match pin " + pin)
+			}
+			if roots == nil {
+				return nil
+			}
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{DNSName: state.ServerName, Roots: roots, Intermediates: intermediates})
+			return err
+		}
+	}
+	return config, nil
+}
@@ -0,0 +1,123 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeClientCertificate makes a self-signed client certificate and returns it with its files
+func writeClientCertificate(t *testing.T, folder string) (*x509.Certificate, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "tvengine"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour), IsCA: true, BasicConstraintsValid: true,
+		KeyUsage: x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile := filepath.Join(folder, "client.pem")
+	keyFile := filepath.Join(folder, "client-key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return cert, certFile, keyFile
+}
+
+func TestMutualTlsAndPinning(t *testing.T) {
+	folder := t.TempDir()
+	clientCert, certFile, keyFile := writeClientCertificate(t, folder)
+	clientPool := x509.NewCertPool()
+	clientPool.AddCert(clientCert)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"UP"}`))
+	}))
+	server.TLS = &tls.Config{ClientCAs: clientPool, ClientAuth: tls.RequireAndVerifyClientCert}
+	server.StartTLS()
+	defer server.Close()
+	caFile := filepath.Join(folder, "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600)
+	task := &TaskWorker{Id: "tls", Task: &TvTask{Url: server.URL}}
+	status := func() error {
+		_, err := task.sendRequest(requestStatus, "status", "", "GET", nil)
+		return err
+	}
+
+	if err := status(); err == nil || !strings.Contains(err.Error(), errNoPlayerTrust.Error()) {
+		t.Errorf("https player without ca or pin must be rejected, got %v", err)
+	}
+	restoreSystem := SetPropertyForTest("TVSERVER_TLS_SYSTEM_CA", "true")
+	if err := status(); err == nil || strings.Contains(err.Error(), errNoPlayerTrust.Error()) {
+		t.Errorf("player certificate unknown to the system store must be rejected, got %v", err)
+	}
+	restoreSystem()
+	restoreCa := SetPropertyForTest("TVSERVER_TLS_CA", caFile)
+	if status() == nil {
+		t.Error("player requiring a client certificate must reject the server without it")
+	}
+	defer SetPropertyForTest("TVSERVER_TLS_CERT", certFile)()
+	defer SetPropertyForTest("TVSERVER_TLS_KEY", keyFile)()
+	if err := status(); err != nil {
+		t.Errorf("trusted player with client certificate must answer, got %v", err)
+	}
+
+	task.Task.Pin = GetCertificatePin(server.Certificate())
+	if err := status(); err != nil {
+		t.Errorf("pinned player of the ca must be trusted, got %v", err)
+	}
+	otherCaFile := filepath.Join(folder, "other-ca.pem")
+	os.WriteFile(otherCaFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Raw}), 0600)
+	restoreOtherCa := SetPropertyForTest("TVSERVER_TLS_CA", otherCaFile)
+	if status() == nil {
+		t.Error("pinned player must be rejected when its certificate is not of the ca")
+	}
+	restoreOtherCa()
+
+	restoreCa()
+	if err := status(); err != nil {
+		t.Errorf("pinned player must be trusted without ca, got %v", err)
+	}
+	task.Task.Pin = GetCertificatePin(clientCert)
+	if status() == nil {
+		t.Error("player with another certificate than the pin must be rejected")
+	}
+}
+
+func TestPlayerScheme(t *testing.T) {
+	task := &TaskWorker{Task: &TvTask{Url: "10.0.0.5:8085"}}
+	if u := task.GetComputerUrl(); u != "http://10.0.0.5:8085/" {
+		t.Errorf("plain http must stay the default, got %s", u)
+	}
+	defer SetPropertyForTest("TVSERVER_PLAYER_SCHEME", "https")()
+	if u := task.GetComputerUrl(); u != "https://10.0.0.5:8085/" {
+		t.Errorf("configured scheme must be used, got %s", u)
+	}
+}
@@ -0,0 +1,336 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvaction"
+	"github.com/Dobryvechir/microcore/pkg/dvcontext"
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+	"github.com/Dobryvechir/microcore/pkg/dvtextutils"
+)
+
+// TaskModePull is the mode of a tvpc whose player polls the server, its worker sends nothing
+const TaskModePull = "pull"
+
+// the player calls {prefix}{id}/task, {prefix}{id}/file/{name}?offset= and {prefix}{id}/progress
+const pullApiPrefix = "/api/v1/player/"
+
+const (
+	pullTask     = "task"
+	pullFile     = "file"
+	pullProgress = "progress"
+	// the heartbeats come from the players in both modes
+	pullHeartbeat = "heartbeat"
+)
+
+// PullTask is the answer to GET task, Config is the config of the current presentation
+// while it is delivered and Key is the next key of the tvpc wrapped by the key which signed
+// the request, the player signs with it from now on
+type PullTask struct {
+	Id                  string      `json:"id"`
+	PresentationId      string      `json:"presentationId,omitempty"`
+	PresentationVersion string      `json:"presentationVersion,omitempty"`
+	Config              *TvConfig   `json:"config,omitempty"`
+	Phase               TaskPhase   `json:"phase"`
+	Paused              bool        `json:"paused,omitempty"`
+	TaskStatus          int         `json:"taskStatus"`
+	Key                 *WrappedKey `json:"key,omitempty"`
+}
+
+// PullProgress is the body of POST progress, Left is the map of left files the player
+// answers to a config in push mode
+type PullProgress struct {
+	PresentationId      string           `json:"presentationId"`
+	PresentationVersion string           `json:"presentationVersion"`
+	Left                map[string]int64 `json:"left"`
+}
+
+type PlayerPullConfig struct {
+	Kind string `json:"kind"`
+}
+
+// pullAnswer is written by the action as it is, without the result of the action definition
+type pullAnswer struct {
+	status      int
+	contentType string
+	headers     map[string][]string
+	body        []byte
+}
+
+// GetSignedPath returns the path with the query, both are covered by the signature of a pull request
+func GetSignedPath(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	return u.Path + "?" + u.RawQuery
+}
+
+func newPullError(status int, err error) *pullAnswer {
+	body, _ := json.Marshal(map[string]string{"error": err.Error()})
+	return &pullAnswer{status: status, contentType: "application/json", body: body}
+}
+
+func newPullJson(v interface{}) *pullAnswer {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return newPullError(http.StatusInternalServerError, err)
+	}
+	return &pullAnswer{status: http.StatusOK, contentType: "application/json", body: body}
+}
+
+func readPullTask(id string) (*TvTask, error) {
+	res, err := dvdbmanager.RecordReadOne(taskDbName, id)
+	if err != nil || res == nil {
+		return nil, errors.New("no task for tvpc " + id)
+	}
+	return rowToTask(res)
+}
+
+// authenticatePullRequest checks the signature by the key the player has, by the next key or
+// by the pairing key of a player without keys and returns the key which signed the request;
+// the first request signed by the next key makes it the key of the task; unsigned requests
+// are never taken, the first key comes with the registration or by the pairing token
+func authenticatePullRequest(t *TvTask, r *http.Request, body []byte) (*PlayerKey, error) {
+	var keys []*PlayerKey
+	if key := getTvpcKey(t.Id, t.KeyId); key != nil {
+		keys = append(keys, key)
+	}
+	if t.NextKeyId != t.KeyId {
+		if key := getTvpcKey(t.Id, t.NextKeyId); key != nil {
+			keys = append(keys, key)
+		}
+	}
+	pairing := getPairingKey(t.Id)
+	if pairing != nil {
+		keys = append(keys, pairing)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("tvpc " + t.Id + " has no key, its player gets one by the registration or by its pairing token")
+	}
+	header := r.Header.Get(SignatureHeader)
+	err := VerifySignature(keys, header, r.Method, GetSignedPath(r.URL), body, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	var by *PlayerKey
+	for _, key := range keys {
+		if strings.HasPrefix(header, key.Id+":") {
+			by = key
+			break
+		}
+	}
+	if t.NextKeyId != "" && t.NextKeyId != t.KeyId && by.Id == t.NextKeyId {
+		t.KeyId = t.NextKeyId
+		_, err = createOrUpdateTaskDatabaseForKeySending(t)
+		if err == nil && pairing != nil {
+			err = savePairingToken(t.Id, "")
+		}
+		if err == nil && logLevel() {
+			dvlog.PrintfFullOnly("Key %s is taken by %s", t.KeyId, t.Id)
+		}
+	}
+	return by, err
+}
+
+// ServePull answers the request of kind task, file or progress of a player in pull mode with
+// the same task record, leftFiles and taskStatus as the worker of a player in push mode keeps
+func ServePull(kind string, r *http.Request, body []byte) *pullAnswer {
+	params := strings.SplitN(strings.TrimPrefix(r.URL.Path, pullApiPrefix), "/", 3)
+	if len(params) < 2 || params[0] == "" || params[1] != kind {
+		return newPullError(http.StatusNotFound, errors.New("unknown request "+r.URL.Path))
+	}
+	t, err := readPullTask(params[0])
+	if err != nil {
+		return newPullError(http.StatusNotFound, err)
+	}
+	if t.Mode != TaskModePull && kind != pullHeartbeat {
+		return newPullError(http.StatusConflict, errors.New("tvpc "+t.Id+" is not in pull mode"))
+	}
+	var by *PlayerKey
+	// the heartbeats of a tvpc without key are taken unsigned as the server sends it its requests
+	if kind != pullHeartbeat || t.KeyId != "" {
+		by, err = authenticatePullRequest(t, r, body)
+		if err != nil {
+			return newPullError(http.StatusUnauthorized, err)
+		}
+	}
+	switch {
+	case kind == pullTask && len(params) == 2:
+		return servePullTask(t, by)
+	case kind == pullFile && len(params) == 3:
+		return servePullFile(t, r, params[2])
+	case kind == pullProgress && len(params) == 2:
+		return servePullProgress(t, body)
+	case kind == pullHeartbeat && len(params) == 2:
+		return servePullHeartbeat(t, r, body)
+	}
+	return newPullError(http.StatusNotFound, errors.New("unknown request "+r.URL.Path))
+}
+
+// servePullTask answers the task with the next key wrapped by the key by, which signed the request
+func servePullTask(t *TvTask, by *PlayerKey) *pullAnswer {
+	res := &PullTask{Id: t.Id, Phase: t.Phase, Paused: t.Paused, TaskStatus: t.TaskStatus}
+	// a paused, cancelled or failed task gives no config, so the player waits
+	if t.NewPresentationId != "" && t.NewPresentationVersion != "" && !t.Paused && (t.isSending() || t.Phase == PhaseDone) {
+		res.PresentationId = t.NewPresentationId
+		res.PresentationVersion = t.NewPresentationVersion
+		res.Config = t.Config
+	}
+	if t.NextKeyId != "" && t.NextKeyId != t.KeyId {
+		if key := getTvpcKey(t.Id, t.NextKeyId); key != nil {
+			wrapped, err := WrapKey(key, by)
+			if err != nil {
+				return newPullError(http.StatusInternalServerError, err)
+			}
+			res.Key = wrapped
+		}
+	}
+	// the request of the player is its connection check
+	if t.connectionSucceeded() || t.LastError != "" {
+		t.LastError = ""
+		_, err := createOrUpdateTaskDatabaseForConnectionStatus(t)
+		if err != nil {
+			return newPullError(http.StatusInternalServerError, err)
+		}
+	}
+	return newPullJson(res)
+}
+
+// servePullFile gives the part of the file from offset, not longer than length or the largest chunk
+func servePullFile(t *TvTask, r *http.Request, name string) *pullAnswer {
+	if t.Config == nil || dvtextutils.FindIndexInStringArray(t.Config.File, name) < 0 {
+		return newPullError(http.StatusNotFound, errors.New("file "+name+" is not in the config of tvpc "+t.Id))
+	}
+	if t.Paused || !t.isSending() && t.Phase != PhaseDone {
+		state := string(t.Phase)
+		if t.Paused {
+			state = "paused"
+		}
+		return newPullError(http.StatusServiceUnavailable, errors.New("task of tvpc "+t.Id+" is "+state))
+	}
+	query := r.URL.Query()
+	offset, err := strconv.Atoi(query.Get("offset"))
+	if err != nil || offset < 0 {
+		return newPullError(http.StatusBadRequest, errors.New("offset must be a non-negative number"))
+	}
+	_, length := GetChunkSizeLimits()
+	if s := query.Get("length"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return newPullError(http.StatusBadRequest, errors.New("length must be a positive number"))
+		}
+		length = min(n, length)
+	}
+	total := getFullSeek(name)
+	if offset >= total {
+		return newPullError(http.StatusRequestedRangeNotSatisfiable, errors.New("offset "+strconv.Itoa(offset)+" is beyond "+name))
+	}
+	if !IsFileSendingAllowed(t.GroupId) {
+		return newPullError(http.StatusServiceUnavailable, errors.New("files are not sent outside the delivery window"))
+	}
+	_, realName, err := detectRealFileName(t, name)
+	if err != nil {
+		return newPullError(http.StatusNotFound, err)
+	}
+	amount := min(length, total-offset)
+	waitForBandwidth(r.Context(), t.GroupId, amount)
+	data, err := readFileWithSeek(realName, offset, amount)
+	if err != nil {
+		return newPullError(http.StatusInternalServerError, err)
+	}
+	headers := map[string][]string{ChunkDigestHeader: {CalculateChunkDigest(data)}}
+	return &pullAnswer{status: http.StatusOK, contentType: "application/octet-stream", headers: headers, body: data}
+}
+
+// servePullProgress saves the left files of the player as the answer to the config in push mode
+func servePullProgress(t *TvTask, body []byte) *pullAnswer {
+	progress := &PullProgress{}
+	err := json.Unmarshal(body, progress)
+	if err != nil {
+		return newPullError(http.StatusBadRequest, err)
+	}
+	if progress.PresentationId != t.NewPresentationId || progress.PresentationVersion != t.NewPresentationVersion {
+		return newPullError(http.StatusConflict, errors.New("task of tvpc "+t.Id+" has presentation "+t.NewPresentationId+" version "+t.NewPresentationVersion))
+	}
+	left, err := json.Marshal(progress.Left)
+	if err != nil {
+		return newPullError(http.StatusBadRequest, err)
+	}
+	err = analyzeComputerConfigSendingResponse(string(left), t)
+	if err != nil {
+		return newPullError(http.StatusBadRequest, err)
+	}
+	configSent := t.Phase == PhasePending || t.Phase == PhaseSendingConfig
+	err = calculateTaskStatus(t)
+	if err != nil {
+		return newPullError(http.StatusConflict, err)
+	}
+	t.connectionSucceeded()
+	t.LastError = ""
+	if configSent {
+		_, err = createOrUpdateTaskDatabaseForConfigSending(t)
+	} else {
+		_, err = createOrUpdateTaskDatabaseForFileSending(t)
+	}
+	if err != nil {
+		return newPullError(http.StatusInternalServerError, err)
+	}
+	message := strconv.Itoa(len(t.LeftFiles)) + " files left"
+	if configSent {
+		recordTaskEvent(t.Id, TaskEventConfig, t.Phase, "presentation "+t.NewPresentationId+" version "+t.NewPresentationVersion+" pulled, "+message)
+	} else {
+		recordTaskEvent(t.Id, TaskEventChunk, t.Phase, "pulled to "+strconv.Itoa(t.Progress)+", "+message)
+	}
+	if logLevel() {
+		dvlog.PrintfFullOnly("Pull progress of %s is %d in phase %s, left %v", t.Id, t.Progress, t.Phase, t.LeftFiles)
+	}
+	return newPullJson(map[string]int{"taskStatus": t.TaskStatus})
+}
+
+func PlayerPullInit(command string, ctx *dvcontext.RequestContext) ([]interface{}, bool) {
+	config := &PlayerPullConfig{}
+	if !dvaction.DefaultInitWithObject(command, config, dvaction.GetEnvironment(ctx)) {
+		return nil, false
+	}
+	return []interface{}{config, ctx}, true
+}
+
+func PlayerPullRun(data []interface{}) bool {
+	if data[1] == nil {
+		return true
+	}
+	config := data[0].(*PlayerPullConfig)
+	ctx := data[1].(*dvcontext.RequestContext)
+	if ctx.Reader == nil {
+		return true
+	}
+	res := ServePull(config.Kind, ctx.Reader, []byte(ctx.PrimaryContextEnvironment.GetString(dvcontext.BODY_STRING)))
+	ctx.StatusCode = res.status
+	ctx.DataType = res.contentType
+	ctx.Output = res.body
+	if len(res.headers) != 0 {
+		if ctx.Headers == nil {
+			ctx.Headers = make(map[string][]string)
+		}
+		for k, v := range res.headers {
+			ctx.Headers[k] = v
+		}
+	}
+	return true
+}
+
+const (
+	CommandPlayerPull = "playerpull"
+)
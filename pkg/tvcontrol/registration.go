@@ -0,0 +1,325 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"sync"
+
+	"github.com/Dobryvechir/microcore/pkg/dvaction"
+	"github.com/Dobryvechir/microcore/pkg/dvcontext"
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+)
+
+// the status of a tvpc registered by its player, a tvpc without status is created by an admin
+const (
+	TvpcStatusPending  = "pending"
+	TvpcStatusApproved = "approved"
+)
+
+const pairingCodeDigits = 6
+
+// TvpcRegistration is sent by a player on its first boot and again until it gets its key;
+// RegistrationToken is given by the first answer and proves later that it is the same player
+type TvpcRegistration struct {
+	HardwareId        string   `json:"hardwareId"`
+	Name              string   `json:"name,omitempty"`
+	Url               string   `json:"url"`
+	Capabilities      []string `json:"capabilities,omitempty"`
+	RegistrationToken string   `json:"registrationToken,omitempty"`
+	// Mode is pull for a player which polls the server, it may have no url then
+	Mode string `json:"mode,omitempty"`
+}
+
+// TvpcRegistrationAnswer has the pairing code to show on the screen while the tvpc is pending
+// and the key of the tvpc after the approval
+type TvpcRegistrationAnswer struct {
+	Id                string `json:"id,omitempty"`
+	Status            string `json:"status,omitempty"`
+	PairingCode       string `json:"pairingCode,omitempty"`
+	RegistrationToken string `json:"registrationToken,omitempty"`
+	KeyId             string `json:"keyId,omitempty"`
+	Secret            string `json:"secret,omitempty"`
+	Error             string `json:"error,omitempty"`
+}
+
+// TvpcApproval is the body of the approval, the admin types the code shown on the screen
+type TvpcApproval struct {
+	PairingCode string `json:"pairingCode"`
+	Name        string `json:"name,omitempty"`
+}
+
+type TvpcRegisterConfig struct {
+	Result string `json:"result"`
+}
+
+type TvpcApproveConfig struct {
+	Result string `json:"result"`
+}
+
+// two first registrations of the same hardware must not create two tvpcs
+var registerMu sync.Mutex
+
+var tvpcConditionsForRegistration = []string{
+	"DEFAULT",
+}
+
+// the first registration creates the record
+var tvpcConditionsForNew = []string{
+	"NEW",
+}
+
+var tvpcFieldsForNew = []string{
+	"",
+}
+
+func TvpcRegisterInit(command string, ctx *dvcontext.RequestContext) ([]interface{}, bool) {
+	config := &TvpcRegisterConfig{}
+	if !dvaction.DefaultInitWithObject(command, config, dvaction.GetEnvironment(ctx)) {
+		return nil, false
+	}
+	return []interface{}{config, ctx}, true
+}
+
+func TvpcRegisterRun(data []interface{}) bool {
+	config := data[0].(*TvpcRegisterConfig)
+	var ctx *dvcontext.RequestContext = nil
+	if data[1] != nil {
+		ctx = data[1].(*dvcontext.RequestContext)
+	}
+	answer, err := tvpcRegisterRunByConfig(ctx)
+	if err != nil {
+		dvlog.PrintlnError(err.Error())
+		answer = &TvpcRegistrationAnswer{Error: err.Error()}
+	}
+	res, err := dvevaluation.AnyStructToDvVariable(answer)
+	if err != nil {
+		dvlog.PrintError(err)
+		return true
+	}
+	dvaction.SaveActionResult(config.Result, res, ctx)
+	return true
+}
+
+func tvpcRegisterRunByConfig(ctx *dvcontext.RequestContext) (*TvpcRegistrationAnswer, error) {
+	if ctx == nil {
+		return nil, errors.New("registration needs a request")
+	}
+	reg := &TvpcRegistration{}
+	err := json.Unmarshal([]byte(ctx.PrimaryContextEnvironment.GetString(dvcontext.BODY_STRING)), reg)
+	if err != nil {
+		return nil, err
+	}
+	return RegisterTvpc(reg, strconv.FormatInt(ctx.Id, 10))
+}
+
+// RegisterTvpc creates a pending tvpc with newId for an unknown hardware id; the same hardware
+// with its registration token updates its url and capabilities and gets its key once approved
+func RegisterTvpc(reg *TvpcRegistration, newId string) (*TvpcRegistrationAnswer, error) {
+	if reg.HardwareId == "" || reg.Url == "" && reg.Mode != TaskModePull {
+		return nil, errors.New("registration must have hardwareId and url")
+	}
+	registerMu.Lock()
+	defer registerMu.Unlock()
+	tvpc, err := findTvpcByHardwareId(reg.HardwareId)
+	if err != nil {
+		return nil, err
+	}
+	if tvpc == nil {
+		return createPendingTvpc(reg, newId)
+	}
+	id := tvpc.ReadSimpleChildValue("id")
+	token := getRegistrationToken(id)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(reg.RegistrationToken)) != 1 {
+		return nil, errors.New("hardware " + reg.HardwareId + " is registered already as tvpc " + id)
+	}
+	status := tvpc.ReadSimpleChildValue("status")
+	answer := &TvpcRegistrationAnswer{Id: id, Status: status}
+	update := map[string]interface{}{"id": id, "url": reg.Url, "capabilities": reg.Capabilities, "mode": reg.Mode}
+	fields := "^url,capabilities,mode"
+	if status == TvpcStatusPending {
+		answer.PairingCode = getPairingCode(id)
+	} else if key := getTvpcKey(id, tvpc.ReadSimpleChildValue("keyId")); key != nil {
+		// the task of the tvpc starts with the key the player has got here
+		answer.KeyId = key.Id
+		answer.Secret = key.Secret
+		update["deliveredKeyId"] = key.Id
+		fields += ",deliveredKeyId"
+	}
+	row, err := dvevaluation.AnyStructToDvVariable(update)
+	if err != nil {
+		return nil, err
+	}
+	_, err = updateRecordByConditions(tvpcDbName, row, tvpcConditionsForRegistration, []string{fields})
+	if err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
+
+func findTvpcByHardwareId(hardwareId string) (*dvevaluation.DvVariable, error) {
+	tvs, err := dvdbmanager.RecordReadAll(tvpcDbName)
+	if err != nil || tvs == nil {
+		return nil, err
+	}
+	for _, tv := range tvs.Fields {
+		if tv != nil && tv.ReadSimpleChildValue("hardwareId") == hardwareId {
+			return tv, nil
+		}
+	}
+	return nil, nil
+}
+
+func createPendingTvpc(reg *TvpcRegistration, id string) (*TvpcRegistrationAnswer, error) {
+	token, err := newRegistrationToken()
+	if err != nil {
+		return nil, err
+	}
+	code, err := newPairingCode()
+	if err != nil {
+		return nil, err
+	}
+	name := reg.Name
+	if name == "" {
+		name = "tv " + reg.HardwareId
+	}
+	row, err := dvevaluation.AnyStructToDvVariable(map[string]interface{}{"id": id, "name": name, "url": reg.Url, "hardwareId": reg.HardwareId,
+		"capabilities": reg.Capabilities, "status": TvpcStatusPending, "mode": reg.Mode})
+	if err != nil {
+		return nil, err
+	}
+	err = saveRegistrationSecrets(id, token, code)
+	if err != nil {
+		return nil, err
+	}
+	_, err = updateRecordByConditions(tvpcDbName, row, tvpcConditionsForNew, tvpcFieldsForNew)
+	if err != nil {
+		return nil, err
+	}
+	dvlog.PrintfFullOnly("Tvpc %s of hardware %s at %s waits for approval with code %s", id, reg.HardwareId, reg.Url, code)
+	return &TvpcRegistrationAnswer{Id: id, Status: TvpcStatusPending, PairingCode: code, RegistrationToken: token}, nil
+}
+
+func newRegistrationToken() (string, error) {
+	token := make([]byte, 16)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+func newPairingCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	code := strconv.FormatInt(n.Int64(), 10)
+	for len(code) < pairingCodeDigits {
+		code = "0" + code
+	}
+	return code, nil
+}
+
+func TvpcApproveInit(command string, ctx *dvcontext.RequestContext) ([]interface{}, bool) {
+	config := &TvpcApproveConfig{}
+	if !dvaction.DefaultInitWithObject(command, config, dvaction.GetEnvironment(ctx)) {
+		return nil, false
+	}
+	return []interface{}{config, ctx}, true
+}
+
+func TvpcApproveRun(data []interface{}) bool {
+	config := data[0].(*TvpcApproveConfig)
+	var ctx *dvcontext.RequestContext = nil
+	if data[1] != nil {
+		ctx = data[1].(*dvcontext.RequestContext)
+	}
+	err := tvpcApproveRunByConfig(config, ctx)
+	if err != nil {
+		mes := err.Error()
+		dvlog.PrintlnError(mes)
+		resError := &dvevaluation.DvVariable{Kind: dvevaluation.FIELD_STRING, Name: []byte("error"), Value: []byte(mes)}
+		res := &dvevaluation.DvVariable{Kind: dvevaluation.FIELD_OBJECT, Fields: []*dvevaluation.DvVariable{resError}}
+		dvaction.SaveActionResult(config.Result, res, ctx)
+	}
+	return true
+}
+
+// tvpcApproveRunByConfig serves POST /api/v1/tvpc/{id}/approve
+func tvpcApproveRunByConfig(config *TvpcApproveConfig, ctx *dvcontext.RequestContext) error {
+	id, err := getApiPathId(ctx, tvpcDbName, "approve")
+	if err != nil {
+		return err
+	}
+	approval := &TvpcApproval{}
+	err = json.Unmarshal([]byte(ctx.PrimaryContextEnvironment.GetString(dvcontext.BODY_STRING)), approval)
+	if err != nil {
+		return err
+	}
+	res, err := ApproveTvpc(id, approval)
+	if err != nil {
+		return err
+	}
+	dvaction.SaveActionResult(config.Result, res, ctx)
+	return nil
+}
+
+// ApproveTvpc makes the pending tvpc a member of the default group and issues its key,
+// which the player gets with its next registration
+func ApproveTvpc(id string, approval *TvpcApproval) (*dvevaluation.DvVariable, error) {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+	tvpc, err := dvdbmanager.RecordReadOne(tvpcDbName, id)
+	if err != nil || tvpc == nil {
+		return nil, errors.New("tvpc " + id + " does not exist")
+	}
+	if tvpc.ReadSimpleChildValue("status") != TvpcStatusPending {
+		return nil, errors.New("tvpc " + id + " is not waiting for approval")
+	}
+	code := getPairingCode(id)
+	if code == "" || subtle.ConstantTimeCompare([]byte(code), []byte(approval.PairingCode)) != 1 {
+		return nil, errors.New("wrong pairing code for tvpc " + id)
+	}
+	update := map[string]string{"id": id, "status": TvpcStatusApproved}
+	fields := "^status,pairingCode"
+	if approval.Name != "" {
+		update["name"] = approval.Name
+		fields += ",name"
+	}
+	row, err := dvevaluation.AnyStructToDvVariable(update)
+	if err != nil {
+		return nil, err
+	}
+	_, err = updateRecordByConditions(tvpcDbName, row, tvpcConditionsForRegistration, []string{fields})
+	if err != nil {
+		return nil, err
+	}
+	err = removePairingCode(id)
+	if err != nil {
+		return nil, err
+	}
+	dvlog.PrintfFullOnly("Tvpc %s is approved", id)
+	return IssueTvpcKey(id, getNextKeyId(tvpc.ReadSimpleChildValue("keyId")))
+}
+
+// isTvpcActive tells whether the tvpc may get presentations, a pending one waits for approval
+func isTvpcActive(tv *dvevaluation.DvVariable) bool {
+	return tv.ReadSimpleChildValue("status") != TvpcStatusPending
+}
+
+const (
+	CommandTvpcRegister = "tvpcregister"
+	CommandTvpcApprove  = "tvpcapprove"
+)
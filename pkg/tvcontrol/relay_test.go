@@ -0,0 +1,95 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol_test
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+	"github.com/VDobryvechir/tvengine/pkg/tvrelay"
+)
+
+func TestRelayFansOutUpstreamConfig(t *testing.T) {
+	players := make([]*stubPlayer, 2)
+	tvpcIds := make([]string, len(players))
+	for i := range players {
+		players[i] = createStubPlayer(t)
+		tvpc := record{}
+		callApi(t, "POST", "tvpc", map[string]string{"name": "site" + string(rune('A'+i)), "url": players[i].Url}, &tvpc)
+		tvpcIds[i] = tvpc.str("id")
+	}
+	defer callApi(t, "DELETE", "tvpc/"+strings.Join(tvpcIds, ","), nil, nil)
+	relay, err := tvrelay.NewRelay(htmlPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(relay.Player)
+	defer server.Close()
+
+	// the central server sends the config and the file to the relay as to a single player
+	data := make([]byte, 5000)
+	rand.New(rand.NewSource(7)).Read(data)
+	hash := tvcontrol.CalculateChunkDigest(data)
+	name := "i" + hash[:32] + "-" + strconv.Itoa(len(data)) + ".png"
+	config := &tvcontrol.TvConfig{File: []string{name}, Duration: []int{15}, Hash: []string{hash}}
+	body, _ := json.Marshal(config)
+	res, err := http.Post(server.URL+"/config", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	res, err = http.Post(server.URL+"/upload/0_0_"+strconv.Itoa(len(data)), "application/octet-stream", strings.NewReader(string(data)))
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatalf("upload to relay failed %v %v", res, err)
+	}
+	res.Body.Close()
+
+	version := tvcontrol.GetRelayConfigVersion(config)
+	tasks := waitForDelivery(t, record{"id": tvcontrol.RelayPresentationId}, tvpcIds)
+	for i, player := range players {
+		if tasks[tvpcIds[i]].str("oldPresentationVersion") != version || !reflect.DeepEqual(player.Config(), config) {
+			t.Errorf("site player %d received %v", i, player.Config())
+		}
+		received, err := os.ReadFile(player.MediaPath(name))
+		if err != nil || string(received) != string(data) {
+			t.Errorf("site player %d has wrong %s: %v", i, name, err)
+		}
+	}
+
+	status := struct {
+		Relay *tvcontrol.RelayProgress `json:"relay"`
+	}{}
+	eventually(t, 10*time.Second, "relay status does not report the delivered tv pcs", func() bool {
+		res, err := http.Get(server.URL + "/status")
+		if err != nil {
+			return false
+		}
+		defer res.Body.Close()
+		return json.NewDecoder(res.Body).Decode(&status) == nil && status.Relay != nil &&
+			status.Relay.Version == version && status.Relay.Done == len(players) && status.Relay.TaskStatus == 1000
+	})
+
+	relay.Upstream = serverUrl
+	relay.Url = "http://10.9.9.9:8086/"
+	relay.Name = "site relay"
+	id, err := relay.Register()
+	if err != nil || id == "" {
+		t.Fatalf("relay was not registered upstream: %v", err)
+	}
+	defer callApi(t, "DELETE", "tvpc/"+id, nil, nil)
+	if again, err := relay.Register(); err != nil || again != id {
+		t.Errorf("relay must be registered once, got %s %v", again, err)
+	}
+}
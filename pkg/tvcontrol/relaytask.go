@@ -0,0 +1,109 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+)
+
+const tvpcDbName = "tvpc"
+
+// RelayPresentationId is the presentation of the tasks of a relay, they show the config
+// received from the central server, the version is taken from the config itself;
+// both are numbers like the ids of the presentation table, the task conditions need it
+const RelayPresentationId = "0"
+
+// RelayProgress is the delivery state of the local tv pcs of a relay, it is added to
+// the status answer of the relay as the relay field
+type RelayProgress struct {
+	Version    string `json:"version"`
+	Tvpcs      int    `json:"tvpcs"`
+	Done       int    `json:"done"`
+	TaskStatus int    `json:"taskStatus"`
+}
+
+// GetRelayConfigVersion gives the same version to the same files and durations
+func GetRelayConfigVersion(config *TvConfig) string {
+	data, _ := json.Marshal(&TvConfig{File: config.File, Duration: config.Duration})
+	n, _ := strconv.ParseInt(CalculateChunkDigest(data)[:12], 16, 64)
+	return strconv.FormatInt(n+1, 10)
+}
+
+// DistributeRelayConfig creates the tasks of all local tv pcs for the config received from
+// the central server; realFiles are the received files under HTML_PATH in the order of config.File
+func DistributeRelayConfig(config *TvConfig, realFiles []string) error {
+	if config == nil || len(config.File) == 0 || len(config.File) != len(realFiles) {
+		return errors.New("relay config must have a received file for every file")
+	}
+	tvs, err := dvdbmanager.RecordReadAll(tvpcDbName)
+	if err != nil {
+		return err
+	}
+	if tvs == nil || len(tvs.Fields) == 0 {
+		return errors.New("there is no local tv pc for the relay")
+	}
+	local := &TvConfig{File: config.File, Duration: config.Duration, Hash: config.Hash}
+	version := GetRelayConfigVersion(config)
+	sample := &TvTask{NewPresentationId: RelayPresentationId, NewPresentationName: "relay " + version, NewPresentationVersion: version, Config: local, RealFiles: realFiles, GroupId: defaultGroupId}
+	tasks, err := createTvTasks(sample, tvs.Fields)
+	if err != nil {
+		return err
+	}
+	_, err = createOrUpdateTaskDatabaseForWeb(tasks)
+	if err != nil {
+		return err
+	}
+	if logLevel() {
+		dvlog.PrintfFullOnly("Relay config %s is sent to %d tv pcs", version, len(tasks))
+	}
+	return wakeUpMainWorker()
+}
+
+// GetRelayProgress aggregates the tasks of the local tv pcs for the relay config version,
+// taskStatus is the average of their task statuses
+func GetRelayProgress(version string) (*RelayProgress, error) {
+	res, err := dvdbmanager.RecordReadAll(taskDbName)
+	if err != nil {
+		return nil, err
+	}
+	progress := &RelayProgress{Version: version}
+	if res == nil {
+		return progress, nil
+	}
+	sum := 0
+	for _, v := range res.Fields {
+		t, err := rowToTask(v)
+		if err != nil || t.NewPresentationId != RelayPresentationId {
+			continue
+		}
+		progress.Tvpcs++
+		if t.NewPresentationVersion != version {
+			continue
+		}
+		sum += t.Progress
+		if t.Phase == PhaseDone && t.OldPresentationVersion == version {
+			progress.Done++
+		}
+	}
+	if progress.Tvpcs > 0 {
+		progress.TaskStatus = sum / progress.Tvpcs
+	}
+	return progress, nil
+}
+
+// parseStatusRelay reads the progress of the local tv pcs from the status answer of a relay
+func parseStatusRelay(body string) *RelayProgress {
+	status := &playerStatus{}
+	if json.Unmarshal([]byte(body), status) != nil {
+		return nil
+	}
+	return status.Relay
+}
@@ -0,0 +1,370 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvaction"
+	"github.com/Dobryvechir/microcore/pkg/dvcontext"
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+)
+
+// the configs delivered to a tv pc are kept in its own record of the folder table confighistory
+const configHistoryDbName = "confighistory"
+
+// default number of the delivered configs kept for every tv pc
+const defaultConfigHistory = 5
+
+// DeliveredConfig is a presentation whose files a tv pc has received, the config has no peers,
+// they are given again by the rollback
+type DeliveredConfig struct {
+	PresentationId      string    `json:"presentationId"`
+	PresentationName    string    `json:"presentationName"`
+	PresentationVersion string    `json:"presentationVersion"`
+	GroupId             string    `json:"groupId"`
+	Config              *TvConfig `json:"config"`
+	RealFiles           []string  `json:"realFiles"`
+	Time                int64     `json:"time"`
+}
+
+// configHistory has the delivered configs of the tv pc from the oldest to the newest
+type configHistory struct {
+	Id      string             `json:"id"`
+	Configs []*DeliveredConfig `json:"configs"`
+}
+
+type RollbackConfig struct {
+	Result string `json:"result"`
+}
+
+var configHistoryMu sync.Mutex
+
+// a rolled back task starts without failures and mismatches as a retried one,
+// otherwise it is saved as a new presentation
+var taskFieldsForRollback = []string{
+	"",
+	taskFieldsForWeb[1],
+	"oldPresentationId,oldPresentationName,oldPresentationVersion,contacted,chunkSize,keyId",
+}
+
+var configHistoryConditions = []string{
+	"NEW",
+	"DEFAULT",
+}
+
+var configHistoryFields = []string{
+	"",
+	"",
+}
+
+func readConfigHistory(id string) (*configHistory, error) {
+	res, err := dvdbmanager.RecordReadOne(configHistoryDbName, id)
+	if err != nil {
+		return nil, err
+	}
+	history := &configHistory{Id: id}
+	if res != nil {
+		err = res.DvVariableToAnyStruct(history)
+	}
+	return history, err
+}
+
+func saveConfigHistory(history *configHistory) error {
+	row, err := dvevaluation.AnyStructToDvVariable(history)
+	if err != nil {
+		return err
+	}
+	_, err = dvdbmanager.CreateOrUpdateByConditionsAndUpdateFields(configHistoryDbName, row, configHistoryConditions, configHistoryFields)
+	return err
+}
+
+func (c *DeliveredConfig) isPresentationOf(t *TvTask) bool {
+	return c.PresentationId == t.NewPresentationId && c.PresentationVersion == t.NewPresentationVersion
+}
+
+// AddDeliveredConfig keeps the config of the task as the newest of the last TVSERVER_CONFIG_HISTORY
+// configs of its tv pc, a presentation delivered again is kept once, 0 keeps nothing
+func AddDeliveredConfig(t *TvTask, now time.Time) error {
+	limit := readIntProperty("TVSERVER_CONFIG_HISTORY", defaultConfigHistory)
+	if limit <= 0 || t.Id == "" || t.Config == nil || t.NewPresentationId == "" || t.NewPresentationVersion == "" {
+		return nil
+	}
+	config := *t.Config
+	config.Peer = nil
+	delivered := &DeliveredConfig{PresentationId: t.NewPresentationId, PresentationName: t.NewPresentationName, PresentationVersion: t.NewPresentationVersion,
+		GroupId: t.GroupId, Config: &config, RealFiles: t.RealFiles, Time: now.Unix()}
+	configHistoryMu.Lock()
+	defer configHistoryMu.Unlock()
+	history, err := readConfigHistory(t.Id)
+	if err != nil {
+		return err
+	}
+	configs := make([]*DeliveredConfig, 0, len(history.Configs)+1)
+	for _, c := range history.Configs {
+		if !c.isPresentationOf(t) {
+			configs = append(configs, c)
+		}
+	}
+	configs = append(configs, delivered)
+	history.Configs = configs[max(len(configs)-limit, 0):]
+	return saveConfigHistory(history)
+}
+
+// keepDeliveredConfig keeps the delivered config, a failure to keep it does not stop the task
+func keepDeliveredConfig(t *TvTask) {
+	err := AddDeliveredConfig(t, time.Now())
+	if err != nil {
+		dvlog.PrintError(err)
+	}
+}
+
+// getPreviousConfig returns the index of the newest config which is not the presentation of the task
+func (history *configHistory) getPreviousConfig(t *TvTask) int {
+	for i := len(history.Configs) - 1; i >= 0; i-- {
+		if !history.Configs[i].isPresentationOf(t) {
+			return i
+		}
+	}
+	return -1
+}
+
+// rollbackTasks gives every task the previous config of its tv pc, the configs newer than it are
+// dropped, so the next rollback goes further back; tasks without a previous config are skipped
+func rollbackTasks(tasks []*TvTask) ([]*TvTask, error) {
+	configHistoryMu.Lock()
+	defer configHistoryMu.Unlock()
+	histories := make([]*configHistory, 0, len(tasks))
+	kept := make([][]*DeliveredConfig, 0, len(tasks))
+	rolled := make([]*TvTask, 0, len(tasks))
+	for _, t := range tasks {
+		history, err := readConfigHistory(t.Id)
+		if err != nil {
+			return nil, err
+		}
+		n := history.getPreviousConfig(t)
+		if n < 0 {
+			dvlog.PrintfFullOnly("Task %s has no config before presentation %s version %s", t.Id, t.NewPresentationId, t.NewPresentationVersion)
+			continue
+		}
+		previous := history.Configs[n]
+		r := *t
+		// as retry, the config is sent again to learn the left files from the player
+		phase := PhaseSendingConfig
+		if !CanChangePhase(r.Phase, phase) {
+			phase = PhasePending
+		}
+		err = r.setPhase(phase)
+		if err != nil {
+			return nil, err
+		}
+		kept = append(kept, history.Configs)
+		history.Configs = history.Configs[:n+1]
+		histories = append(histories, history)
+		config := *previous.Config
+		r.NewPresentationId = previous.PresentationId
+		r.NewPresentationName = previous.PresentationName
+		r.NewPresentationVersion = previous.PresentationVersion
+		r.GroupId = previous.GroupId
+		r.Config = &config
+		r.RealFiles = previous.RealFiles
+		r.LeftFiles = make([]string, 0, 16)
+		r.Progress = 0
+		r.Failures = 0
+		r.Mismatches = 0
+		r.Paused = false
+		r.LastError = ""
+		rolled = append(rolled, &r)
+	}
+	if len(rolled) == 0 {
+		return nil, errors.New("no previous config to roll back to")
+	}
+	// the histories are cut before the tasks are saved and given back if the tasks are not saved,
+	// so a rolled back task always finds its config in the history
+	for i, history := range histories {
+		err := saveConfigHistory(history)
+		if err != nil {
+			restoreConfigHistories(histories[:i], kept)
+			return nil, err
+		}
+	}
+	// the player still has the files of the previous config, it answers no left files to it
+	assignPeerSeeds(rolled)
+	rows, err := createOrUpdateTaskDatabaseForRollback(rolled)
+	if err != nil {
+		restoreConfigHistories(histories, kept)
+		return nil, err
+	}
+	res := make([]*TvTask, 0, len(rows))
+	for _, row := range rows {
+		if row == nil {
+			continue
+		}
+		t, err := rowToTask(row)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, t)
+	}
+	for _, t := range rolled {
+		recordTaskEvent(t.Id, TaskEventControl, t.Phase, "rollback to presentation "+t.NewPresentationId+" version "+t.NewPresentationVersion)
+	}
+	dvlog.PrintfFullOnly("%d tasks are rolled back", len(rolled))
+	return res, wakeUpMainWorker()
+}
+
+func createOrUpdateTaskDatabaseForRollback(tasks []*TvTask) ([]*dvevaluation.DvVariable, error) {
+	res := make([]*dvevaluation.DvVariable, len(tasks))
+	for i, t := range tasks {
+		recordPresentationChange(t)
+		row, err := createOrUpdateTaskDatabase(t, taskConditionsForWeb, taskFieldsForRollback)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = row
+	}
+	return res, nil
+}
+
+// restoreConfigHistories gives the histories their configs before the rollback
+func restoreConfigHistories(histories []*configHistory, configs [][]*DeliveredConfig) {
+	for i, history := range histories {
+		history.Configs = configs[i]
+		err := saveConfigHistory(history)
+		if err != nil {
+			dvlog.PrintError(err)
+		}
+	}
+}
+
+// RollbackTvpc sends the previous config again to the tv pc
+func RollbackTvpc(id string) (*TvTask, error) {
+	t, err := readPullTask(id)
+	if err != nil {
+		return nil, err
+	}
+	res, err := rollbackTasks([]*TvTask{t})
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		return nil, errors.New("task " + id + " is not saved")
+	}
+	return res[0], nil
+}
+
+// getGroupTvpcIds returns the ids of the tv pcs of the group as the control of a presentation
+// finds them, the tvpc list of the group record or all tv pcs for the default group
+func getGroupTvpcIds(groupId string) ([]string, error) {
+	var ids []string
+	if groupId == defaultGroupId {
+		tvs, err := dvdbmanager.RecordReadAll(tvpcDbName)
+		if err != nil {
+			return nil, err
+		}
+		if tvs != nil {
+			for _, tv := range tvs.Fields {
+				if tv != nil {
+					ids = append(ids, tv.ReadSimpleChildValue("id"))
+				}
+			}
+		}
+		return ids, nil
+	}
+	group, err := dvdbmanager.RecordReadOne(groupDbName, groupId)
+	if err != nil || group == nil {
+		return nil, errors.New("group " + groupId + " does not exist")
+	}
+	if tvpc, ok := group.FindChildByKey("tvpc"); ok && tvpc != nil {
+		for _, id := range tvpc.Fields {
+			if id != nil {
+				ids = append(ids, string(id.Value))
+			}
+		}
+	}
+	return ids, nil
+}
+
+// RollbackGroup sends the previous config again to the tv pcs of the group
+func RollbackGroup(groupId string) ([]*TvTask, error) {
+	ids, err := getGroupTvpcIds(groupId)
+	if err != nil {
+		return nil, err
+	}
+	var tasks []*TvTask
+	for _, id := range ids {
+		if t, err := readPullTask(id); err == nil {
+			tasks = append(tasks, t)
+		}
+	}
+	if len(tasks) == 0 {
+		return nil, errors.New("group " + groupId + " has no tasks")
+	}
+	return rollbackTasks(tasks)
+}
+
+func RollbackInit(command string, ctx *dvcontext.RequestContext) ([]interface{}, bool) {
+	config := &RollbackConfig{}
+	if !dvaction.DefaultInitWithObject(command, config, dvaction.GetEnvironment(ctx)) {
+		return nil, false
+	}
+	return []interface{}{config, ctx}, true
+}
+
+func saveRollbackResult(config *RollbackConfig, ctx *dvcontext.RequestContext, result interface{}, err error) {
+	var res *dvevaluation.DvVariable
+	if err == nil {
+		res, err = dvevaluation.AnyStructToDvVariable(result)
+	}
+	if err != nil {
+		mes := err.Error()
+		dvlog.PrintlnError(mes)
+		resError := &dvevaluation.DvVariable{Kind: dvevaluation.FIELD_STRING, Name: []byte("error"), Value: []byte(mes)}
+		res = &dvevaluation.DvVariable{Kind: dvevaluation.FIELD_OBJECT, Fields: []*dvevaluation.DvVariable{resError}}
+	}
+	dvaction.SaveActionResult(config.Result, res, ctx)
+}
+
+// TvpcRollbackRun serves POST /api/v1/tvpc/{id}/rollback
+func TvpcRollbackRun(data []interface{}) bool {
+	config := data[0].(*RollbackConfig)
+	var ctx *dvcontext.RequestContext = nil
+	if data[1] != nil {
+		ctx = data[1].(*dvcontext.RequestContext)
+	}
+	var t *TvTask
+	id, err := getApiPathId(ctx, tvpcDbName, "rollback")
+	if err == nil {
+		t, err = RollbackTvpc(id)
+	}
+	saveRollbackResult(config, ctx, t, err)
+	return true
+}
+
+// GroupRollbackRun serves POST /api/v1/group/{id}/rollback
+func GroupRollbackRun(data []interface{}) bool {
+	config := data[0].(*RollbackConfig)
+	var ctx *dvcontext.RequestContext = nil
+	if data[1] != nil {
+		ctx = data[1].(*dvcontext.RequestContext)
+	}
+	var tasks []*TvTask
+	id, err := getApiPathId(ctx, groupDbName, "rollback")
+	if err == nil {
+		tasks, err = RollbackGroup(id)
+	}
+	saveRollbackResult(config, ctx, tasks, err)
+	return true
+}
+
+const (
+	CommandTvpcRollback  = "tvpcrollback"
+	CommandGroupRollback = "grouprollback"
+)
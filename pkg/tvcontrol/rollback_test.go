@@ -0,0 +1,96 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+)
+
+func deliveredTask(id string, presentation string, version string) *TvTask {
+	return &TvTask{Id: id, Name: "rollback", NewPresentationId: presentation, NewPresentationName: "p" + presentation, NewPresentationVersion: version,
+		OldPresentationId: presentation, OldPresentationVersion: version, Phase: PhaseDone, Progress: 1000, GroupId: "7",
+		Config:    &TvConfig{File: []string{"i" + presentation + version + "-100.png"}, Duration: []int{5}, Peer: []string{"http://peer"}},
+		RealFiles: []string{"/" + presentation + ".png"}}
+}
+
+func TestDeliveredConfigsAreLimited(t *testing.T) {
+	defer SetPropertyForTest("TVSERVER_CONFIG_HISTORY", "2")()
+	defer dvdbmanager.RecordDelete(configHistoryDbName, "9601")
+	now := time.Now()
+	for _, v := range [][2]string{{"1", "1"}, {"2", "1"}, {"1", "1"}, {"3", "2"}} {
+		if err := AddDeliveredConfig(deliveredTask("9601", v[0], v[1]), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	history, err := readConfigHistory("9601")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history.Configs) != 2 || history.Configs[0].PresentationId != "1" || history.Configs[1].PresentationId != "3" {
+		t.Fatalf("the last 2 presentations must be kept once, got %+v", history.Configs)
+	}
+	if history.Configs[1].Config.Peer != nil || history.Configs[1].RealFiles[0] != "/3.png" {
+		t.Errorf("config must be kept without peers: %+v", history.Configs[1])
+	}
+}
+
+func TestRollbackTvpcGoesBackStepByStep(t *testing.T) {
+	defer dvdbmanager.RecordDelete(configHistoryDbName, "9602")
+	defer dvdbmanager.RecordDelete(taskEventDbName, "9602")
+	now := time.Now()
+	for _, presentation := range []string{"1", "2", "3"} {
+		if err := AddDeliveredConfig(deliveredTask("9602", presentation, "4"), now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := deliveredTask("9602", "3", "4")
+	current.Failures, current.Mismatches = 2, 1
+	if _, err := createOrUpdateTaskDatabase(current, []string{"NEW"}, []string{""}); err != nil {
+		t.Fatal(err)
+	}
+	defer dvdbmanager.RecordDelete(taskDbName, "9602")
+
+	task, err := RollbackTvpc("9602")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.NewPresentationId != "2" || task.Phase != PhaseSendingConfig || task.OldPresentationId != "3" || task.Config.File[0] != "i24-100.png" || task.RealFiles[0] != "/2.png" {
+		t.Fatalf("task must get the previous config: %+v", task)
+	}
+	if task.Failures != 0 || task.Mismatches != 0 {
+		t.Errorf("rolled back task must start without failures as retry: %+v", task)
+	}
+	if saved := readTask(t, "9602"); saved.NewPresentationId != "2" || saved.Name != "rollback" {
+		t.Fatalf("rolled back task must be saved: %+v", saved)
+	}
+	history, _ := readConfigHistory("9602")
+	if len(history.Configs) != 2 || history.Configs[1].PresentationId != "2" {
+		t.Fatalf("configs newer than the rolled back one must be dropped, got %+v", history.Configs)
+	}
+
+	// the group of the last presentation is not the group of the tv pc
+	dvdbmanager.RecordCreate(groupDbName, `{"name":"rollback","tvpc":[]}`, "7")
+	defer dvdbmanager.RecordDelete(groupDbName, "7")
+	if _, err = RollbackGroup("7"); err == nil {
+		t.Error("rollback of a group without tv pcs must fail")
+	}
+	dvdbmanager.RecordCreate(groupDbName, `{"name":"members","tvpc":["9602"]}`, "9603")
+	defer dvdbmanager.RecordDelete(groupDbName, "9603")
+	// the rolled back presentation is not delivered yet, so the next one goes further back
+	tasks, err := RollbackGroup("9603")
+	if err != nil || len(tasks) != 1 || tasks[0].NewPresentationId != "1" {
+		t.Fatalf("group must be rolled back to the first presentation: %v %+v", err, tasks)
+	}
+	if _, err = RollbackTvpc("9602"); err == nil {
+		t.Error("rollback without a previous config must fail")
+	}
+	if _, err = RollbackGroup("8"); err == nil {
+		t.Error("rollback of a missing group must fail")
+	}
+}
@@ -0,0 +1,126 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+	"github.com/Dobryvechir/microcore/pkg/dvparser"
+)
+
+const settingsPrefix = "TVSERVER_"
+
+// the TVSERVER_ properties are taken from the global properties of the server at startup
+// and only from propertyOverrides after ReloadSettings, so they can be changed without a restart
+// and a property removed from the file gets its default
+var propertyOverrides map[string]string
+var settingsReloaded bool
+var propertyOverridesMu sync.RWMutex
+
+var debugLog atomic.Bool
+
+func init() {
+	debugLog.Store(true)
+}
+
+// logLevel tells whether the workers log every step, TVSERVER_LOG_LEVEL=DEBUG
+func logLevel() bool {
+	return debugLog.Load()
+}
+
+func readProperty(name string, defValue string) string {
+	propertyOverridesMu.RLock()
+	value, ok := propertyOverrides[name]
+	reloaded := settingsReloaded && strings.HasPrefix(name, settingsPrefix)
+	propertyOverridesMu.RUnlock()
+	if ok || reloaded {
+		if value == "" {
+			return defValue
+		}
+		return value
+	}
+	return dvparser.GetByGlobalPropertiesOrDefault(name, defValue)
+}
+
+func readIntProperty(name string, defValue int) int {
+	s := readProperty(name, "")
+	if s == "" {
+		return defValue
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		dvlog.PrintlnError("Incorrect " + name + "=" + s + ", default " + strconv.Itoa(defValue) + " is used")
+		return defValue
+	}
+	return n
+}
+
+// ApplySettings takes the settings which are kept outside the properties, now the log level
+func ApplySettings() {
+	level := strings.ToUpper(strings.TrimSpace(readProperty("TVSERVER_LOG_LEVEL", "DEBUG")))
+	debugLog.Store(level == "DEBUG" || level == "TRACE")
+}
+
+// readSettingsFile reads the plain TVSERVER_ lines of the properties file
+func readSettingsFile(fileName string) (map[string]string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, settingsPrefix) {
+			continue
+		}
+		p := strings.Index(line, "=")
+		if p < 0 {
+			continue
+		}
+		res[strings.TrimSpace(line[:p])] = strings.TrimSpace(line[p+1:])
+	}
+	return res, scanner.Err()
+}
+
+func getPropertiesFileName() string {
+	name := dvparser.MicroCorePropertiesInCurrentFolderFileName
+	if _, err := os.Stat(name); err != nil {
+		name = os.Getenv(dvparser.MicroCorePrexix + dvparser.MicroCorePathSuffix)
+	}
+	return name
+}
+
+// ReloadSettings reads the TVSERVER_ properties again from fileName, by default from the
+// properties file of the server; the next step of every worker uses the new values, the
+// properties not in the file are unset
+func ReloadSettings(fileName string) error {
+	if fileName == "" {
+		fileName = getPropertiesFileName()
+	}
+	if fileName == "" {
+		return errors.New("no properties file to reload the settings from")
+	}
+	settings, err := readSettingsFile(fileName)
+	if err != nil {
+		return err
+	}
+	propertyOverridesMu.Lock()
+	propertyOverrides = settings
+	settingsReloaded = true
+	propertyOverridesMu.Unlock()
+	ApplySettings()
+	dvlog.PrintfFullOnly("Reloaded %d settings from %s", len(settings), fileName)
+	return nil
+}
@@ -0,0 +1,76 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvparser"
+)
+
+func TestReloadSettings(t *testing.T) {
+	defer func() {
+		propertyOverridesMu.Lock()
+		propertyOverrides = nil
+		settingsReloaded = false
+		propertyOverridesMu.Unlock()
+		ApplySettings()
+	}()
+	if timeout := getRequestTimeout(requestUpload); timeout != defaultUploadTimeout*time.Second {
+		t.Fatalf("timeout must have the default, got %v", timeout)
+	}
+	// the startup value of a property which is not in the reloaded file must be dropped
+	dvparser.SetGlobalPropertiesValue("TVSERVER_TEST_REMOVED", "9")
+	fileName := filepath.Join(t.TempDir(), "tvserver.properties")
+	props := "# comment\nTVSERVER_UPLOAD_TIMEOUT=7\nTVSERVER_LOG_LEVEL=INFO\nTVSERVER_BACKOFF_MAX=\nLISTEN_PORT=1\n"
+	if err := os.WriteFile(fileName, []byte(props), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReloadSettings(fileName); err != nil {
+		t.Fatal(err)
+	}
+	if timeout := getRequestTimeout(requestUpload); timeout != 7*time.Second {
+		t.Errorf("reloaded timeout must be used, got %v", timeout)
+	}
+	if logLevel() {
+		t.Error("log level INFO must turn the debug log off")
+	}
+	if GetBackoffMax() != defaultBackoffMax {
+		t.Errorf("empty property must keep the default, got %d", GetBackoffMax())
+	}
+	if n := readIntProperty("TVSERVER_TEST_REMOVED", 3); n != 3 {
+		t.Errorf("property removed from the file must get its default, got %d", n)
+	}
+	if readProperty("LISTEN_PORT", "") == "1" {
+		t.Error("only TVSERVER_ properties are reloaded")
+	}
+	if err := ReloadSettings(filepath.Join(t.TempDir(), "missing.properties")); err == nil {
+		t.Error("missing file must fail")
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	defer SetPropertyForTest("TVSERVER_ERROR_DELAY", "30")()
+	defer SetPropertyForTest("TVSERVER_BACKOFF_MAX", "600")()
+	expected := []time.Duration{30, 30, 60, 120, 240, 480, 600, 600}
+	for status, seconds := range expected {
+		if limit := getBackoffLimit(status); limit != seconds*time.Second {
+			t.Errorf("connection status %d must wait %ds, got %v", status, seconds, limit)
+		}
+	}
+	if limit := getBackoffLimit(1000); limit != 600*time.Second {
+		t.Errorf("long offline must wait the maximum, got %v", limit)
+	}
+	for i := 0; i < 100; i++ {
+		delay := GetBackoffDelay(3)
+		if delay < 96*time.Second || delay > 144*time.Second {
+			t.Fatalf("jitter must stay within 20%%, got %v", delay)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SignatureHeader carries {keyId}:{unix seconds}:{hex hmac-sha256} of the request, the hmac is
+// taken with the secret of the tvpc over the method, the path with the offset of an upload,
+// the time and the sha-256 of the body as it is sent
+const SignatureHeader = "X-Tv-Signature"
+
+// a signed request older or newer than this is rejected, so it cannot be replayed later
+const signatureMaxSkew = 5 * time.Minute
+
+var ErrSignatureMissing = errors.New("request is not signed")
+
+// PairingKeyId is the id of the key made of the pairing token of a player without keys,
+// the server signs and wraps the first key by it once the admin gives it the token
+const PairingKeyId = "pairing"
+
+// the hex digits of a pairing token
+const pairingTokenLength = 32
+
+// the salt and the info of the hkdf deriving the aes key which wraps a key by another one
+const (
+	keyWrapSalt = "tvengine key wrap"
+	keyWrapInfo = "aes-256-gcm"
+)
+
+// PlayerKey is the secret shared by tvengine and one tv pc, the player keeps the previous key
+// as well, so that the requests signed before the rotation are still accepted
+type PlayerKey struct {
+	Id     string `json:"id"`
+	Secret string `json:"secret"`
+}
+
+// NewPlayerKey makes a random secret with the given id
+func NewPlayerKey(id string) (*PlayerKey, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &PlayerKey{Id: id, Secret: hex.EncodeToString(secret)}, nil
+}
+
+// NewPairingToken makes the random token a player without keys shows for its pairing
+func NewPairingToken() (string, error) {
+	token := make([]byte, pairingTokenLength/2)
+	_, err := rand.Read(token)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
+
+// isPairingToken checks the token given by the admin has the form of NewPairingToken
+func isPairingToken(token string) bool {
+	_, err := hex.DecodeString(token)
+	return err == nil && len(token) == pairingTokenLength
+}
+
+// getNextKeyId returns the id after the id of the current key
+func getNextKeyId(id string) string {
+	n, _ := strconv.Atoi(id)
+	return strconv.Itoa(n + 1)
+}
+
+func calculateSignature(secret string, method string, path string, timestamp string, body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n" + hex.EncodeToString(digest[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest returns the value of SignatureHeader for the request
+func SignRequest(key *PlayerKey, method string, path string, body []byte, now time.Time) string {
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	return key.Id + ":" + timestamp + ":" + calculateSignature(key.Secret, method, path, timestamp, body)
+}
+
+// VerifySignature checks the value of SignatureHeader by the key with its id among keys
+func VerifySignature(keys []*PlayerKey, header string, method string, path string, body []byte, now time.Time) error {
+	if header == "" {
+		return ErrSignatureMissing
+	}
+	parts := strings.Split(header, ":")
+	if len(parts) != 3 {
+		return errors.New("signature must be in format {keyId}:{time}:{hmac}")
+	}
+	seconds, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errors.New("incorrect time of signature " + parts[1])
+	}
+	skew := now.Sub(time.Unix(seconds, 0))
+	if skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		return errors.New("signature time differs by " + skew.String())
+	}
+	for _, key := range keys {
+		if key == nil || key.Id != parts[0] {
+			continue
+		}
+		expected := calculateSignature(key.Secret, method, path, parts[1], body)
+		if !hmac.Equal([]byte(expected), []byte(parts[2])) {
+			return errors.New("wrong signature of key " + key.Id)
+		}
+		return nil
+	}
+	return errors.New("unknown key " + parts[0])
+}
+
+// WrappedKey is a key sealed by the key By for its delivery, so the secret is never sent in clear
+type WrappedKey struct {
+	Id     string `json:"id"`
+	By     string `json:"by"`
+	Sealed string `json:"sealed"`
+}
+
+// newKeyCipher makes aes-256-gcm keyed by the hkdf-sha256 of the secret
+func newKeyCipher(secret string) (cipher.AEAD, error) {
+	extract := hmac.New(sha256.New, []byte(keyWrapSalt))
+	extract.Write([]byte(secret))
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write([]byte(keyWrapInfo))
+	expand.Write([]byte{1})
+	block, err := aes.NewCipher(expand.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// WrapKey seals the secret of key by the key by, both ids are authenticated with it
+func WrapKey(key *PlayerKey, by *PlayerKey) (*WrappedKey, error) {
+	aead, err := newKeyCipher(by.Secret)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(key.Secret), []byte(key.Id+":"+by.Id))
+	return &WrappedKey{Id: key.Id, By: by.Id, Sealed: base64.StdEncoding.EncodeToString(sealed)}, nil
+}
+
+// UnwrapKey opens the wrapped key by the key with its id among keys
+func UnwrapKey(wrapped *WrappedKey, keys []*PlayerKey) (*PlayerKey, error) {
+	for _, by := range keys {
+		if by == nil || by.Id != wrapped.By {
+			continue
+		}
+		aead, err := newKeyCipher(by.Secret)
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := base64.StdEncoding.DecodeString(wrapped.Sealed)
+		if err != nil || len(sealed) < aead.NonceSize() {
+			return nil, errors.New("incorrect sealed key " + wrapped.Id)
+		}
+		secret, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(wrapped.Id+":"+by.Id))
+		if err != nil || len(secret) == 0 {
+			return nil, errors.New("key " + wrapped.Id + " is not sealed by key " + by.Id)
+		}
+		return &PlayerKey{Id: wrapped.Id, Secret: string(secret)}, nil
+	}
+	return nil, errors.New("unknown key " + wrapped.By)
+}
@@ -0,0 +1,199 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"context"
+	"errors"
+
+	"github.com/Dobryvechir/microcore/pkg/dvaction"
+	"github.com/Dobryvechir/microcore/pkg/dvcontext"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+)
+
+// the controls of a task by POST /api/v1/task/{id}/{control}
+const (
+	TaskControlPause  = "pause"
+	TaskControlResume = "resume"
+	TaskControlCancel = "cancel"
+	TaskControlRetry  = "retry"
+)
+
+// the control is saved only for the same presentation, a new presentation is a new delivery
+var taskFieldsForControl = []string{
+	"^phase,paused,leftFiles,progress,taskStatus,failures,mismatches,contacted,connectionStatus,lastError",
+}
+
+type TaskControlConfig struct {
+	Result string `json:"result"`
+}
+
+// taskControlRequest is applied by the running worker between its steps, so its saves keep the control
+type taskControlRequest struct {
+	control string
+	task    *TvTask
+	err     error
+	done    chan struct{}
+}
+
+// applyControl changes the task by the control: a paused task only watches its player until
+// it is resumed, a cancelled one until it is retried, and a retried task sends its config again
+// to learn the left files from the player
+func (t *TvTask) applyControl(control string) error {
+	switch control {
+	case TaskControlPause:
+		if !t.isSending() {
+			return errors.New("task " + t.Id + " in phase " + string(t.Phase) + " cannot be paused")
+		}
+		t.Paused = true
+	case TaskControlResume:
+		t.Paused = false
+	case TaskControlCancel:
+		err := t.setPhase(PhaseCancelled)
+		if err != nil {
+			return err
+		}
+		t.Paused = false
+	case TaskControlRetry:
+		phase := PhaseSendingConfig
+		if !CanChangePhase(t.Phase, phase) {
+			phase = PhasePending
+		}
+		err := t.setPhase(phase)
+		if err != nil {
+			return err
+		}
+		t.Paused = false
+		t.LeftFiles = nil
+		t.Progress = 0
+		t.Failures = 0
+		t.Mismatches = 0
+		t.LastError = ""
+	default:
+		return errors.New("unknown control " + control)
+	}
+	return nil
+}
+
+func createOrUpdateTaskDatabaseForControl(task *TvTask) (*TvTask, error) {
+	rowTask, err := taskToRow(task)
+	if err != nil {
+		return nil, err
+	}
+	res, err := updateRecordByConditions(taskDbName, rowTask, []string{getCoincidenceInTask(task)}, taskFieldsForControl)
+	if err != nil || res == nil {
+		return nil, err
+	}
+	return rowToTask(res)
+}
+
+// controlTask saves a copy of the task changed by the control
+func controlTask(t *TvTask, control string) (*TvTask, error) {
+	if t.NewPresentationId == "" || t.NewPresentationVersion == "" {
+		return nil, errors.New("task " + t.Id + " has no presentation")
+	}
+	copied := *t
+	t = &copied
+	err := t.applyControl(control)
+	if err != nil {
+		return nil, err
+	}
+	res, err := createOrUpdateTaskDatabaseForControl(t)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil || res.NewPresentationId != t.NewPresentationId || res.NewPresentationVersion != t.NewPresentationVersion {
+		return nil, errors.New("task " + t.Id + " has got another presentation")
+	}
+	recordTaskEvent(t.Id, TaskEventControl, res.Phase, control)
+	dvlog.PrintfFullOnly("Task %s got %s, it is %s paused %v", t.Id, control, res.Phase, res.Paused)
+	return res, nil
+}
+
+// applyControl is called by the worker between its steps
+func (task *TaskWorker) applyControl(control string) (*TvTask, error) {
+	t, err := controlTask(task.Task, control)
+	if err == nil {
+		task.Task = t
+	}
+	return t, err
+}
+
+// ControlTask passes the control to the running worker of the task and waits until it is applied,
+// a task without worker is changed at once
+func ControlTask(ctx context.Context, id string, control string) (*TvTask, error) {
+	if worker := mainSupervisor.Worker(id); worker != nil {
+		req := &taskControlRequest{control: control, done: make(chan struct{})}
+		select {
+		case worker.control <- req:
+			select {
+			case <-req.done:
+				return req.task, req.err
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		case <-worker.Done():
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	t, err := readPullTask(id)
+	if err != nil {
+		return nil, err
+	}
+	return controlTask(t, control)
+}
+
+func taskControlInit(control string) func(command string, ctx *dvcontext.RequestContext) ([]interface{}, bool) {
+	return func(command string, ctx *dvcontext.RequestContext) ([]interface{}, bool) {
+		config := &TaskControlConfig{}
+		if !dvaction.DefaultInitWithObject(command, config, dvaction.GetEnvironment(ctx)) {
+			return nil, false
+		}
+		return []interface{}{config, ctx, control}, true
+	}
+}
+
+func TaskControlRun(data []interface{}) bool {
+	config := data[0].(*TaskControlConfig)
+	var ctx *dvcontext.RequestContext = nil
+	if data[1] != nil {
+		ctx = data[1].(*dvcontext.RequestContext)
+	}
+	control := data[2].(string)
+	var res *dvevaluation.DvVariable
+	id, err := getTaskPathId(ctx, control)
+	if err == nil {
+		var t *TvTask
+		t, err = ControlTask(ctx.Reader.Context(), id, control)
+		if err == nil {
+			res, err = dvevaluation.AnyStructToDvVariable(t)
+		}
+	}
+	if err != nil {
+		mes := err.Error()
+		dvlog.PrintlnError(mes)
+		resError := &dvevaluation.DvVariable{Kind: dvevaluation.FIELD_STRING, Name: []byte("error"), Value: []byte(mes)}
+		res = &dvevaluation.DvVariable{Kind: dvevaluation.FIELD_OBJECT, Fields: []*dvevaluation.DvVariable{resError}}
+	}
+	dvaction.SaveActionResult(config.Result, res, ctx)
+	return true
+}
+
+var (
+	TaskPauseInit  = taskControlInit(TaskControlPause)
+	TaskResumeInit = taskControlInit(TaskControlResume)
+	TaskCancelInit = taskControlInit(TaskControlCancel)
+	TaskRetryInit  = taskControlInit(TaskControlRetry)
+)
+
+const (
+	CommandTaskPause  = "taskpause"
+	CommandTaskResume = "taskresume"
+	CommandTaskCancel = "taskcancel"
+	CommandTaskRetry  = "taskretry"
+)
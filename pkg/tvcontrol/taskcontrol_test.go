@@ -0,0 +1,120 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+)
+
+func TestTaskControlTransitions(t *testing.T) {
+	task := &TvTask{Id: "9501", Phase: PhaseSendingFiles, LeftFiles: []string{"a-100.png:50"}, Progress: 500, Failures: 2}
+	if err := task.applyControl(TaskControlPause); err != nil || !task.Paused {
+		t.Fatalf("sending task must be paused: %v %v", err, task.Paused)
+	}
+	if err := task.applyControl(TaskControlResume); err != nil || task.Paused || task.Phase != PhaseSendingFiles {
+		t.Fatalf("resumed task must continue its phase: %v %v %s", err, task.Paused, task.Phase)
+	}
+	if err := task.applyControl(TaskControlRetry); err != nil || task.Phase != PhaseSendingConfig || task.LeftFiles != nil || task.Progress != 0 || task.Failures != 0 {
+		t.Fatalf("retried task must send its config again: %v %+v", err, task)
+	}
+	if err := task.applyControl(TaskControlCancel); err != nil || task.Phase != PhaseCancelled {
+		t.Fatalf("sending task must be cancelled: %v %s", err, task.Phase)
+	}
+	if err := task.applyControl(TaskControlPause); err == nil {
+		t.Error("cancelled task must not be paused")
+	}
+	if err := task.applyControl(TaskControlRetry); err != nil || task.Phase != PhasePending {
+		t.Errorf("cancelled task must be retried from pending: %v %s", err, task.Phase)
+	}
+	task.Phase = PhaseDone
+	if err := task.applyControl(TaskControlCancel); err == nil {
+		t.Error("done task must not be cancelled")
+	}
+	if err := task.applyControl("stop"); err == nil {
+		t.Error("unknown control must fail")
+	}
+}
+
+// watchedPlayer answers every request as up and counts the uploads
+type watchedPlayer struct {
+	mu      sync.Mutex
+	uploads int
+}
+
+func (p *watchedPlayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, "/upload/") {
+		p.mu.Lock()
+		p.uploads++
+		p.mu.Unlock()
+	}
+	w.Write([]byte(`{"status":"UP"}`))
+}
+
+func TestControlTaskByWorkerAndDirectly(t *testing.T) {
+	player := &watchedPlayer{}
+	server := httptest.NewServer(player)
+	defer server.Close()
+	task := &TvTask{Id: "9502", Name: "controlled", Url: server.URL, NewPresentationId: "1", NewPresentationVersion: "2",
+		OldPresentationId: "1", OldPresentationVersion: "2", Phase: PhaseSendingFiles, Paused: true,
+		LeftFiles: []string{"a-100.png"}, RealFiles: []string{"/a.png"}, Progress: 300}
+	row, err := createOrUpdateTaskDatabase(task, []string{"NEW"}, []string{""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dvdbmanager.RecordDelete(taskDbName, "9502")
+	defer dvdbmanager.RecordDelete(taskEventDbName, "9502")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mainSupervisor.StartOrWakeUp(ctx, "9502", row)
+	worker := mainSupervisor.Worker("9502")
+	if worker == nil {
+		t.Fatal("worker is not created")
+	}
+
+	res, err := ControlTask(ctx, "9502", TaskControlCancel)
+	if err != nil || res.Phase != PhaseCancelled || res.Paused {
+		t.Fatalf("worker must cancel the task: %v %+v", err, res)
+	}
+	if saved := readTask(t, "9502"); saved.Phase != PhaseCancelled || saved.Name != "controlled" || saved.Url != server.URL {
+		t.Fatalf("cancelled task must be saved: %s %q %q", saved.Phase, saved.Name, saved.Url)
+	}
+	mainSupervisor.Stop("9502")
+	waitForDone(t, worker)
+	player.mu.Lock()
+	uploads := player.uploads
+	player.mu.Unlock()
+	if uploads != 0 {
+		t.Errorf("paused and cancelled task must upload nothing, got %d uploads", uploads)
+	}
+
+	if _, err = ControlTask(ctx, "9502", TaskControlPause); err == nil {
+		t.Error("cancelled task must not be paused")
+	}
+	res, err = ControlTask(ctx, "9502", TaskControlRetry)
+	if err != nil || res.Phase != PhasePending || res.Progress != 0 || len(res.LeftFiles) != 0 {
+		t.Fatalf("task without worker must be retried at once: %v %+v", err, res)
+	}
+	page, err := GetTaskEvents("9502", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var controls []string
+	for _, event := range page.Events {
+		if event.Kind == TaskEventControl {
+			controls = append(controls, event.Message)
+		}
+	}
+	if strings.Join(controls, ",") != "cancel,retry" {
+		t.Errorf("applied controls must be in the events, got %v", controls)
+	}
+}
@@ -0,0 +1,309 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvaction"
+	"github.com/Dobryvechir/microcore/pkg/dvcontext"
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+)
+
+// the events of a task are kept in its own record of the folder table taskevent,
+// so an event rewrites the file of one task only
+const taskEventDbName = "taskevent"
+
+// default retention of the events of a task and the default page of GET events
+const (
+	defaultTaskEventsMax  = 1000
+	defaultTaskEventsDays = 30
+	defaultTaskEventsPage = 100
+	maxTaskEventsPage     = 1000
+)
+
+// the kinds of the task events
+const (
+	TaskEventStart   = "start"
+	TaskEventPhase   = "phase"
+	TaskEventConfig  = "config"
+	TaskEventChunk   = "chunk"
+	TaskEventFile    = "file"
+	TaskEventError   = "error"
+	TaskEventWakeUp  = "wakeup"
+	TaskEventControl = "control"
+	TaskEventStop    = "stop"
+)
+
+// TaskEvent is a step of a task, Seq grows by one with every event of the task
+type TaskEvent struct {
+	Seq     int64     `json:"seq"`
+	Time    int64     `json:"time"`
+	Kind    string    `json:"kind"`
+	Phase   TaskPhase `json:"phase,omitempty"`
+	Message string    `json:"message,omitempty"`
+}
+
+// TaskEventPage is the answer of GET events, Next is the after of the next page if More is true
+type TaskEventPage struct {
+	Id     string       `json:"id"`
+	Events []*TaskEvent `json:"events"`
+	Next   int64        `json:"next"`
+	More   bool         `json:"more"`
+}
+
+type taskEventLog struct {
+	Id     string       `json:"id"`
+	Seq    int64        `json:"seq"`
+	Events []*TaskEvent `json:"events"`
+}
+
+type TaskEventsConfig struct {
+	Result string `json:"result"`
+}
+
+// taskEventMu guards taskEventLocks, the lock of a task guards the record of its events
+var taskEventMu sync.Mutex
+var taskEventLocks = make(map[string]*sync.Mutex)
+
+var taskEventConditions = []string{
+	"NEW",
+	"DEFAULT",
+}
+
+var taskEventFields = []string{
+	"",
+	"",
+}
+
+// lockTaskEvents locks the events of the task and returns the unlock
+func lockTaskEvents(id string) func() {
+	taskEventMu.Lock()
+	mu := taskEventLocks[id]
+	if mu == nil {
+		mu = &sync.Mutex{}
+		taskEventLocks[id] = mu
+	}
+	taskEventMu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+func readTaskEventLog(id string) (*taskEventLog, error) {
+	res, err := dvdbmanager.RecordReadOne(taskEventDbName, id)
+	if err != nil {
+		return nil, err
+	}
+	log := &taskEventLog{Id: id}
+	if res != nil {
+		err = res.DvVariableToAnyStruct(log)
+	}
+	return log, err
+}
+
+func saveTaskEventLog(log *taskEventLog) error {
+	row, err := dvevaluation.AnyStructToDvVariable(log)
+	if err != nil {
+		return err
+	}
+	_, err = dvdbmanager.CreateOrUpdateByConditionsAndUpdateFields(taskEventDbName, row, taskEventConditions, taskEventFields)
+	return err
+}
+
+// trimTaskEvents drops the events older than TVSERVER_TASK_EVENTS_DAYS days
+// and the oldest above TVSERVER_TASK_EVENTS_MAX events, 0 keeps them
+func trimTaskEvents(events []*TaskEvent, now time.Time) []*TaskEvent {
+	if days := readIntProperty("TVSERVER_TASK_EVENTS_DAYS", defaultTaskEventsDays); days > 0 {
+		oldest := now.Add(-time.Duration(days) * 24 * time.Hour).Unix()
+		n := 0
+		for n < len(events) && events[n].Time < oldest {
+			n++
+		}
+		events = events[n:]
+	}
+	if limit := readIntProperty("TVSERVER_TASK_EVENTS_MAX", defaultTaskEventsMax); limit > 0 && len(events) > limit {
+		events = events[len(events)-limit:]
+	}
+	return events
+}
+
+// AddTaskEvent appends the event to the events of the task, the events are never changed
+// but dropped by their retention
+func AddTaskEvent(id string, kind string, phase TaskPhase, message string, now time.Time) error {
+	return AddTaskEvents(id, now, &TaskEvent{Kind: kind, Phase: phase, Message: message})
+}
+
+// AddTaskEvents appends the events to the events of the task by one write of its record,
+// their Seq and Time are given here
+func AddTaskEvents(id string, now time.Time, events ...*TaskEvent) error {
+	if id == "" {
+		return errors.New("no task for events")
+	}
+	if len(events) == 0 {
+		return nil
+	}
+	defer lockTaskEvents(id)()
+	log, err := readTaskEventLog(id)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		log.Seq++
+		event.Seq, event.Time = log.Seq, now.Unix()
+		log.Events = append(log.Events, event)
+	}
+	log.Events = trimTaskEvents(log.Events, now)
+	return saveTaskEventLog(log)
+}
+
+// recordTaskEvent keeps the event of the task, a failure to keep it does not stop the task
+func recordTaskEvent(id string, kind string, phase TaskPhase, message string) {
+	err := AddTaskEvent(id, kind, phase, message, time.Now())
+	if err != nil {
+		dvlog.PrintError(err)
+	}
+}
+
+// recordTaskEvents keeps the events of the task together, a failure to keep them does not stop the task
+func recordTaskEvents(id string, events []*TaskEvent) {
+	err := AddTaskEvents(id, time.Now(), events...)
+	if err != nil {
+		dvlog.PrintError(err)
+	}
+}
+
+// GetTaskEvents returns up to limit events of the task after the event with seq after
+func GetTaskEvents(id string, after int64, limit int) (*TaskEventPage, error) {
+	unlock := lockTaskEvents(id)
+	log, err := readTaskEventLog(id)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = defaultTaskEventsPage
+	}
+	limit = min(limit, maxTaskEventsPage)
+	page := &TaskEventPage{Id: id, Events: make([]*TaskEvent, 0, limit), Next: after}
+	for _, event := range trimTaskEvents(log.Events, time.Now()) {
+		if event.Seq <= after {
+			continue
+		}
+		if len(page.Events) == limit {
+			page.More = true
+			break
+		}
+		page.Events = append(page.Events, event)
+		page.Next = event.Seq
+	}
+	return page, nil
+}
+
+// pruneTaskEvents applies the retention to the events of all tasks, also of the deleted ones
+func pruneTaskEvents(now time.Time) error {
+	res, err := dvdbmanager.RecordReadAll(taskEventDbName)
+	if err != nil || res == nil {
+		return err
+	}
+	for _, record := range res.Fields {
+		if record == nil {
+			continue
+		}
+		if id := record.ReadSimpleChildValue("id"); id != "" {
+			if err = pruneTaskEventLog(id, now); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneTaskEventLog applies the retention to the events of the task read again under its lock,
+// the record stays even without events to keep its Seq going on
+func pruneTaskEventLog(id string, now time.Time) error {
+	defer lockTaskEvents(id)()
+	log, err := readTaskEventLog(id)
+	if err != nil {
+		return err
+	}
+	events := trimTaskEvents(log.Events, now)
+	if len(events) == len(log.Events) {
+		return nil
+	}
+	log.Events = events
+	return saveTaskEventLog(log)
+}
+
+// getTaskPathId takes the id of /api/v1/task/{id}/{name}
+func getTaskPathId(ctx *dvcontext.RequestContext, name string) (string, error) {
+	return getApiPathId(ctx, taskDbName, name)
+}
+
+// parseTaskEventsRequest takes the id of /api/v1/task/{id}/events and its after and limit parameters
+func parseTaskEventsRequest(ctx *dvcontext.RequestContext) (string, int64, int, error) {
+	id, err := getTaskPathId(ctx, "events")
+	if err != nil {
+		return "", 0, 0, err
+	}
+	query := ctx.Reader.URL.Query()
+	var after int64
+	var limit int
+	if s := query.Get("after"); s != "" {
+		after, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || after < 0 {
+			return "", 0, 0, errors.New("after must be a non-negative number")
+		}
+	}
+	if s := query.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return "", 0, 0, errors.New("limit must be a positive number")
+		}
+	}
+	return id, after, limit, nil
+}
+
+func TaskEventsInit(command string, ctx *dvcontext.RequestContext) ([]interface{}, bool) {
+	config := &TaskEventsConfig{}
+	if !dvaction.DefaultInitWithObject(command, config, dvaction.GetEnvironment(ctx)) {
+		return nil, false
+	}
+	return []interface{}{config, ctx}, true
+}
+
+func TaskEventsRun(data []interface{}) bool {
+	config := data[0].(*TaskEventsConfig)
+	var ctx *dvcontext.RequestContext = nil
+	if data[1] != nil {
+		ctx = data[1].(*dvcontext.RequestContext)
+	}
+	var page *TaskEventPage
+	id, after, limit, err := parseTaskEventsRequest(ctx)
+	if err == nil {
+		page, err = GetTaskEvents(id, after, limit)
+	}
+	var res *dvevaluation.DvVariable
+	if err == nil {
+		res, err = dvevaluation.AnyStructToDvVariable(page)
+	}
+	if err != nil {
+		mes := err.Error()
+		dvlog.PrintlnError(mes)
+		resError := &dvevaluation.DvVariable{Kind: dvevaluation.FIELD_STRING, Name: []byte("error"), Value: []byte(mes)}
+		res = &dvevaluation.DvVariable{Kind: dvevaluation.FIELD_OBJECT, Fields: []*dvevaluation.DvVariable{resError}}
+	}
+	dvaction.SaveActionResult(config.Result, res, ctx)
+	return true
+}
+
+const (
+	CommandTaskEvents = "taskevents"
+)
@@ -0,0 +1,104 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+)
+
+func TestTaskEventsAreKeptByRetention(t *testing.T) {
+	defer SetPropertyForTest("TVSERVER_TASK_EVENTS_MAX", "3")()
+	defer SetPropertyForTest("TVSERVER_TASK_EVENTS_DAYS", "2")()
+	defer dvdbmanager.RecordDelete(taskEventDbName, "9401")
+	now := time.Now()
+	old := now.Add(-72 * time.Hour)
+	if err := AddTaskEvent("9401", TaskEventPhase, PhasePending, "presentation 1 version 1", old); err != nil {
+		t.Fatal(err)
+	}
+	for i, kind := range []string{TaskEventStart, TaskEventConfig, TaskEventChunk, TaskEventError} {
+		if err := AddTaskEvent("9401", kind, PhaseSendingFiles, "", now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	page, err := GetTaskEvents("9401", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Events) != 3 || page.Events[0].Seq != 3 || page.Events[0].Kind != TaskEventConfig || page.Next != 5 || page.More {
+		t.Fatalf("only the last 3 events must be kept, got %+v", page)
+	}
+	page, err = GetTaskEvents("9401", 3, 1)
+	if err != nil || len(page.Events) != 1 || page.Events[0].Seq != 4 || !page.More || page.Next != 4 {
+		t.Errorf("second page must have the event 4 and more: %+v %v", page, err)
+	}
+
+	if err = AddTaskEvent("9402", TaskEventStop, PhaseDone, "context canceled", old); err != nil {
+		t.Fatal(err)
+	}
+	defer dvdbmanager.RecordDelete(taskEventDbName, "9402")
+	if err = pruneTaskEvents(now); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ = GetTaskEvents("9402", 0, 0); page == nil || len(page.Events) != 0 {
+		t.Errorf("expired events of a stopped task must be removed: %+v", page)
+	}
+	if err = AddTaskEvent("9402", TaskEventStart, PhasePending, "", now); err != nil {
+		t.Fatal(err)
+	}
+	if page, _ = GetTaskEvents("9402", 0, 0); page == nil || len(page.Events) != 1 || page.Events[0].Seq != 2 {
+		t.Errorf("the seq must go on after the expired events: %+v", page)
+	}
+	if page, _ = GetTaskEvents("9401", 0, 0); len(page.Events) != 3 {
+		t.Errorf("events within the retention must stay, got %+v", page)
+	}
+}
+
+func TestTaskEventsOfBatchAreAddedTogether(t *testing.T) {
+	defer dvdbmanager.RecordDelete(taskEventDbName, "9405")
+	now := time.Now()
+	if err := AddTaskEvent("9405", TaskEventConfig, PhaseSendingConfig, "", now); err != nil {
+		t.Fatal(err)
+	}
+	acks := []*TaskEvent{
+		{Kind: TaskEventChunk, Phase: PhaseSendingFiles, Message: "a.mp4 goes on from 10"},
+		{Kind: TaskEventChunk, Phase: PhaseSendingFiles, Message: "b.png is complete"},
+	}
+	if err := AddTaskEvents("9405", now, acks...); err != nil {
+		t.Fatal(err)
+	}
+	page, err := GetTaskEvents("9405", 1, 0)
+	if err != nil || len(page.Events) != 2 || page.Events[0].Seq != 2 || page.Events[1].Seq != 3 || page.Events[1].Message != "b.png is complete" {
+		t.Errorf("the chunks of a batch must follow in their order: %+v %v", page, err)
+	}
+}
+
+func TestTaskEventsOfTasksAreAddedTogether(t *testing.T) {
+	ids := []string{"9403", "9404"}
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		defer dvdbmanager.RecordDelete(taskEventDbName, id)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func(id string) {
+				defer wg.Done()
+				if err := AddTaskEvent(id, TaskEventChunk, PhaseSendingFiles, "", time.Now()); err != nil {
+					t.Error(err)
+				}
+			}(id)
+		}
+	}
+	wg.Wait()
+	for _, id := range ids {
+		page, err := GetTaskEvents(id, 0, 0)
+		if err != nil || len(page.Events) != 10 || page.Next != 10 {
+			t.Errorf("every event of task %s must be kept once: %+v %v", id, page, err)
+		}
+	}
+}
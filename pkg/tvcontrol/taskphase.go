@@ -0,0 +1,211 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"errors"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+)
+
+// TaskPhase is the step of the delivery of the presentation of a task
+type TaskPhase string
+
+const (
+	// PhasePending is a task whose config was not sent yet
+	PhasePending TaskPhase = "pending"
+	// PhaseSendingConfig is a task whose config was sent but not accepted yet
+	PhaseSendingConfig TaskPhase = "sending-config"
+	// PhaseSendingFiles is a task whose player accepted the config and misses the leftFiles
+	PhaseSendingFiles TaskPhase = "sending-files"
+	// PhaseDone is a task whose player has all files
+	PhaseDone TaskPhase = "done"
+	// PhaseFailed is a task which stopped after TVSERVER_TASK_MAX_FAILURES failed connections
+	PhaseFailed TaskPhase = "failed"
+	// PhaseCancelled is a task stopped by an admin
+	PhaseCancelled TaskPhase = "cancelled"
+	// PhaseSuperseded is an unfinished task replaced by the task of a newer presentation
+	PhaseSuperseded TaskPhase = "superseded"
+)
+
+// progressDone is the progress of a task whose player has all files, the progress is in per mille
+const progressDone = 1000
+
+// taskTransitions lists the phases each phase may change to
+var taskTransitions = map[TaskPhase][]TaskPhase{
+	PhasePending:       {PhaseSendingConfig, PhaseSendingFiles, PhaseDone, PhaseFailed, PhaseCancelled, PhaseSuperseded},
+	PhaseSendingConfig: {PhaseSendingFiles, PhaseDone, PhaseFailed, PhaseCancelled, PhaseSuperseded},
+	PhaseSendingFiles:  {PhaseSendingConfig, PhaseDone, PhaseFailed, PhaseCancelled, PhaseSuperseded},
+	PhaseDone:          {PhaseSendingConfig, PhaseSendingFiles},
+	PhaseFailed:        {PhasePending, PhaseCancelled, PhaseSuperseded},
+	PhaseCancelled:     {PhasePending, PhaseSuperseded},
+	PhaseSuperseded:    {},
+}
+
+// migration of the task records saved before the phases
+var taskFieldsForMigration = []string{
+	"^phase,progress,failures,contacted",
+}
+
+// CanChangePhase tells whether the task in phase from may go to phase to
+func CanChangePhase(from TaskPhase, to TaskPhase) bool {
+	if from == to {
+		return true
+	}
+	for _, phase := range taskTransitions[from] {
+		if phase == to {
+			return true
+		}
+	}
+	return false
+}
+
+// setPhase changes the phase of the task if the transition is allowed
+func (t *TvTask) setPhase(phase TaskPhase) error {
+	if !CanChangePhase(t.Phase, phase) {
+		return errors.New("task " + t.Id + " cannot go from " + string(t.Phase) + " to " + string(phase))
+	}
+	if t.Phase != phase {
+		recordTaskEvent(t.Id, TaskEventPhase, phase, "from "+string(t.Phase))
+		if phase == PhaseDone {
+			keepDeliveredConfig(t)
+		}
+	}
+	t.Phase = phase
+	if phase == PhaseDone {
+		t.Progress = progressDone
+		t.LeftFiles = nil
+	}
+	return nil
+}
+
+// isSending tells whether the worker still delivers the presentation of the task
+func (t *TvTask) isSending() bool {
+	return t.Phase == PhasePending || t.Phase == PhaseSendingConfig || t.Phase == PhaseSendingFiles
+}
+
+// setReceivedPhase moves the task whose player has accepted the config to done or to sending-files
+func (t *TvTask) setReceivedPhase() error {
+	if len(t.LeftFiles) == 0 {
+		return t.setPhase(PhaseDone)
+	}
+	return t.setPhase(PhaseSendingFiles)
+}
+
+// connectionSucceeded clears the failures and tells whether the task has changed
+func (t *TvTask) connectionSucceeded() bool {
+	changed := t.Failures != 0 || !t.Contacted
+	t.Failures = 0
+	t.Contacted = true
+	return changed
+}
+
+// connectionFailed counts the failure, a delivering task fails after TVSERVER_TASK_MAX_FAILURES
+// failures in a row unless it is 0
+func (t *TvTask) connectionFailed() {
+	t.Failures++
+	limit := readIntProperty("TVSERVER_TASK_MAX_FAILURES", 0)
+	if limit > 0 && t.Failures >= limit && t.isSending() {
+		t.setPhase(PhaseFailed)
+		dvlog.PrintfFullOnly("Task %s failed after %d failed connections: %s", t.Id, t.Failures, t.LastError)
+	}
+}
+
+// setLegacyStatus fills taskStatus and connectionStatus for the readers of the task table
+// before the phases: taskStatus 1000 is done, connectionStatus -1 is never connected,
+// 0 connected and a positive number counts the failures in a row
+func (t *TvTask) setLegacyStatus() {
+	switch t.Phase {
+	case PhaseDone:
+		t.TaskStatus = progressDone
+	case PhasePending, PhaseSendingConfig:
+		t.TaskStatus = 0
+	default:
+		t.TaskStatus = t.Progress
+	}
+	switch {
+	case t.Failures > 0:
+		t.ConnectionStatus = t.Failures
+	case t.Contacted:
+		t.ConnectionStatus = 0
+	default:
+		t.ConnectionStatus = -1
+	}
+}
+
+// ensurePhase derives the phase, progress and failures of a task saved before the phases
+// or whose phase was cleaned because its config must be sent again
+func (t *TvTask) ensurePhase() {
+	if t.Phase != "" {
+		return
+	}
+	t.Progress = t.TaskStatus
+	t.Failures = max(t.ConnectionStatus, 0)
+	t.Contacted = t.ConnectionStatus == 0
+	switch {
+	case t.NewPresentationId != t.OldPresentationId || t.NewPresentationVersion != t.OldPresentationVersion:
+		t.Phase = PhasePending
+		t.Progress = 0
+	case t.TaskStatus < 0:
+		// taskStatus -1 was a task failed for its checksum mismatches
+		t.Phase = PhaseFailed
+		t.Progress = 0
+	case len(t.LeftFiles) == 0 || t.TaskStatus == progressDone:
+		t.Phase = PhaseDone
+		t.Progress = progressDone
+	default:
+		t.Phase = PhaseSendingFiles
+	}
+}
+
+func taskToRow(t *TvTask) (*dvevaluation.DvVariable, error) {
+	t.ensurePhase()
+	t.setLegacyStatus()
+	return dvevaluation.AnyStructToDvVariable(t)
+}
+
+func rowToTask(row *dvevaluation.DvVariable) (*TvTask, error) {
+	t := &TvTask{}
+	err := row.DvVariableToAnyStruct(t)
+	if err != nil {
+		return nil, err
+	}
+	t.ensurePhase()
+	return t, nil
+}
+
+// migrateTaskTable saves the derived phase in the task records saved before the phases
+func migrateTaskTable() error {
+	tasks, err := dvdbmanager.RecordReadAll(taskDbName)
+	if err != nil || tasks == nil {
+		return err
+	}
+	migrated := 0
+	for _, record := range tasks.Fields {
+		if record == nil || record.ReadSimpleChildValue("phase") != "" {
+			continue
+		}
+		t, err := rowToTask(record)
+		if err != nil {
+			return err
+		}
+		row, err := taskToRow(t)
+		if err != nil {
+			return err
+		}
+		_, err = updateRecordByConditions(taskDbName, row, taskConditionsForConnectionCheck, taskFieldsForMigration)
+		if err != nil {
+			return err
+		}
+		migrated++
+	}
+	if migrated != 0 {
+		dvlog.PrintfFullOnly("Phases of %d tasks are derived from their status", migrated)
+	}
+	return nil
+}
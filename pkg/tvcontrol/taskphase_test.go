@@ -0,0 +1,96 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"testing"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+)
+
+func TestTaskPhaseTransitions(t *testing.T) {
+	task := &TvTask{Id: "9301", Phase: PhasePending, LeftFiles: []string{"a-100.png"}, RealFiles: []string{"/a.png"}}
+	if err := task.setPhase(PhaseSendingConfig); err != nil {
+		t.Fatal(err)
+	}
+	if err := task.setReceivedPhase(); err != nil || task.Phase != PhaseSendingFiles {
+		t.Fatalf("accepted config with left files must send files: %v %s", err, task.Phase)
+	}
+	task.LeftFiles = nil
+	if err := calculateTaskStatus(task); err != nil || task.Phase != PhaseDone || task.Progress != 1000 || task.TaskStatus != 1000 {
+		t.Fatalf("no left files must finish the task: %v %s %d %d", err, task.Phase, task.Progress, task.TaskStatus)
+	}
+	if err := task.setPhase(PhaseFailed); err == nil {
+		t.Error("done task must not fail")
+	}
+	task.Phase = PhaseSuperseded
+	if err := task.setPhase(PhasePending); err == nil || task.Phase != PhaseSuperseded {
+		t.Errorf("superseded task must stay superseded: %v %s", err, task.Phase)
+	}
+	task.Phase = PhaseCancelled
+	if err := task.setPhase(PhasePending); err != nil {
+		t.Errorf("cancelled task must be restarted: %v", err)
+	}
+}
+
+func TestTaskFailsAfterMaxFailures(t *testing.T) {
+	defer SetPropertyForTest("TVSERVER_TASK_MAX_FAILURES", "2")()
+	task := &TvTask{Id: "9302", Phase: PhaseSendingFiles}
+	task.connectionFailed()
+	task.setLegacyStatus()
+	if task.Phase != PhaseSendingFiles || task.ConnectionStatus != 1 {
+		t.Fatalf("first failure must be counted only: %s %d", task.Phase, task.ConnectionStatus)
+	}
+	task.connectionFailed()
+	if task.Phase != PhaseFailed {
+		t.Fatalf("second failure must fail the task, got %s", task.Phase)
+	}
+	if !task.connectionSucceeded() || task.Phase != PhaseFailed {
+		t.Errorf("connection must not restart a failed task: %s", task.Phase)
+	}
+	task.setLegacyStatus()
+	if task.ConnectionStatus != 0 {
+		t.Errorf("connected task must have connectionStatus 0, got %d", task.ConnectionStatus)
+	}
+}
+
+func TestTaskTableIsMigrated(t *testing.T) {
+	records := map[string]map[string]interface{}{
+		"9303": {"id": "9303", "name": "never", "newPresentationId": "1", "newPresentationVersion": "2", "connectionStatus": -1, "taskStatus": 0},
+		"9304": {"id": "9304", "name": "sending", "newPresentationId": "1", "newPresentationVersion": "2", "oldPresentationId": "1", "oldPresentationVersion": "2",
+			"leftFiles": []string{"a-100.png:50"}, "connectionStatus": 2, "taskStatus": 250},
+		"9305": {"id": "9305", "name": "done", "newPresentationId": "1", "newPresentationVersion": "2", "oldPresentationId": "1", "oldPresentationVersion": "2",
+			"connectionStatus": 0, "taskStatus": 1000},
+		"9306": {"id": "9306", "name": "failed", "newPresentationId": "1", "newPresentationVersion": "2", "oldPresentationId": "1", "oldPresentationVersion": "2",
+			"leftFiles": []string{"a-100.png"}, "connectionStatus": 0, "taskStatus": -1},
+	}
+	for id, v := range records {
+		row, err := dvevaluation.AnyStructToDvVariable(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = updateRecordByConditions(taskDbName, row, []string{"NEW"}, []string{""}); err != nil {
+			t.Fatal(err)
+		}
+		defer dvdbmanager.RecordDelete(taskDbName, id)
+	}
+	if err := migrateTaskTable(); err != nil {
+		t.Fatal(err)
+	}
+	if task := readTask(t, "9303"); task.Phase != PhasePending || task.Contacted || task.Failures != 0 {
+		t.Errorf("task never sent must be pending: %s %v %d", task.Phase, task.Contacted, task.Failures)
+	}
+	if task := readTask(t, "9304"); task.Phase != PhaseSendingFiles || task.Progress != 250 || task.Failures != 2 || task.Name != "sending" {
+		t.Errorf("task with left files must be sending files: %s %d %d %q", task.Phase, task.Progress, task.Failures, task.Name)
+	}
+	if task := readTask(t, "9305"); task.Phase != PhaseDone || task.Progress != 1000 || !task.Contacted {
+		t.Errorf("task with status 1000 must be done: %s %d %v", task.Phase, task.Progress, task.Contacted)
+	}
+	if task := readTask(t, "9306"); task.Phase != PhaseFailed {
+		t.Errorf("task with status -1 must be failed: %s", task.Phase)
+	}
+}
@@ -7,13 +7,10 @@ package tvcontrol
 
 import (
 	"errors"
-	"os"
 	"strconv"
 	"strings"
 
 	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
-	"github.com/Dobryvechir/microcore/pkg/dvlog"
-	"github.com/Dobryvechir/microcore/pkg/dvparser"
 )
 
 func readScreens(presentation *dvevaluation.DvVariable) ([]*TvScreen, error) {
@@ -82,36 +79,15 @@ func prepareSampleTask(presentation *dvevaluation.DvVariable) (*TvTask, error) {
 	if err != nil {
 		return nil, err
 	}
-	err = fixConfigFileNames(config, realFiles)
+	err = putUpContentFiles(config, realFiles)
 	if err != nil {
 		return nil, err
 	}
-	r := &TvTask{NewPresentationId: presId, NewPresentationName: presName, NewPresentationVersion: presVersion, Config: config, RealFiles: realFiles}
+	groupId := presentation.ReadSimpleChildValue("group")
+	r := &TvTask{NewPresentationId: presId, NewPresentationName: presName, NewPresentationVersion: presVersion, Config: config, RealFiles: realFiles, GroupId: groupId}
 	return r, nil
 }
 
-func fixConfigFileNames(config *TvConfig, realFiles []string) error {
-	n := len(config.File)
-	m := len(realFiles)
-	if n == 0 {
-		return errors.New("no files to show")
-	}
-	if n != m {
-		return errors.New("misconfiguration in screens, remove them and create from the scratch")
-	}
-	for i := 0; i < n; i++ {
-		if len(config.File[i]) == 0 {
-			s, err := fixFileName(realFiles[i])
-			if err != nil {
-				return err
-			}
-			config.File[i] = s
-			dvlog.PrintfFullOnly("Fixed %d file name %s", i, s)
-		}
-	}
-	return nil
-}
-
 func getFileNamePrefix(ext string) (string, error) {
 	if ext == "mp4" || ext == "webm" || ext == "ogv" {
 		return "v", nil
@@ -131,72 +107,31 @@ func getFileNameExtension(name string) (string, error) {
 	return ext, nil
 }
 
-func getFileNameLength(name string) (string, error) {
-	file := dvparser.GetByGlobalPropertiesOrDefault("HTML_PATH", "") + name
-	fi, err := os.Stat(file)
-	if err != nil {
-		return "", err
-	}
-	size := fi.Size()
-	if size == 0 {
-		return "", errors.New("File " + file + " has zero size")
-	}
-	res := strconv.FormatInt(size, 10)
-	return res, nil
-}
-
-func getFileNameId(name string) (string, error) {
-	begPos := 0
-	n := len(name)
-	for begPos < n && !(name[begPos] >= '0' && name[begPos] <= '9') {
-		begPos++
-	}
-	if begPos == n {
-		return "", errors.New("No id in file name " + name)
-	}
-	endPos := begPos + 1
-	for endPos < n && name[endPos] >= '0' && name[endPos] <= '9' {
-		endPos++
-	}
-	return name[begPos:endPos], nil
-}
-
-// template: i583747_7721532218530737715-1071263.png
-func fixFileName(name string) (string, error) {
-	resLen, err := getFileNameLength(name)
-	if err != nil {
-		return "", err
-	}
-	resExt, err := getFileNameExtension(name)
-	if err != nil {
-		return "", err
-	}
-	resPref, err := getFileNamePrefix(resExt)
-	if err != nil {
-		return "", err
-	}
-	resId, err := getFileNameId(name)
-	if err != nil {
-		return "", err
-	}
-	return resPref + resId + "_0-" + resLen + "." + resExt, nil
-}
-
 func createTvTasks(sample *TvTask, tvs []*dvevaluation.DvVariable) ([]*TvTask, error) {
-	n := len(tvs)
-	if n == 0 {
-		return nil, errors.New("no tvs")
-	}
-	res := make([]*TvTask, n)
-	for i := 0; i < n; i++ {
-		tv := tvs[i]
+	res := make([]*TvTask, 0, len(tvs))
+	for _, tv := range tvs {
+		if !isTvpcActive(tv) {
+			continue
+		}
 		id := tv.ReadSimpleChildValue("id")
 		name := tv.ReadSimpleChildValue("name")
 		url := tv.ReadSimpleChildValue("url")
-		if id == "" || name == "" || url == "" {
+		mode := tv.ReadSimpleChildValue("mode")
+		// the player in pull mode calls the server, its url is not needed
+		if id == "" || name == "" || url == "" && mode != TaskModePull {
 			return nil, errors.New("empty id, name, url in tvpc " + id + "," + name + "," + url)
 		}
-		res[i] = &TvTask{NewPresentationId: sample.NewPresentationId, NewPresentationName: sample.NewPresentationName, NewPresentationVersion: sample.NewPresentationVersion, Config: sample.Config, RealFiles: sample.RealFiles, Id: id, Name: name, Url: url, LeftFiles: make([]string, 0, 16), ConnectionStatus: -1}
+		task := &TvTask{NewPresentationId: sample.NewPresentationId, NewPresentationName: sample.NewPresentationName, NewPresentationVersion: sample.NewPresentationVersion, Config: sample.Config, RealFiles: sample.RealFiles, Id: id, Name: name, Url: url, LeftFiles: make([]string, 0, 16), Phase: PhasePending, GroupId: sample.GroupId, Pin: tv.ReadSimpleChildValue("pin"),
+			NextKeyId: tv.ReadSimpleChildValue("keyId"), Mode: mode}
+		// the player got this key with its registration, a new task signs with it at once
+		if task.NextKeyId != "" && tv.ReadSimpleChildValue("deliveredKeyId") == task.NextKeyId {
+			task.KeyId = task.NextKeyId
+		}
+		res = append(res, task)
+	}
+	if len(res) == 0 {
+		return nil, errors.New("no tvs")
 	}
+	assignPeerSeeds(res)
 	return res, nil
 }
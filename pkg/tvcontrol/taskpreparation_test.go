@@ -0,0 +1,113 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Dobryvechir/microcore/pkg/dvjson"
+	"github.com/Dobryvechir/microcore/pkg/dvparser"
+)
+
+func writeHtmlFile(t *testing.T, name string, size int) {
+	t.Helper()
+	folder := dvparser.GetByGlobalPropertiesOrDefault("HTML_PATH", "")
+	err := os.WriteFile(filepath.Join(folder, name), make([]byte, size), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContentFileName(t *testing.T) {
+	hash := CalculateChunkDigest([]byte("abc"))
+	cases := []struct {
+		ext      string
+		expected string
+		fail     bool
+	}{
+		{"png", "i" + hash[:32] + "-1234.png", false},
+		{"mp4", "v" + hash[:32] + "-1234.mp4", false},
+		{"txt", "", true},
+	}
+	for _, c := range cases {
+		res, err := getContentFileName(hash, 1234, c.ext)
+		if (err != nil) != c.fail || res != c.expected {
+			t.Errorf("getContentFileName(%s)=%s,%v expected %s", c.ext, res, err, c.expected)
+		}
+	}
+	if n := getFullSeek(cases[0].expected + ":17"); n != 1234 {
+		t.Errorf("content file name must keep the size for getFullSeek, got %d", n)
+	}
+}
+
+func TestPrepareSampleTask(t *testing.T) {
+	writeHtmlFile(t, "screen901.png", 10)
+	writeHtmlFile(t, "screen/2.png", 3)
+	presentation, err := dvjson.JsonFullParser([]byte(`{"id":"7","name":"morning","version":"3","duration":[5,6,7,8],
+		"screens":[{"id":"1","file":"/screen901.png","fileName":""},{"id":"2","file":"/screen/2.png","fileName":"i2_55-99.png"},
+		{"id":"3","file":"/screen/2.png","fileName":"ilogo-3.png"},{"id":"4","file":"/screen/2.png","fileName":"ilogo.png"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	task, err := prepareSampleTask(presentation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if task.NewPresentationId != "7" || task.NewPresentationName != "morning" || task.NewPresentationVersion != "3" {
+		t.Errorf("wrong presentation in %v", task)
+	}
+	hash1 := CalculateChunkDigest(make([]byte, 10))
+	hash2 := CalculateChunkDigest(make([]byte, 3))
+	// the name set by the operator is kept, the generated one and the one without the size are replaced
+	expected := &TvConfig{File: []string{"i" + hash1[:32] + "-10.png", "i" + hash2[:32] + "-3.png", "ilogo-3.png", "i" + hash2[:32] + "-3.png"},
+		Duration: []int{5, 6, 7, 8}, Hash: []string{hash1, hash2, hash2, hash2}}
+	if !reflect.DeepEqual(task.Config, expected) {
+		t.Errorf("config %v, expected %v", task.Config, expected)
+	}
+	store2 := "/store/" + hash2 + ".png"
+	if !reflect.DeepEqual(task.RealFiles, []string{"/store/" + hash1 + ".png", store2, store2, store2}) {
+		t.Errorf("wrong real files %v", task.RealFiles)
+	}
+	folder := dvparser.GetByGlobalPropertiesOrDefault("HTML_PATH", "")
+	if fi, err := os.Stat(folder + task.RealFiles[0]); err != nil || fi.Size() != 10 {
+		t.Errorf("file is not stored by its hash: %v", err)
+	}
+
+	wrong, _ := dvjson.JsonFullParser([]byte(`{"id":"7","name":"morning","version":"3","duration":[5],
+		"screens":[{"id":"1","file":"/a.png","fileName":"a-1.png"},{"id":"2","file":"/b.png","fileName":"b-1.png"}]}`))
+	if _, err = prepareSampleTask(wrong); err == nil {
+		t.Error("durations and screens mismatch must fail")
+	}
+	noVersion, _ := dvjson.JsonFullParser([]byte(`{"id":"7","name":"morning","duration":[5],"screens":[{"id":"1"}]}`))
+	if _, err = prepareSampleTask(noVersion); err == nil {
+		t.Error("presentation without version must fail")
+	}
+}
+
+func TestCleanMediaStore(t *testing.T) {
+	folder := dvparser.GetByGlobalPropertiesOrDefault("HTML_PATH", "")
+	if err := os.MkdirAll(folder+mediaStoreFolder, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeHtmlFile(t, "store/unused901.png", 4)
+	writeHtmlFile(t, "screen902.png", 5)
+	storeFile, err := storeMediaFile("/screen902.png", "stored902", "png", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cleanMediaStore(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(folder + "/store/unused901.png"); !os.IsNotExist(err) {
+		t.Errorf("unused store file must be removed: %v", err)
+	}
+	if _, err = os.Stat(folder + storeFile); err != nil {
+		t.Errorf("file stored since the start must be kept: %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/Dobryvechir/microcore/pkg/dvaction"
+	"github.com/Dobryvechir/microcore/pkg/dvcontext"
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+)
+
+// TvpcKeyConfig issues the secret of a registered tvpc which has none yet,
+// with rotate a new secret is issued anyway and delivered by the task of the tvpc
+type TvpcKeyConfig struct {
+	Tvpc   string `json:"tvpc"`
+	Rotate bool   `json:"rotate"`
+	Result string `json:"result"`
+}
+
+var tvpcConditionsForKey = []string{
+	"DEFAULT",
+}
+
+var tvpcFieldsForKey = []string{
+	"^keyId",
+}
+
+func TvpcKeyInit(command string, ctx *dvcontext.RequestContext) ([]interface{}, bool) {
+	config := &TvpcKeyConfig{}
+	if !dvaction.DefaultInitWithObject(command, config, dvaction.GetEnvironment(ctx)) {
+		return nil, false
+	}
+	return []interface{}{config, ctx}, true
+}
+
+func TvpcKeyRun(data []interface{}) bool {
+	config := data[0].(*TvpcKeyConfig)
+	var ctx *dvcontext.RequestContext = nil
+	if data[1] != nil {
+		ctx = data[1].(*dvcontext.RequestContext)
+	}
+	err := tvpcKeyRunByConfig(config, ctx)
+	if err != nil {
+		mes := err.Error()
+		dvlog.PrintlnError(mes)
+		resError := &dvevaluation.DvVariable{Kind: dvevaluation.FIELD_STRING, Name: []byte("error"), Value: []byte(mes)}
+		res := &dvevaluation.DvVariable{Kind: dvevaluation.FIELD_OBJECT, Fields: []*dvevaluation.DvVariable{resError}}
+		dvaction.SaveActionResult(config.Result, res, ctx)
+	}
+	return true
+}
+
+// getApiPathId takes the id of /api/v1/{table}/{id}/{name}
+func getApiPathId(ctx *dvcontext.RequestContext, table string, name string) (string, error) {
+	if ctx == nil || ctx.Reader == nil {
+		return "", errors.New("no request for " + table + " " + name)
+	}
+	params := strings.Split(strings.Trim(strings.TrimPrefix(ctx.Reader.URL.Path, "/api/v1/"+table+"/"), "/"), "/")
+	if len(params) != 2 || params[0] == "" || params[1] != name {
+		return "", errors.New("unknown request " + ctx.Reader.URL.Path)
+	}
+	return params[0], nil
+}
+
+// readTvpcForKey takes the tvpc of the action result or, without it, of /api/v1/tvpc/{id}/key
+func readTvpcForKey(config *TvpcKeyConfig, ctx *dvcontext.RequestContext) (*dvevaluation.DvVariable, error) {
+	if config.Tvpc == "" {
+		id, err := getApiPathId(ctx, tvpcDbName, "key")
+		if err != nil {
+			return nil, err
+		}
+		tvpc, err := dvdbmanager.RecordReadOne(tvpcDbName, id)
+		if err != nil || tvpc == nil {
+			return nil, errors.New("tvpc " + id + " does not exist")
+		}
+		return tvpc, nil
+	}
+	tvpcData, ok := dvaction.ReadActionResult(config.Tvpc, ctx)
+	if !ok {
+		return nil, errors.New("system error in reading the tvpc")
+	}
+	tvpc := dvevaluation.AnyToDvVariable(tvpcData)
+	if tvpc == nil || tvpc.Kind != dvevaluation.FIELD_OBJECT {
+		return nil, errors.New("no tvpc to issue the key for")
+	}
+	return tvpc, nil
+}
+
+// TvpcPairing is the body of POST /api/v1/tvpc/{id}/key with the pairing token shown by
+// the player without keys, the first key is delivered to that player only
+type TvpcPairing struct {
+	PairingToken string `json:"pairingToken"`
+}
+
+// readPairingToken takes the pairing token of the body, the body may be empty
+func readPairingToken(ctx *dvcontext.RequestContext) (string, error) {
+	if ctx == nil || ctx.PrimaryContextEnvironment == nil {
+		return "", nil
+	}
+	body := strings.TrimSpace(ctx.PrimaryContextEnvironment.GetString(dvcontext.BODY_STRING))
+	if body == "" {
+		return "", nil
+	}
+	pairing := &TvpcPairing{}
+	err := json.Unmarshal([]byte(body), pairing)
+	if err != nil {
+		return "", err
+	}
+	if pairing.PairingToken != "" && !isPairingToken(pairing.PairingToken) {
+		return "", errors.New("pairing token must have " + strconv.Itoa(pairingTokenLength) + " hex digits")
+	}
+	return pairing.PairingToken, nil
+}
+
+func tvpcKeyRunByConfig(config *TvpcKeyConfig, ctx *dvcontext.RequestContext) error {
+	tvpc, err := readTvpcForKey(config, ctx)
+	if err != nil {
+		return err
+	}
+	id := tvpc.ReadSimpleChildValue("id")
+	keyId := tvpc.ReadSimpleChildValue("keyId")
+	if id == "" {
+		return errors.New("tvpc has no id")
+	}
+	if config.Tvpc == "" {
+		token, err := readPairingToken(ctx)
+		if err != nil {
+			return err
+		}
+		if token != "" {
+			err = savePairingToken(id, token)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !config.Rotate && getTvpcKey(id, keyId) != nil {
+		dvaction.SaveActionResult(config.Result, tvpc, ctx)
+		return nil
+	}
+	res, err := IssueTvpcKey(id, getNextKeyId(keyId))
+	if err != nil {
+		return err
+	}
+	dvaction.SaveActionResult(config.Result, res, ctx)
+	return nil
+}
+
+// IssueTvpcKey saves a new secret in tvpcsecret and its id in the tvpc record and makes
+// the task of the tvpc deliver it to the player
+func IssueTvpcKey(id string, keyId string) (*dvevaluation.DvVariable, error) {
+	key, err := NewPlayerKey(keyId)
+	if err != nil {
+		return nil, err
+	}
+	err = saveTvpcKey(id, key)
+	if err != nil {
+		return nil, err
+	}
+	row, err := dvevaluation.AnyStructToDvVariable(map[string]string{"id": id, "keyId": key.Id})
+	if err != nil {
+		return nil, err
+	}
+	res, err := updateRecordByConditions(tvpcDbName, row, tvpcConditionsForKey, tvpcFieldsForKey)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return nil, errors.New("tvpc " + id + " does not exist")
+	}
+	task, err := createOrUpdateTaskDatabase(&TvTask{Id: id, NextKeyId: key.Id}, taskConditionsForConnectionCheck, taskFieldsForKeyRotation)
+	if err != nil {
+		return nil, err
+	}
+	if task != nil {
+		wakeUpMainWorker()
+	}
+	return res, nil
+}
+
+const (
+	CommandTvpcKey = "tvpckey"
+)
@@ -0,0 +1,253 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"sync"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+)
+
+// the secrets of a tv pc are kept in its own record of the folder table tvpcsecret, no action
+// of the api reads this table, so the records of tvpc and task have only the key ids
+const tvpcSecretDbName = "tvpcsecret"
+
+// the last issued keys kept for a tv pc, the player may sign with an older one until the
+// rotated key reaches it
+const maxTvpcKeys = 8
+
+// tvpcSecrets has the keys of the tv pc from the oldest to the newest, the token which lets
+// the player get its key with the registration, the pairing code shown by the pending player
+// until the approval and the pairing token of its player without keys until the first key is delivered
+type tvpcSecrets struct {
+	Id                string       `json:"id"`
+	Keys              []*PlayerKey `json:"keys"`
+	RegistrationToken string       `json:"registrationToken,omitempty"`
+	PairingCode       string       `json:"pairingCode,omitempty"`
+	PairingToken      string       `json:"pairingToken,omitempty"`
+}
+
+var tvpcSecretMu sync.Mutex
+
+var tvpcSecretConditions = []string{
+	"NEW",
+	"DEFAULT",
+}
+
+var tvpcSecretFields = []string{
+	"",
+	"",
+}
+
+func readTvpcSecrets(id string) (*tvpcSecrets, error) {
+	res, err := dvdbmanager.RecordReadOne(tvpcSecretDbName, id)
+	if err != nil {
+		return nil, err
+	}
+	secrets := &tvpcSecrets{Id: id}
+	if res != nil {
+		err = res.DvVariableToAnyStruct(secrets)
+	}
+	return secrets, err
+}
+
+func saveTvpcSecrets(secrets *tvpcSecrets) error {
+	row, err := dvevaluation.AnyStructToDvVariable(secrets)
+	if err != nil {
+		return err
+	}
+	_, err = dvdbmanager.CreateOrUpdateByConditionsAndUpdateFields(tvpcSecretDbName, row, tvpcSecretConditions, tvpcSecretFields)
+	return err
+}
+
+// updateTvpcSecrets applies change to the secrets of the tv pc and saves them
+func updateTvpcSecrets(id string, change func(secrets *tvpcSecrets)) error {
+	tvpcSecretMu.Lock()
+	defer tvpcSecretMu.Unlock()
+	secrets, err := readTvpcSecrets(id)
+	if err != nil {
+		return err
+	}
+	change(secrets)
+	return saveTvpcSecrets(secrets)
+}
+
+// saveTvpcKey keeps the key as the newest of the last maxTvpcKeys keys of the tv pc
+func saveTvpcKey(id string, key *PlayerKey) error {
+	return updateTvpcSecrets(id, func(secrets *tvpcSecrets) {
+		keys := make([]*PlayerKey, 0, len(secrets.Keys)+1)
+		for _, k := range secrets.Keys {
+			if k != nil && k.Id != key.Id {
+				keys = append(keys, k)
+			}
+		}
+		keys = append(keys, key)
+		secrets.Keys = keys[max(len(keys)-maxTvpcKeys, 0):]
+	})
+}
+
+// saveRegistrationSecrets keeps the registration token and the pairing code of the tv pc,
+// an empty one leaves the saved value
+func saveRegistrationSecrets(id string, token string, code string) error {
+	return updateTvpcSecrets(id, func(secrets *tvpcSecrets) {
+		if token != "" {
+			secrets.RegistrationToken = token
+		}
+		if code != "" {
+			secrets.PairingCode = code
+		}
+	})
+}
+
+// removePairingCode forgets the pairing code of the approved tv pc
+func removePairingCode(id string) error {
+	return updateTvpcSecrets(id, func(secrets *tvpcSecrets) {
+		secrets.PairingCode = ""
+	})
+}
+
+// getTvpcKey returns the key of the tv pc with keyId or nil if there is no such key
+func getTvpcKey(id string, keyId string) *PlayerKey {
+	if id == "" || keyId == "" {
+		return nil
+	}
+	secrets, err := readTvpcSecrets(id)
+	if err != nil {
+		dvlog.PrintError(err)
+		return nil
+	}
+	for _, key := range secrets.Keys {
+		if key != nil && key.Id == keyId && key.Secret != "" {
+			return key
+		}
+	}
+	return nil
+}
+
+func getRegistrationToken(id string) string {
+	secrets, err := readTvpcSecrets(id)
+	if err != nil {
+		dvlog.PrintError(err)
+		return ""
+	}
+	return secrets.RegistrationToken
+}
+
+func getPairingCode(id string) string {
+	secrets, err := readTvpcSecrets(id)
+	if err != nil {
+		dvlog.PrintError(err)
+		return ""
+	}
+	return secrets.PairingCode
+}
+
+// savePairingToken keeps the token the admin took from the log of the player without keys,
+// an empty token removes it
+func savePairingToken(id string, token string) error {
+	return updateTvpcSecrets(id, func(secrets *tvpcSecrets) {
+		secrets.PairingToken = token
+	})
+}
+
+// getPairingKey returns the key made of the pairing token of the tv pc or nil without token
+func getPairingKey(id string) *PlayerKey {
+	secrets, err := readTvpcSecrets(id)
+	if err != nil {
+		dvlog.PrintError(err)
+		return nil
+	}
+	if secrets.PairingToken == "" {
+		return nil
+	}
+	return &PlayerKey{Id: PairingKeyId, Secret: secrets.PairingToken}
+}
+
+var tvpcConditionsForSecrets = []string{
+	"DEFAULT",
+}
+
+// the fields are taken from the record with the id only, so they are removed
+var tvpcFieldsForSecrets = []string{
+	"^secret,registrationToken,pairingCode",
+}
+
+var taskFieldsForSecrets = []string{
+	"^secret,nextSecret",
+}
+
+// moveSecrets keeps the keys, the token and the pairing code of the record in tvpcsecret
+// and cleans them in the record
+func moveSecrets(table string, record *dvevaluation.DvVariable, keyFields [][2]string, fields []string) (bool, error) {
+	id := record.ReadSimpleChildValue("id")
+	token, code := "", ""
+	if table == tvpcDbName {
+		token, code = record.ReadSimpleChildValue("registrationToken"), record.ReadSimpleChildValue("pairingCode")
+	}
+	moved := token != "" || code != ""
+	for _, f := range keyFields {
+		keyId, secret := record.ReadSimpleChildValue(f[0]), record.ReadSimpleChildValue(f[1])
+		if secret == "" {
+			continue
+		}
+		moved = true
+		if keyId != "" && getTvpcKey(id, keyId) == nil {
+			if err := saveTvpcKey(id, &PlayerKey{Id: keyId, Secret: secret}); err != nil {
+				return false, err
+			}
+		}
+	}
+	if !moved || id == "" {
+		return false, nil
+	}
+	if token != "" || code != "" {
+		if err := saveRegistrationSecrets(id, token, code); err != nil {
+			return false, err
+		}
+	}
+	row, err := dvevaluation.AnyStructToDvVariable(map[string]string{"id": id})
+	if err != nil {
+		return false, err
+	}
+	_, err = updateRecordByConditions(table, row, tvpcConditionsForSecrets, fields)
+	return err == nil, err
+}
+
+// migrateTvpcSecrets moves the secrets saved in the records of tvpc and task to tvpcsecret
+func migrateTvpcSecrets() error {
+	migrated := 0
+	for _, table := range []string{tvpcDbName, taskDbName} {
+		records, err := dvdbmanager.RecordReadAll(table)
+		if err != nil {
+			return err
+		}
+		if records == nil {
+			continue
+		}
+		keyFields, fields := [][2]string{{"keyId", "secret"}}, tvpcFieldsForSecrets
+		if table == taskDbName {
+			keyFields, fields = [][2]string{{"keyId", "secret"}, {"nextKeyId", "nextSecret"}}, taskFieldsForSecrets
+		}
+		for _, record := range records.Fields {
+			if record == nil {
+				continue
+			}
+			moved, err := moveSecrets(table, record, keyFields, fields)
+			if err != nil {
+				return err
+			}
+			if moved {
+				migrated++
+			}
+		}
+	}
+	if migrated != 0 {
+		dvlog.PrintfFullOnly("Secrets of %d records are moved to %s", migrated, tvpcSecretDbName)
+	}
+	return nil
+}
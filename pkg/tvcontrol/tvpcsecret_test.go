@@ -0,0 +1,67 @@
+/***********************************************************************
+TV Controller
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvcontrol
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/Dobryvechir/microcore/pkg/dvdbmanager"
+	"github.com/Dobryvechir/microcore/pkg/dvevaluation"
+)
+
+func TestTvpcKeysAreLimited(t *testing.T) {
+	defer dvdbmanager.RecordDelete(tvpcSecretDbName, "9701")
+	for i := 1; i <= maxTvpcKeys+2; i++ {
+		key, err := NewPlayerKey(strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = saveTvpcKey("9701", key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if getTvpcKey("9701", "1") != nil || getTvpcKey("9701", "3") == nil || getTvpcKey("9701", "") != nil {
+		t.Errorf("only the last %d keys must be kept", maxTvpcKeys)
+	}
+}
+
+func TestSecretsAreMovedFromRecords(t *testing.T) {
+	tvpc, err := dvevaluation.AnyStructToDvVariable(map[string]string{"id": "9702", "name": "old", "keyId": "2", "secret": "s2", "registrationToken": "token", "pairingCode": "123456"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = updateRecordByConditions(tvpcDbName, tvpc, tvpcConditionsForNew, tvpcFieldsForNew); err != nil {
+		t.Fatal(err)
+	}
+	defer dvdbmanager.RecordDelete(tvpcDbName, "9702")
+	defer dvdbmanager.RecordDelete(tvpcSecretDbName, "9702")
+	task, err := dvevaluation.AnyStructToDvVariable(map[string]string{"id": "9702", "name": "old", "keyId": "1", "secret": "s1", "nextKeyId": "2", "nextSecret": "s2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = updateRecordByConditions(taskDbName, task, []string{"NEW"}, []string{""}); err != nil {
+		t.Fatal(err)
+	}
+	defer dvdbmanager.RecordDelete(taskDbName, "9702")
+
+	if err = migrateTvpcSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{tvpcDbName, taskDbName} {
+		row, err := dvdbmanager.RecordReadOne(table, "9702")
+		if err != nil || row.FindIndex("secret") >= 0 || row.FindIndex("nextSecret") >= 0 ||
+			row.FindIndex("registrationToken") >= 0 || row.FindIndex("pairingCode") >= 0 || row.ReadSimpleChildValue("keyId") == "" || row.ReadSimpleChildValue("name") != "old" {
+			t.Errorf("%s must keep only the key id: %v %v", table, row, err)
+		}
+	}
+	if key := getTvpcKey("9702", "1"); key == nil || key.Secret != "s1" {
+		t.Errorf("delivered key must be moved, got %v", key)
+	}
+	if key := getTvpcKey("9702", "2"); key == nil || key.Secret != "s2" || getRegistrationToken("9702") != "token" || getPairingCode("9702") != "123456" {
+		t.Errorf("key and token of the tvpc must be moved, got %v", key)
+	}
+}
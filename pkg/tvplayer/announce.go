@@ -0,0 +1,58 @@
+/***********************************************************************
+TV Player
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvplayer
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+)
+
+// Announce sends the announcement to the udp address target, like 255.255.255.255:8087,
+// signed by the current key of the player if it has one
+func (p *Player) Announce(target string, a tvcontrol.Announcement) error {
+	a.Service = tvcontrol.DiscoveryService
+	a.Signature = ""
+	p.mu.Lock()
+	var key *tvcontrol.PlayerKey
+	if len(p.keys) != 0 {
+		key = p.keys[0]
+	}
+	p.mu.Unlock()
+	if key != nil {
+		tvcontrol.SignAnnouncement(&a, key, time.Now())
+	}
+	data, err := json.Marshal(&a)
+	if err != nil {
+		return err
+	}
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write(data)
+	return err
+}
+
+// AnnounceEvery repeats the announcement every interval, so the server finds the player
+// again after its address changes
+func (p *Player) AnnounceEvery(target string, a tvcontrol.Announcement, interval time.Duration) {
+	for {
+		err := p.Announce(target, a)
+		if err != nil && p.LogLevel {
+			dvlog.PrintError(err)
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin
+
+/***********************************************************************
+TV Player
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvplayer
+
+import "syscall"
+
+// getFreeDisk returns the bytes available to the player in the folder, -1 if unknown
+func getFreeDisk(folder string) int64 {
+	var stat syscall.Statfs_t
+	if syscall.Statfs(folder, &stat) != nil {
+		return -1
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize)
+}
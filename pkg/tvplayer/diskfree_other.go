@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+/***********************************************************************
+TV Player
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvplayer
+
+// getFreeDisk is unknown where statfs is not available
+func getFreeDisk(folder string) int64 {
+	return -1
+}
@@ -0,0 +1,92 @@
+/***********************************************************************
+TV Player
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvplayer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+)
+
+// the temperature of the first thermal zone of linux in millidegrees
+const thermalZoneFile = "/sys/class/thermal/thermal_zone0/temp"
+
+// Heartbeat returns the current state of the player for the server
+func (p *Player) Heartbeat() *tvcontrol.Heartbeat {
+	heartbeat := &tvcontrol.Heartbeat{
+		Uptime:      int64(time.Since(p.started) / time.Second),
+		FreeDisk:    getFreeDisk(p.Root),
+		Temperature: readTemperature(),
+		Encodings:   tvcontrol.SupportedEncodings,
+	}
+	if p.StatusInfo != nil {
+		if relay, ok := p.StatusInfo()["relay"].(*tvcontrol.RelayProgress); ok {
+			heartbeat.Relay = relay
+		}
+	}
+	if p.HeartbeatInfo != nil {
+		p.HeartbeatInfo(heartbeat)
+	}
+	return heartbeat
+}
+
+func readTemperature() float64 {
+	data, err := os.ReadFile(thermalZoneFile)
+	if err != nil {
+		return 0
+	}
+	n, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil {
+		return 0
+	}
+	return n / 1000
+}
+
+// SendHeartbeat posts the heartbeat of tvpc id to the server and returns the interval
+// the server expects the next one after
+func (p *Player) SendHeartbeat(client *http.Client, server string, id string) (time.Duration, error) {
+	if !strings.HasSuffix(server, "/") {
+		server += "/"
+	}
+	body, err := json.Marshal(p.Heartbeat())
+	if err != nil {
+		return 0, err
+	}
+	data, _, err := p.signedRequest(client, http.MethodPost, server+pullApi+url.PathEscape(id)+"/heartbeat", body)
+	if err != nil {
+		return 0, err
+	}
+	answer := &struct {
+		Interval int `json:"interval"`
+	}{}
+	err = json.Unmarshal(data, answer)
+	return time.Duration(answer.Interval) * time.Second, err
+}
+
+// HeartbeatEvery sends the heartbeats at the interval given by the server or at interval
+// until the server gives one; an empty id is taken from the registration of the player
+func (p *Player) HeartbeatEvery(client *http.Client, server string, id string, interval time.Duration) {
+	for {
+		tvpcId := p.getTvpcId(id)
+		if tvpcId != "" {
+			next, err := p.SendHeartbeat(client, server, tvpcId)
+			if err != nil && p.LogLevel {
+				dvlog.PrintError(err)
+			}
+			if next > 0 {
+				interval = next
+			}
+		}
+		time.Sleep(interval)
+	}
+}
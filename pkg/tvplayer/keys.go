@@ -0,0 +1,188 @@
+/***********************************************************************
+TV Player
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvplayer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+)
+
+const keysFileName = "keys.json"
+
+// the pairing token of a player without keys, it is removed with the first key
+const pairingFileName = "pairing.txt"
+
+// the largest signed body, a chunk is much smaller
+const maxSignedBody = 256 << 20
+
+func (p *Player) loadKeys() error {
+	data, err := os.ReadFile(filepath.Join(p.Root, keysFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	var keys []*tvcontrol.PlayerKey
+	err = json.Unmarshal(data, &keys)
+	if err != nil {
+		return err
+	}
+	p.keys = keys
+	return nil
+}
+
+// loadPairingToken reads the pairing token of a player without keys or makes a new one
+func (p *Player) loadPairingToken() error {
+	if len(p.keys) != 0 {
+		return nil
+	}
+	name := filepath.Join(p.Root, pairingFileName)
+	data, err := os.ReadFile(name)
+	if err == nil && len(bytes.TrimSpace(data)) != 0 {
+		p.pairing = string(bytes.TrimSpace(data))
+		return nil
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	token, err := tvcontrol.NewPairingToken()
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(name, []byte(token), 0600)
+	if err != nil {
+		return err
+	}
+	p.pairing = token
+	return nil
+}
+
+// PairingToken returns the token the admin gives to the server by POST /api/v1/tvpc/{id}/key
+// {"pairingToken"}, so the first key reaches this player only; it is empty once the player has a key
+func (p *Player) PairingToken() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pairing
+}
+
+// getPairingKeys returns the key made of the pairing token, the caller holds the lock
+func (p *Player) getPairingKeys() []*tvcontrol.PlayerKey {
+	if p.pairing == "" {
+		return nil
+	}
+	return []*tvcontrol.PlayerKey{{Id: tvcontrol.PairingKeyId, Secret: p.pairing}}
+}
+
+func (p *Player) saveKeys(keys []*tvcontrol.PlayerKey) error {
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(p.Root, keysFileName)
+	err = os.WriteFile(name+partialSuffix, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+partialSuffix, name)
+}
+
+// KeyId returns the id of the current key or an empty string when the player has no key
+func (p *Player) KeyId() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.keys) == 0 {
+		return ""
+	}
+	return p.keys[0].Id
+}
+
+// CheckSignature verifies the request by the keys of the player and gives the read body
+// back to the request; a player without keys takes its first key signed by its pairing token
+// only and the other requests unsigned unless RequireSignature
+func (p *Player) CheckSignature(r *http.Request) error {
+	p.mu.Lock()
+	keys := p.keys
+	paired := len(keys) != 0
+	if !paired {
+		keys = p.getPairingKeys()
+	}
+	p.mu.Unlock()
+	if !paired && !p.RequireSignature && strings.TrimPrefix(r.URL.Path, "/") != keyUrl {
+		return nil
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxSignedBody))
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	return tvcontrol.VerifySignature(keys, r.Header.Get(tvcontrol.SignatureHeader), r.Method, r.URL.Path, data, time.Now())
+}
+
+// handleKey opens the new key wrapped by the current or the pairing key and keeps it with
+// the current one, the requests signed by the previous key are still accepted until the next rotation
+func (p *Player) handleKey(w http.ResponseWriter, r *http.Request) {
+	wrapped := &tvcontrol.WrappedKey{}
+	err := json.NewDecoder(r.Body).Decode(wrapped)
+	if err != nil || wrapped.Id == "" || wrapped.Sealed == "" {
+		writeError(w, http.StatusBadRequest, errors.New("key must have id and sealed secret"))
+		return
+	}
+	p.mu.Lock()
+	key, err := tvcontrol.UnwrapKey(wrapped, append(p.getPairingKeys(), p.keys...))
+	if err != nil {
+		p.mu.Unlock()
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	err = p.setKey(key)
+	left := p.getLeftFiles()
+	p.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, left)
+}
+
+// setKey makes key the current one and keeps the previous key, p.mu must be locked
+func (p *Player) setKey(key *tvcontrol.PlayerKey) error {
+	if len(p.keys) != 0 && p.keys[0].Id == key.Id && p.keys[0].Secret == key.Secret {
+		return nil
+	}
+	keys := []*tvcontrol.PlayerKey{key}
+	if len(p.keys) != 0 && p.keys[0].Id != key.Id {
+		keys = append(keys, p.keys[0])
+	}
+	err := p.saveKeys(keys)
+	if err == nil {
+		p.keys = keys
+		p.removePairingToken()
+	}
+	return err
+}
+
+// removePairingToken forgets the token once the first key is taken, the caller holds the lock
+func (p *Player) removePairingToken() {
+	if p.pairing == "" {
+		return
+	}
+	p.pairing = ""
+	err := os.Remove(filepath.Join(p.Root, pairingFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		dvlog.PrintError(err)
+	}
+}
@@ -0,0 +1,161 @@
+/***********************************************************************
+TV Player
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvplayer
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+)
+
+// files are pulled from peers in pieces of this size, each piece is written like an upload chunk
+const peerChunkSize = 1 << 20
+
+// a pass over the peers without any new bytes is repeated after this delay
+const defaultPeerRetryDelay = 5 * time.Second
+
+var peerClient = &http.Client{Timeout: 10 * time.Minute}
+
+var errPeerStopped = errors.New("config changed or file received by other means")
+
+// startPeerPulling pulls the missing files from the peers of the config in background,
+// the server keeps uploading whatever the peers cannot supply
+func (p *Player) startPeerPulling(config *tvcontrol.TvConfig) {
+	if len(config.Peer) == 0 {
+		return
+	}
+	p.mu.Lock()
+	if p.pulling {
+		p.mu.Unlock()
+		return
+	}
+	p.pulling = true
+	p.mu.Unlock()
+	go p.pullFromPeers()
+}
+
+func (p *Player) pullFromPeers() {
+	for {
+		p.mu.Lock()
+		config := p.config
+		left := p.getLeftFiles()
+		if config == nil || len(config.Peer) == 0 || len(left) == 0 {
+			p.pulling = false
+			p.mu.Unlock()
+			return
+		}
+		p.mu.Unlock()
+		progress := false
+		for name := range left {
+			for _, peer := range config.Peer {
+				n, err := p.pullFile(config, peer, name)
+				if n > 0 {
+					progress = true
+				}
+				if p.LogLevel && err != nil {
+					dvlog.PrintfFullOnly("Peer %s did not give %s: %v", peer, name, err)
+				}
+				if err == nil || err == errPeerStopped {
+					break
+				}
+			}
+		}
+		if !progress {
+			delay := p.PeerRetryDelay
+			if delay <= 0 {
+				delay = defaultPeerRetryDelay
+			}
+			time.Sleep(delay)
+		}
+	}
+}
+
+// pullFile continues the file from its received offset with GET media/{name} of the peer
+// and returns the amount of received bytes
+func (p *Player) pullFile(config *tvcontrol.TvConfig, peer string, name string) (int64, error) {
+	p.mu.Lock()
+	offset, complete := p.getReceivedOffset(name)
+	p.mu.Unlock()
+	total := getFileSize(name)
+	if complete || offset >= total {
+		return 0, errPeerStopped
+	}
+	req, err := http.NewRequest(http.MethodGet, peer+mediaUrl+name, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(offset, 10)+"-")
+	res, err := peerClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		_, err = io.CopyN(io.Discard, res.Body, offset)
+		if err != nil {
+			return 0, err
+		}
+	default:
+		return 0, errors.New("peer answered " + strconv.Itoa(res.StatusCode))
+	}
+	received := int64(0)
+	buf := make([]byte, peerChunkSize)
+	for offset < total {
+		n, err := io.ReadFull(res.Body, buf[:min(int64(len(buf)), total-offset)])
+		if err != nil {
+			return received, err
+		}
+		current, err := p.writeFetchedChunk(config, name, offset, buf[:n], total, "peer "+peer)
+		if err != nil {
+			return received, err
+		}
+		received += int64(n)
+		offset = current
+	}
+	return received, nil
+}
+
+// writeFetchedChunk writes the piece fetched by the player from source only if the config
+// is the same and nobody else wrote the file meanwhile
+func (p *Player) writeFetchedChunk(config *tvcontrol.TvConfig, name string, offset int64, data []byte, total int64, source string) (int64, error) {
+	p.mu.Lock()
+	if p.config != config {
+		p.mu.Unlock()
+		return 0, errPeerStopped
+	}
+	current, complete := p.getReceivedOffset(name)
+	if complete || current != offset {
+		p.mu.Unlock()
+		return 0, errPeerStopped
+	}
+	hash := ""
+	for i, file := range config.File {
+		if file == name && i < len(config.Hash) {
+			hash = config.Hash[i]
+		}
+	}
+	current, err := p.writeChunk(name, offset, data, total, hash)
+	if err != nil {
+		p.mu.Unlock()
+		return 0, err
+	}
+	left := p.getLeftFiles()
+	p.mu.Unlock()
+	if p.LogLevel {
+		dvlog.PrintfFullOnly("Player received %s %d-%d of %d from %s", name, offset, current, total, source)
+	}
+	if len(left) == 0 {
+		p.notify(config, true)
+	}
+	return current, nil
+}
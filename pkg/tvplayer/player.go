@@ -0,0 +1,390 @@
+/***********************************************************************
+TV Player
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+// Package tvplayer implements the receiving side of the tvcontrol delivery
+// protocol:
+//
+//	GET  status                            any 2xx answer means the player is alive,
+//	                                       encodings lists the accepted Content-Encoding
+//	POST config                            body is TvConfig, answer is the map of left files
+//	POST upload/{index}_{offset}_{length}  body is a chunk, answer is the map of left files
+//	POST key                               body is {"id","secret"} of the key of the next
+//	                                       signatures, answer is the map of left files
+//
+// The map of left files has the file name as a key and the amount of already
+// received bytes as a value, complete files are not listed. Bodies may be
+// compressed, the length and the offsets of upload are always counted in
+// uncompressed bytes. A config with peer urls makes the player pull its
+// missing files from GET media/{name} of these peers as well. A player with a key
+// accepts the POST requests only with the X-Tv-Signature of its key, the first key
+// is accepted unsigned.
+package tvplayer
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+)
+
+const (
+	statusUrl  = "status"
+	configUrl  = "config"
+	uploadUrl  = "upload/"
+	currentUrl = "current"
+	mediaUrl   = "media/"
+	keyUrl     = "key"
+)
+
+type Player struct {
+	Root     string
+	LogLevel bool
+	// OnChange is called after a new config is accepted and after the last file is received
+	OnChange func(config *tvcontrol.TvConfig, ready bool)
+	// StatusInfo adds its fields to the status answer
+	StatusInfo func() map[string]interface{}
+	// HeartbeatInfo fills the fields of the heartbeat known to the application, like the playing file
+	HeartbeatInfo func(heartbeat *tvcontrol.Heartbeat)
+	// PeerRetryDelay is the pause between attempts to pull files from the peers of the config
+	PeerRetryDelay time.Duration
+	// RequireSignature rejects unsigned requests even before the first key is received
+	RequireSignature bool
+	mu               sync.Mutex
+	config           *tvcontrol.TvConfig
+	accepted         bool
+	pulling          bool
+	keys             []*tvcontrol.PlayerKey
+	pairing          string
+	pairingCode      string
+	started          time.Time
+}
+
+type PlayerState struct {
+	Config  *tvcontrol.TvConfig `json:"config"`
+	Ready   bool                `json:"ready"`
+	Missing map[string]int64    `json:"missing"`
+	// PairingCode is shown on the screen until an admin approves the registered tvpc
+	PairingCode string `json:"pairingCode,omitempty"`
+}
+
+func NewPlayer(root string) (*Player, error) {
+	p := &Player{Root: root, started: time.Now()}
+	err := p.ensureFolders()
+	if err != nil {
+		return nil, err
+	}
+	err = p.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	err = p.loadKeys()
+	if err != nil {
+		return nil, err
+	}
+	err = p.loadPairingToken()
+	if err != nil {
+		return nil, err
+	}
+	if p.config != nil {
+		p.startPeerPulling(p.config)
+	}
+	return p, nil
+}
+
+// Config returns the last accepted config or nil if none was received yet
+func (p *Player) Config() *tvcontrol.TvConfig {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.config
+}
+
+func (p *Player) State() *PlayerState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	left := p.getLeftFiles()
+	return &PlayerState{Config: p.config, Ready: p.config != nil && len(left) == 0, Missing: left, PairingCode: p.pairingCode}
+}
+
+func (p *Player) getLeftFiles() map[string]int64 {
+	res := make(map[string]int64)
+	if p.config == nil {
+		return res
+	}
+	for _, name := range p.config.File {
+		total := getFileSize(name)
+		if total <= 0 || !isSafeFileName(name) {
+			continue
+		}
+		current, complete := p.getReceivedOffset(name)
+		if complete || current >= total {
+			continue
+		}
+		res[name] = current
+	}
+	return res
+}
+
+func (p *Player) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		err := p.CheckSignature(r)
+		if err != nil {
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+	}
+	p.ServeVerified(w, r)
+}
+
+// ServeVerified answers the request whose signature is already checked by CheckSignature
+func (p *Player) ServeVerified(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case path == statusUrl && r.Method == http.MethodGet:
+		p.handleStatus(w)
+	case path == configUrl && r.Method == http.MethodPost:
+		p.handleConfig(w, r)
+	case strings.HasPrefix(path, uploadUrl) && r.Method == http.MethodPost:
+		p.handleUpload(w, r, path[len(uploadUrl):])
+	case path == keyUrl && r.Method == http.MethodPost:
+		p.handleKey(w, r)
+	case path == currentUrl && r.Method == http.MethodGet:
+		writeJson(w, http.StatusOK, p.State())
+	case strings.HasPrefix(path, mediaUrl) && r.Method == http.MethodGet:
+		p.handleMedia(w, r, path[len(mediaUrl):])
+	default:
+		writeError(w, http.StatusNotFound, errors.New("unknown request "+r.Method+" "+path))
+	}
+}
+
+func (p *Player) handleStatus(w http.ResponseWriter) {
+	state := p.State()
+	files := 0
+	if state.Config != nil {
+		files = len(state.Config.File)
+	}
+	status := map[string]interface{}{"status": "UP", "files": files, "ready": state.Ready, "encodings": tvcontrol.SupportedEncodings}
+	if state.PairingCode != "" {
+		status["pairingCode"] = state.PairingCode
+	}
+	if p.StatusInfo != nil {
+		for k, v := range p.StatusInfo() {
+			status[k] = v
+		}
+	}
+	writeJson(w, http.StatusOK, status)
+}
+
+func (p *Player) handleConfig(w http.ResponseWriter, r *http.Request) {
+	body, err := tvcontrol.OpenEncodedBody(r.Body, r.Header.Get("Content-Encoding"))
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	defer body.Close()
+	config := &tvcontrol.TvConfig{}
+	err = json.NewDecoder(body).Decode(config)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	err = validateConfig(config)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	left, err := p.acceptConfig(config)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, http.StatusOK, left)
+}
+
+func validateConfig(config *tvcontrol.TvConfig) error {
+	if len(config.File) == 0 || len(config.File) != len(config.Duration) {
+		return errors.New("config must have the same non-zero amount of files and durations")
+	}
+	if len(config.Hash) != 0 && len(config.Hash) != len(config.File) {
+		return errors.New("config must have a hash for every file")
+	}
+	for _, name := range config.File {
+		if !isSafeFileName(name) {
+			return errors.New("incorrect file name " + name)
+		}
+	}
+	return nil
+}
+
+// acceptConfig saves the config, starts pulling from its peers and returns the left files;
+// the same config sent again, as the server does while it waits for the peers, only answers the left files
+func (p *Player) acceptConfig(config *tvcontrol.TvConfig) (map[string]int64, error) {
+	p.mu.Lock()
+	if p.accepted && reflect.DeepEqual(p.config, config) {
+		left := p.getLeftFiles()
+		p.mu.Unlock()
+		if len(left) != 0 {
+			p.startPeerPulling(config)
+		}
+		return left, nil
+	}
+	err := p.saveConfig(config)
+	if err != nil {
+		p.mu.Unlock()
+		return nil, err
+	}
+	p.config = config
+	p.accepted = true
+	left := p.getLeftFiles()
+	p.mu.Unlock()
+	if p.LogLevel {
+		dvlog.PrintfFullOnly("Player received config with %d files, %d left", len(config.File), len(left))
+	}
+	p.notify(config, len(left) == 0)
+	if len(left) != 0 {
+		p.startPeerPulling(config)
+	}
+	return left, nil
+}
+
+func parseUploadParams(s string) (index int, offset int64, length int, err error) {
+	params := strings.Split(s, "_")
+	if len(params) != 3 {
+		err = errors.New("upload must be in format upload/{index}_{offset}_{length}: " + s)
+		return
+	}
+	index, err = strconv.Atoi(params[0])
+	if err != nil {
+		return
+	}
+	offset, err = strconv.ParseInt(params[1], 10, 64)
+	if err != nil {
+		return
+	}
+	length, err = strconv.Atoi(params[2])
+	if err == nil && (index < 0 || offset < 0 || length <= 0) {
+		err = errors.New("negative or zero upload parameters " + s)
+	}
+	return
+}
+
+func (p *Player) handleUpload(w http.ResponseWriter, r *http.Request, params string) {
+	index, offset, length, err := parseUploadParams(params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	body, err := tvcontrol.OpenEncodedBody(r.Body, r.Header.Get("Content-Encoding"))
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	defer body.Close()
+	data, err := io.ReadAll(io.LimitReader(body, int64(length)+1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(data) != length {
+		writeError(w, http.StatusBadRequest, errors.New("body has "+strconv.Itoa(len(data))+" bytes instead of "+strconv.Itoa(length)))
+		return
+	}
+	digest := r.Header.Get(tvcontrol.ChunkDigestHeader)
+	if digest != "" && !strings.EqualFold(digest, tvcontrol.CalculateChunkDigest(data)) {
+		writeChecksumError(w, tvcontrol.MismatchChunk, "chunk "+params+" does not match its digest")
+		return
+	}
+	p.mu.Lock()
+	config := p.config
+	if config == nil || index >= len(config.File) {
+		p.mu.Unlock()
+		writeError(w, http.StatusConflict, errors.New("file index "+strconv.Itoa(index)+" is not in the current config"))
+		return
+	}
+	name := config.File[index]
+	hash := ""
+	if index < len(config.Hash) {
+		hash = config.Hash[index]
+	}
+	total := getFileSize(name)
+	current, complete := p.getReceivedOffset(name)
+	switch {
+	case complete:
+		err = nil
+	case offset > current:
+		err = errors.New("gap in " + name + ": received " + strconv.FormatInt(current, 10) + " but offset is " + strconv.FormatInt(offset, 10))
+	case offset+int64(length) > total:
+		err = errors.New("chunk exceeds size of " + name)
+	default:
+		current, err = p.writeChunk(name, offset, data, total, hash)
+	}
+	if err == errFileHashMismatch {
+		p.mu.Unlock()
+		writeChecksumError(w, tvcontrol.MismatchFile, name+" does not match its hash, it must be sent again")
+		return
+	}
+	if err != nil {
+		p.mu.Unlock()
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+	left := p.getLeftFiles()
+	p.mu.Unlock()
+	if p.LogLevel {
+		dvlog.PrintfFullOnly("Player received %s %d-%d of %d", name, offset, current, total)
+	}
+	if len(left) == 0 && !complete {
+		p.notify(config, true)
+	}
+	writeJson(w, http.StatusOK, left)
+}
+
+func (p *Player) handleMedia(w http.ResponseWriter, r *http.Request, name string) {
+	if !isSafeFileName(name) {
+		writeError(w, http.StatusBadRequest, errors.New("incorrect file name "+name))
+		return
+	}
+	http.ServeFile(w, r, p.MediaPath(name))
+}
+
+func (p *Player) notify(config *tvcontrol.TvConfig, ready bool) {
+	if p.OnChange != nil {
+		p.OnChange(config, ready)
+	}
+}
+
+func writeJson(w http.ResponseWriter, status int, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		data = []byte("{}")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
+func writeChecksumError(w http.ResponseWriter, mismatch string, message string) {
+	writeJson(w, http.StatusUnprocessableEntity, &tvcontrol.ChecksumError{Mismatch: mismatch, Message: message})
+}
+
+func writeBodyError(w http.ResponseWriter, err error) {
+	if err == tvcontrol.ErrUnsupportedEncoding {
+		writeError(w, http.StatusUnsupportedMediaType, err)
+		return
+	}
+	writeError(w, http.StatusBadRequest, err)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
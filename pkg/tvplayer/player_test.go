@@ -0,0 +1,308 @@
+/***********************************************************************
+TV Player
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvplayer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+)
+
+func post(t *testing.T, p *Player, path string, body string) (int, map[string]int64) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+	res := make(map[string]int64)
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, res
+}
+
+func TestPlayerReceivesChunksAndResumes(t *testing.T) {
+	root := t.TempDir()
+	p, err := NewPlayer(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, left := post(t, p, "/config", `{"file":["i1_0-10.png","v2_0-4.mp4"],"duration":[5,6]}`)
+	if code != http.StatusOK || !reflect.DeepEqual(left, map[string]int64{"i1_0-10.png": 0, "v2_0-4.mp4": 0}) {
+		t.Fatalf("config answer %d %v", code, left)
+	}
+	code, left = post(t, p, "/upload/0_0_6", "abcdef")
+	if code != http.StatusOK || left["i1_0-10.png"] != 6 {
+		t.Fatalf("first chunk answer %d %v", code, left)
+	}
+	if code, _ = post(t, p, "/upload/0_8_2", "ij"); code != http.StatusConflict {
+		t.Errorf("gap must be rejected, got %d", code)
+	}
+	if code, _ = post(t, p, "/upload/0_6_4", "gh"); code != http.StatusBadRequest {
+		t.Errorf("short body must be rejected, got %d", code)
+	}
+
+	// a restarted player continues from the stored partial file
+	p, err = NewPlayer(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, left = post(t, p, "/config", `{"file":["i1_0-10.png","v2_0-4.mp4"],"duration":[5,6]}`)
+	if code != http.StatusOK || left["i1_0-10.png"] != 6 {
+		t.Fatalf("resume answer %d %v", code, left)
+	}
+	ready := false
+	p.OnChange = func(config *tvcontrol.TvConfig, r bool) { ready = r }
+	post(t, p, "/upload/0_6_4", "ghij")
+	code, left = post(t, p, "/upload/1_0_4", "wxyz")
+	if code != http.StatusOK || len(left) != 0 || !ready || !p.State().Ready {
+		t.Fatalf("last chunk answer %d %v ready %v", code, left, ready)
+	}
+	data, err := os.ReadFile(p.MediaPath("i1_0-10.png"))
+	if err != nil || string(data) != "abcdefghij" {
+		t.Errorf("stored %q %v", data, err)
+	}
+}
+
+func TestPlayerKeepsSameConfig(t *testing.T) {
+	p, err := NewPlayer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := 0
+	p.OnChange = func(config *tvcontrol.TvConfig, r bool) { changes++ }
+	config := `{"file":["i1_0-10.png"],"duration":[5]}`
+	post(t, p, "/config", config)
+	post(t, p, "/upload/0_0_4", "abcd")
+	code, left := post(t, p, "/config", config)
+	if code != http.StatusOK || left["i1_0-10.png"] != 4 || changes != 1 {
+		t.Fatalf("same config must only answer the left files, got %d %v after %d changes", code, left, changes)
+	}
+	post(t, p, "/config", `{"file":["i1_0-10.png"],"duration":[7]}`)
+	if changes != 2 || p.State().Config.Duration[0] != 7 {
+		t.Errorf("changed config must be accepted, got %d changes", changes)
+	}
+}
+
+func TestPlayerRejectsCorruptedContent(t *testing.T) {
+	p, err := NewPlayer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := tvcontrol.CalculateChunkDigest([]byte("abcd"))
+	code, _ := post(t, p, "/config", `{"file":["i1_0-4.png"],"duration":[5],"hash":["`+hash+`"]}`)
+	if code != http.StatusOK {
+		t.Fatalf("config answer %d", code)
+	}
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/upload/0_0_2", strings.NewReader("ab"))
+	req.Header.Set(tvcontrol.ChunkDigestHeader, tvcontrol.CalculateChunkDigest([]byte("xx")))
+	p.ServeHTTP(w, req)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), tvcontrol.MismatchChunk) {
+		t.Fatalf("wrong chunk digest answer %d %s", w.Code, w.Body.String())
+	}
+	post(t, p, "/upload/0_0_2", "ab")
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/upload/0_2_2", strings.NewReader("XY")))
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), tvcontrol.MismatchFile) {
+		t.Fatalf("wrong file hash answer %d %s", w.Code, w.Body.String())
+	}
+	if left := p.State().Missing; left["i1_0-4.png"] != 0 {
+		t.Errorf("wrong file must be received from the beginning, got %v", left)
+	}
+}
+
+func postEncoded(t *testing.T, p *Player, path string, body string, encoding string) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(body))
+	zw.Close()
+	req := httptest.NewRequest(http.MethodPost, path, &buf)
+	req.Header.Set("Content-Encoding", encoding)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	return w
+}
+
+func TestPlayerAcceptsCompressedBodies(t *testing.T) {
+	p, err := NewPlayer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	if !strings.Contains(w.Body.String(), `"encodings":["zstd","gzip"]`) {
+		t.Errorf("status must list encodings, got %s", w.Body.String())
+	}
+	if w = postEncoded(t, p, "/config", `{"file":["i1_0-6.png"],"duration":[5]}`, "gzip"); w.Code != http.StatusOK {
+		t.Fatalf("compressed config answer %d %s", w.Code, w.Body.String())
+	}
+	// the length in the url is the uncompressed one
+	if w = postEncoded(t, p, "/upload/0_0_6", "aaaaaa", "gzip"); w.Code != http.StatusOK || w.Body.String() != "{}" {
+		t.Fatalf("compressed chunk answer %d %s", w.Code, w.Body.String())
+	}
+	data, err := os.ReadFile(p.MediaPath("i1_0-6.png"))
+	if err != nil || string(data) != "aaaaaa" {
+		t.Errorf("stored %q %v", data, err)
+	}
+	if w = postEncoded(t, p, "/config", `{}`, "br"); w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("unknown encoding must be rejected with 415, got %d", w.Code)
+	}
+}
+
+func TestPlayerPullsFilesFromPeer(t *testing.T) {
+	seed, err := NewPlayer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedServer := httptest.NewServer(seed)
+	defer seedServer.Close()
+	hash := tvcontrol.CalculateChunkDigest([]byte("abcdefgh"))
+	config := `{"file":["i1_0-8.png","i2_0-2.png"],"duration":[5,6],"hash":["` + hash + `","` + tvcontrol.CalculateChunkDigest([]byte("xy")) + `"]`
+	post(t, seed, "/config", config+`}`)
+	post(t, seed, "/upload/0_0_8", "abcdefgh")
+
+	p, err := NewPlayer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.PeerRetryDelay = 10 * time.Millisecond
+	ready := make(chan bool, 1)
+	p.OnChange = func(config *tvcontrol.TvConfig, r bool) {
+		if r {
+			ready <- r
+		}
+	}
+	code, left := post(t, p, "/config", config+`,"peer":["`+seedServer.URL+`/"]}`)
+	if code != http.StatusOK || len(left) != 2 {
+		t.Fatalf("config answer %d %v", code, left)
+	}
+	// the seed has no second file yet, the server sends it
+	post(t, p, "/upload/1_0_2", "xy")
+	select {
+	case <-ready:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("file was not pulled from the peer, missing %v", p.State().Missing)
+	}
+	data, err := os.ReadFile(p.MediaPath("i1_0-8.png"))
+	if err != nil || string(data) != "abcdefgh" {
+		t.Errorf("pulled %q %v", data, err)
+	}
+}
+
+func postSigned(t *testing.T, p *Player, key *tvcontrol.PlayerKey, path string, body string, at time.Time) int {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set(tvcontrol.SignatureHeader, tvcontrol.SignRequest(key, http.MethodPost, path, []byte(body), at))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	return w.Code
+}
+
+// wrapKey returns the body of POST key with the key wrapped by the key by
+func wrapKey(t *testing.T, key *tvcontrol.PlayerKey, by *tvcontrol.PlayerKey) string {
+	t.Helper()
+	wrapped, err := tvcontrol.WrapKey(key, by)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestPlayerRequiresSignatureAfterKey(t *testing.T) {
+	root := t.TempDir()
+	p, err := NewPlayer(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := &tvcontrol.PlayerKey{Id: "1", Secret: "first"}
+	pairing := &tvcontrol.PlayerKey{Id: tvcontrol.PairingKeyId, Secret: p.PairingToken()}
+	if code, _ := post(t, p, "/key", wrapKey(t, first, pairing)); code != http.StatusUnauthorized || p.KeyId() != "" {
+		t.Fatalf("first key must not be accepted unsigned, got %d", code)
+	}
+	guessed := &tvcontrol.PlayerKey{Id: tvcontrol.PairingKeyId, Secret: "0123456789abcdef0123456789abcdef"}
+	if code := postSigned(t, p, guessed, "/key", wrapKey(t, first, guessed), time.Now()); code != http.StatusUnauthorized {
+		t.Errorf("first key signed by another pairing token must be rejected, got %d", code)
+	}
+	if code := postSigned(t, p, pairing, "/key", wrapKey(t, first, pairing), time.Now()); code != http.StatusOK || p.KeyId() != "1" {
+		t.Fatalf("first key signed by the pairing token must be accepted, got %d", code)
+	}
+	if p.PairingToken() != "" {
+		t.Error("pairing token must be removed with the first key")
+	}
+	config := `{"file":["i1_0-3.png"],"duration":[5]}`
+	if code, _ := post(t, p, "/config", config); code != http.StatusUnauthorized {
+		t.Errorf("unsigned config must be rejected, got %d", code)
+	}
+	if code := postSigned(t, p, &tvcontrol.PlayerKey{Id: "1", Secret: "guess"}, "/config", config, time.Now()); code != http.StatusUnauthorized {
+		t.Errorf("config with a wrong secret must be rejected, got %d", code)
+	}
+	if code := postSigned(t, p, first, "/config", config, time.Now().Add(-time.Hour)); code != http.StatusUnauthorized {
+		t.Errorf("old signature must be rejected, got %d", code)
+	}
+	if code := postSigned(t, p, first, "/config", config, time.Now()); code != http.StatusOK {
+		t.Fatalf("signed config must be accepted, got %d", code)
+	}
+	if code, _ := post(t, p, "/key", wrapKey(t, &tvcontrol.PlayerKey{Id: "9", Secret: "stolen"}, first)); code != http.StatusUnauthorized {
+		t.Errorf("unsigned key must not replace the key, got %d", code)
+	}
+	if code := postSigned(t, p, pairing, "/key", wrapKey(t, &tvcontrol.PlayerKey{Id: "9", Secret: "stolen"}, pairing), time.Now()); code != http.StatusUnauthorized {
+		t.Errorf("used pairing token must not replace the key, got %d", code)
+	}
+
+	// the rotated key is wrapped and signed by the current one, the previous key is still accepted
+	if code := postSigned(t, p, first, "/key", wrapKey(t, &tvcontrol.PlayerKey{Id: "2", Secret: "second"}, first), time.Now()); code != http.StatusOK {
+		t.Fatalf("signed rotation must be accepted, got %d", code)
+	}
+	p, err = NewPlayer(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.KeyId() != "2" {
+		t.Errorf("keys must be kept after restart, got %q", p.KeyId())
+	}
+	if code := postSigned(t, p, first, "/upload/0_0_3", "abc", time.Now()); code != http.StatusOK {
+		t.Errorf("chunk signed by the previous key must be accepted, got %d", code)
+	}
+	if code := postSigned(t, p, &tvcontrol.PlayerKey{Id: "2", Secret: "second"}, "/upload/0_1_2", "bc", time.Now()); code != http.StatusOK {
+		t.Errorf("chunk signed by the new key must be accepted, got %d", code)
+	}
+}
+
+func TestPlayerHeartbeat(t *testing.T) {
+	p, err := NewPlayer(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	relay := &tvcontrol.RelayProgress{Version: "v1", Tvpcs: 2, Done: 1, TaskStatus: 500}
+	p.StatusInfo = func() map[string]interface{} {
+		return map[string]interface{}{"relay": relay}
+	}
+	p.HeartbeatInfo = func(heartbeat *tvcontrol.Heartbeat) {
+		heartbeat.Playing = "b.png"
+	}
+	heartbeat := p.Heartbeat()
+	if heartbeat.Playing != "b.png" || heartbeat.Relay != relay || heartbeat.Uptime < 0 || heartbeat.FreeDisk == 0 {
+		t.Errorf("heartbeat must have the state of the player: %+v", heartbeat)
+	}
+	if !reflect.DeepEqual(heartbeat.Encodings, tvcontrol.SupportedEncodings) {
+		t.Errorf("heartbeat must have the encodings of the status, got %v", heartbeat.Encodings)
+	}
+}
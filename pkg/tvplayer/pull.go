@@ -0,0 +1,178 @@
+/***********************************************************************
+TV Player
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvplayer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+)
+
+const pullApi = "api/v1/player/"
+
+// signedRequest sends the request to the server signed by the current key of the player or by
+// its pairing key without keys and returns the answer body
+func (p *Player) signedRequest(client *http.Client, method string, address string, body []byte) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(method, address, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	p.mu.Lock()
+	var key *tvcontrol.PlayerKey
+	if len(p.keys) != 0 {
+		key = p.keys[0]
+	} else if pairing := p.getPairingKeys(); len(pairing) != 0 {
+		key = pairing[0]
+	}
+	p.mu.Unlock()
+	if key != nil {
+		req.Header.Set(tvcontrol.SignatureHeader, tvcontrol.SignRequest(key, method, tvcontrol.GetSignedPath(req.URL), body, time.Now()))
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if res.StatusCode >= 300 {
+		return nil, nil, errors.New(strconv.Itoa(res.StatusCode) + " " + method + " " + req.URL.Path + " " + string(data))
+	}
+	return data, res.Header, nil
+}
+
+// Pull asks the server for the task of tvpc id, takes its key and config, downloads the left
+// files and reports the progress; it returns true when the player has all files of the config
+func (p *Player) Pull(client *http.Client, server string, id string) (bool, error) {
+	if !strings.HasSuffix(server, "/") {
+		server += "/"
+	}
+	base := server + pullApi + url.PathEscape(id) + "/"
+	data, _, err := p.signedRequest(client, http.MethodGet, base+"task", nil)
+	if err != nil {
+		return false, err
+	}
+	task := &tvcontrol.PullTask{}
+	err = json.Unmarshal(data, task)
+	if err != nil {
+		return false, err
+	}
+	if task.Key != nil && task.Key.Id != "" {
+		p.mu.Lock()
+		key, err := tvcontrol.UnwrapKey(task.Key, append(p.getPairingKeys(), p.keys...))
+		if err == nil {
+			err = p.setKey(key)
+		}
+		p.mu.Unlock()
+		if err != nil {
+			return false, err
+		}
+	}
+	if task.Config == nil {
+		return false, nil
+	}
+	config := p.Config()
+	if !reflect.DeepEqual(config, task.Config) {
+		err = validateConfig(task.Config)
+		if err != nil {
+			return false, err
+		}
+		_, err = p.acceptConfig(task.Config)
+		if err != nil {
+			return false, err
+		}
+		config = task.Config
+	}
+	p.mu.Lock()
+	left := p.getLeftFiles()
+	p.mu.Unlock()
+	var fetchErr error
+	for name := range left {
+		fetchErr = p.pullServerFile(client, base, config, name)
+		if fetchErr != nil {
+			break
+		}
+	}
+	p.mu.Lock()
+	left = p.getLeftFiles()
+	p.mu.Unlock()
+	// the server knows already that the player has everything
+	if task.Phase == tvcontrol.PhaseDone && len(left) == 0 {
+		return true, nil
+	}
+	progress := &tvcontrol.PullProgress{PresentationId: task.PresentationId, PresentationVersion: task.PresentationVersion, Left: left}
+	data, err = json.Marshal(progress)
+	if err != nil {
+		return false, err
+	}
+	_, _, err = p.signedRequest(client, http.MethodPost, base+"progress", data)
+	if err == nil {
+		err = fetchErr
+	}
+	return len(left) == 0, err
+}
+
+// pullServerFile continues the file from its received offset with GET file/{name}?offset= of the server
+func (p *Player) pullServerFile(client *http.Client, base string, config *tvcontrol.TvConfig, name string) error {
+	total := getFileSize(name)
+	for {
+		p.mu.Lock()
+		offset, complete := p.getReceivedOffset(name)
+		p.mu.Unlock()
+		if complete || offset >= total {
+			return nil
+		}
+		data, header, err := p.signedRequest(client, http.MethodGet, base+"file/"+url.PathEscape(name)+"?offset="+strconv.FormatInt(offset, 10), nil)
+		if err != nil {
+			return err
+		}
+		if len(data) == 0 {
+			return errors.New("server gave nothing of " + name + " from " + strconv.FormatInt(offset, 10))
+		}
+		digest := header.Get(tvcontrol.ChunkDigestHeader)
+		if digest != "" && !strings.EqualFold(digest, tvcontrol.CalculateChunkDigest(data)) {
+			return errors.New("chunk of " + name + " from " + strconv.FormatInt(offset, 10) + " does not match its digest")
+		}
+		_, err = p.writeFetchedChunk(config, name, offset, data, total, "server")
+		// a peer may have written the same piece meanwhile, the file goes on from its new offset
+		if err == errPeerStopped && p.Config() == config {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// PullEvery repeats Pull every interval; an empty id is taken from the registration of the player
+// as soon as it is there
+func (p *Player) PullEvery(client *http.Client, server string, id string, interval time.Duration) {
+	for {
+		tvpcId := p.getTvpcId(id)
+		if tvpcId != "" {
+			_, err := p.Pull(client, server, tvpcId)
+			if err != nil && p.LogLevel {
+				dvlog.PrintError(err)
+			}
+		}
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,146 @@
+/***********************************************************************
+TV Player
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvplayer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+)
+
+const registrationFileName = "registration.json"
+const registerApi = "api/v1/tvpc/register"
+
+// registration keeps the tvpc id and the token of the first registration answer
+type registration struct {
+	Id    string `json:"id"`
+	Token string `json:"registrationToken"`
+}
+
+func (p *Player) loadRegistration() (*registration, error) {
+	data, err := os.ReadFile(filepath.Join(p.Root, registrationFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &registration{}, nil
+		}
+		return nil, err
+	}
+	res := &registration{}
+	err = json.Unmarshal(data, res)
+	return res, err
+}
+
+func (p *Player) saveRegistration(reg *registration) error {
+	data, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(p.Root, registrationFileName)
+	err = os.WriteFile(name+partialSuffix, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+partialSuffix, name)
+}
+
+// getTvpcId returns id or, when it is empty, the tvpc id of the registration
+func (p *Player) getTvpcId(id string) string {
+	if id != "" {
+		return id
+	}
+	reg, err := p.loadRegistration()
+	if err != nil {
+		dvlog.PrintError(err)
+		return ""
+	}
+	return reg.Id
+}
+
+// PairingCode returns the code to show on the screen while the tvpc waits for approval
+func (p *Player) PairingCode() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.pairingCode
+}
+
+// Register sends the player to POST api/v1/tvpc/register of server, the first answer creates
+// a pending tvpc; the answer after the approval has the key, which the player keeps
+func (p *Player) Register(client *http.Client, server string, reg *tvcontrol.TvpcRegistration) (*tvcontrol.TvpcRegistrationAnswer, error) {
+	saved, err := p.loadRegistration()
+	if err != nil {
+		return nil, err
+	}
+	request := *reg
+	request.RegistrationToken = saved.Token
+	data, err := json.Marshal(&request)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(server, "/") {
+		server += "/"
+	}
+	res, err := client.Post(server+registerApi, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	data, err = io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode >= 300 {
+		return nil, errors.New(strconv.Itoa(res.StatusCode) + " " + registerApi + " " + string(data))
+	}
+	answer := &tvcontrol.TvpcRegistrationAnswer{}
+	err = json.Unmarshal(data, answer)
+	if err != nil {
+		return nil, err
+	}
+	if answer.Error != "" {
+		return nil, errors.New(answer.Error)
+	}
+	if answer.RegistrationToken != "" && (answer.Id != saved.Id || answer.RegistrationToken != saved.Token) {
+		err = p.saveRegistration(&registration{Id: answer.Id, Token: answer.RegistrationToken})
+		if err != nil {
+			return nil, err
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pairingCode = answer.PairingCode
+	if answer.KeyId != "" && answer.Secret != "" {
+		err = p.setKey(&tvcontrol.PlayerKey{Id: answer.KeyId, Secret: answer.Secret})
+	}
+	return answer, err
+}
+
+// RegisterUntilApproved repeats the registration every delay until the player has the key
+// of its approved tvpc
+func (p *Player) RegisterUntilApproved(client *http.Client, server string, reg *tvcontrol.TvpcRegistration, delay time.Duration) {
+	for {
+		answer, err := p.Register(client, server, reg)
+		switch {
+		case err != nil:
+			dvlog.PrintError(err)
+		case answer.Status == tvcontrol.TvpcStatusPending:
+			dvlog.PrintfFullOnly("Tvpc %s waits for approval, pairing code %s", answer.Id, answer.PairingCode)
+		case answer.KeyId != "":
+			dvlog.PrintfFullOnly("Tvpc %s is approved", answer.Id)
+			return
+		}
+		time.Sleep(delay)
+	}
+}
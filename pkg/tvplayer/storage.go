@@ -0,0 +1,146 @@
+/***********************************************************************
+TV Player
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+package tvplayer
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+)
+
+const configFileName = "config.json"
+const mediaFolderName = "media"
+const partialSuffix = ".part"
+
+var errFileHashMismatch = errors.New("file hash mismatch")
+
+// getFileSize reads the size baked into the name by the server,
+// template: i583747_7721532218530737715-1071263.png
+func getFileSize(name string) int64 {
+	pos := strings.LastIndex(name, "-")
+	if pos < 0 {
+		return 0
+	}
+	s := name[pos+1:]
+	pos = strings.Index(s, ".")
+	if pos > 0 {
+		s = s[:pos]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+func isSafeFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\:")
+}
+
+func (p *Player) mediaFolder() string {
+	return filepath.Join(p.Root, mediaFolderName)
+}
+
+func (p *Player) MediaPath(name string) string {
+	return filepath.Join(p.mediaFolder(), name)
+}
+
+func (p *Player) partialPath(name string) string {
+	return p.MediaPath(name) + partialSuffix
+}
+
+func (p *Player) ensureFolders() error {
+	return os.MkdirAll(p.mediaFolder(), 0755)
+}
+
+func (p *Player) loadConfig() error {
+	data, err := os.ReadFile(filepath.Join(p.Root, configFileName))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	config := &tvcontrol.TvConfig{}
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return err
+	}
+	p.config = config
+	return nil
+}
+
+func (p *Player) saveConfig(config *tvcontrol.TvConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(p.Root, configFileName)
+	err = os.WriteFile(name+partialSuffix, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(name+partialSuffix, name)
+}
+
+// getReceivedOffset returns the amount of bytes received for the file
+// and whether the file is already complete
+func (p *Player) getReceivedOffset(name string) (int64, bool) {
+	if fi, err := os.Stat(p.MediaPath(name)); err == nil && !fi.IsDir() {
+		return fi.Size(), true
+	}
+	if fi, err := os.Stat(p.partialPath(name)); err == nil && !fi.IsDir() {
+		return fi.Size(), false
+	}
+	return 0, false
+}
+
+// writeChunk stores the chunk and, when the file is complete, checks its hash if it is known;
+// a file with the wrong hash is removed, so that it is received again from the beginning
+func (p *Player) writeChunk(name string, offset int64, data []byte, total int64, hash string) (int64, error) {
+	partial := p.partialPath(name)
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Seek(offset, io.SeekStart)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Truncate(offset + int64(len(data)))
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return 0, err
+	}
+	current := offset + int64(len(data))
+	if current == total {
+		if hash != "" {
+			digest, err := tvcontrol.CalculateFileDigest(partial)
+			if err != nil {
+				return 0, err
+			}
+			if !strings.EqualFold(digest, hash) {
+				os.Remove(partial)
+				return 0, errFileHashMismatch
+			}
+		}
+		err = os.Rename(partial, p.MediaPath(name))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return current, nil
+}
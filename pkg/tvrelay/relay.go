@@ -0,0 +1,202 @@
+/***********************************************************************
+TV Relay
+Copyright 2024 by Volodymyr Dobryvechir (vdobryvechir@gmail.com)
+************************************************************************/
+
+// Package tvrelay runs tvengine as a caching proxy of a remote site: upstream it is
+// a single player of the central server, locally it sends the received config and
+// files to the tv pcs of its own tvpc table and reports their progress in its status.
+package tvrelay
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Dobryvechir/microcore/pkg/dvlog"
+	"github.com/Dobryvechir/microcore/pkg/dvparser"
+	"github.com/VDobryvechir/tvengine/pkg/tvcontrol"
+	"github.com/VDobryvechir/tvengine/pkg/tvplayer"
+)
+
+// the received files are kept under HTML_PATH, so the local workers send them as they are
+const relayFolder = "/relay/"
+const tvpcApi = "api/v1/tvpc"
+
+// pause between attempts to register at the central server
+const registerRetryDelay = 30 * time.Second
+
+type Relay struct {
+	Player *tvplayer.Player
+	// Upstream is the url of the central server, Name and Url are the tvpc record of the relay there
+	Upstream string
+	Name     string
+	Url      string
+	Client   *http.Client
+	mu       sync.Mutex
+	version  string
+}
+
+type tvpcRecord struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	Url  string `json:"url"`
+}
+
+// NewRelay keeps the received config and files in HTML_PATH/relay
+func NewRelay(htmlPath string) (*Relay, error) {
+	player, err := tvplayer.NewPlayer(filepath.Join(htmlPath, relayFolder))
+	if err != nil {
+		return nil, err
+	}
+	r := &Relay{Player: player, Client: &http.Client{Timeout: 30 * time.Second}}
+	player.OnChange = r.onChange
+	player.StatusInfo = r.statusInfo
+	if config := player.Config(); config != nil {
+		r.version = tvcontrol.GetRelayConfigVersion(config)
+	}
+	return r, nil
+}
+
+// getRealFiles gives the received files relative to HTML_PATH
+func getRealFiles(config *tvcontrol.TvConfig) []string {
+	res := make([]string, len(config.File))
+	for i, name := range config.File {
+		res[i] = relayFolder + "media/" + name
+	}
+	return res
+}
+
+func (r *Relay) onChange(config *tvcontrol.TvConfig, ready bool) {
+	if !ready {
+		return
+	}
+	err := tvcontrol.DistributeRelayConfig(config, getRealFiles(config))
+	if err != nil {
+		dvlog.PrintError(err)
+		return
+	}
+	r.mu.Lock()
+	r.version = tvcontrol.GetRelayConfigVersion(config)
+	r.mu.Unlock()
+}
+
+func (r *Relay) statusInfo() map[string]interface{} {
+	r.mu.Lock()
+	version := r.version
+	r.mu.Unlock()
+	if version == "" {
+		return nil
+	}
+	progress, err := tvcontrol.GetRelayProgress(version)
+	if err != nil {
+		dvlog.PrintError(err)
+		return nil
+	}
+	return map[string]interface{}{"relay": progress}
+}
+
+func (r *Relay) call(method string, api string, body interface{}, result interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, r.Upstream+api, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode >= 300 {
+		return errors.New(strconv.Itoa(res.StatusCode) + " " + method + " " + api + " " + string(data))
+	}
+	return json.Unmarshal(data, result)
+}
+
+// Register creates the tvpc record of the relay at the central server unless its url is there
+func (r *Relay) Register() (string, error) {
+	var list []*tvpcRecord
+	err := r.call(http.MethodGet, tvpcApi, nil, &list)
+	if err != nil {
+		return "", err
+	}
+	for _, tvpc := range list {
+		if tvpc != nil && strings.TrimSuffix(tvpc.Url, "/") == strings.TrimSuffix(r.Url, "/") {
+			return tvpc.Id, nil
+		}
+	}
+	res := &tvpcRecord{}
+	err = r.call(http.MethodPost, tvpcApi, &tvpcRecord{Name: r.Name, Url: r.Url}, res)
+	if err != nil {
+		return "", err
+	}
+	if res.Id == "" {
+		return "", errors.New("central server did not return id for " + r.Name)
+	}
+	return res.Id, nil
+}
+
+func (r *Relay) registerUntilDone() {
+	for {
+		id, err := r.Register()
+		if err == nil {
+			dvlog.PrintfFullOnly("Relay %s is tvpc %s at %s", r.Url, id, r.Upstream)
+			return
+		}
+		dvlog.PrintError(err)
+		time.Sleep(registerRetryDelay)
+	}
+}
+
+// RunRelay starts the relay when TVSERVER_RELAY_LISTEN is set; TVSERVER_RELAY_UPSTREAM is
+// the central server, TVSERVER_RELAY_URL is the url of the relay for it, TVSERVER_RELAY_NAME
+// is the tvpc name; the properties are read after the server has loaded them
+func RunRelay() {
+	go runRelayThread()
+}
+
+func runRelayThread() {
+	time.Sleep(5 * time.Second)
+	listen := dvparser.GetByGlobalPropertiesOrDefault("TVSERVER_RELAY_LISTEN", "")
+	if listen == "" {
+		return
+	}
+	r, err := NewRelay(dvparser.GetByGlobalPropertiesOrDefault("HTML_PATH", ""))
+	if err != nil {
+		dvlog.PrintError(err)
+		return
+	}
+	r.Upstream = dvparser.GetByGlobalPropertiesOrDefault("TVSERVER_RELAY_UPSTREAM", "")
+	r.Url = dvparser.GetByGlobalPropertiesOrDefault("TVSERVER_RELAY_URL", "")
+	r.Name = dvparser.GetByGlobalPropertiesOrDefault("TVSERVER_RELAY_NAME", "relay")
+	if r.Upstream != "" && r.Url != "" {
+		if !strings.HasSuffix(r.Upstream, "/") {
+			r.Upstream += "/"
+		}
+		go r.registerUntilDone()
+	}
+	dvlog.PrintfFullOnly("Relay listens at %s", listen)
+	err = http.ListenAndServe(listen, r.Player)
+	if err != nil {
+		dvlog.PrintError(err)
+	}
+}